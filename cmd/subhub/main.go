@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"flag"
+	"github.com/screencloud/subhub/pubsub"
 	"github.com/screencloud/subhub/server"
+	"github.com/screencloud/subhub/xredis"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type Inventory struct {
@@ -66,13 +70,38 @@ func main() {
 	f := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
 	// Parse flags
+	// redis addresses are host:port or redis://[[user]:password@]host:port[/db], rediss:// for tls
 	f.StringVar(&opts.WebSocketAddress, "http", "0.0.0.0:8081", "Address to bind http for ws and sockjs")
 	f.StringVar(&opts.RedisMasterAddress, "master", "127.0.0.1:6379", "Address of redis master, writes go to master")
 	f.StringVar(&opts.RedisSlaveAddress, "slave", "127.0.0.1:6379", "Address of redis slave, reads go to slave")
 	f.StringVar(&psOpts.RedisPubAddress, "pub", "127.0.0.1:6379", "Address of redis pub server, used only for publish")
 	f.StringVar(&psOpts.RedisSubAddress, "sub", "127.0.0.1:6379", "Address of redis sub server, used only for subsciptions")
-	f.IntVar(&psOpts.PubSubMode, "psmode", 1, "Pub sub mode 1: normal (default) 2: firehose")
+	f.IntVar(&opts.RedisPool.MaxActive, "redis-pool-size", opts.RedisPool.MaxActive, "Most redis connections in use at once to each of master and slave, 0 for no limit")
+	f.IntVar(&opts.RedisPool.MaxIdle, "redis-pool-idle", opts.RedisPool.MaxIdle, "Most idle redis connections kept for reuse")
+	f.DurationVar(&opts.RedisPool.IdleTimeout, "redis-idle-timeout", opts.RedisPool.IdleTimeout, "Close redis connections idle for longer than this")
+	var redisTimeout time.Duration
+	f.DurationVar(&redisTimeout, "redis-timeout", opts.RedisPool.ReadTimeout, "Dial, read and write timeout for redis commands")
+	var sentinels string
+	f.StringVar(&sentinels, "sentinels", "", "Comma separated addresses of redis sentinels, overrides master, slave, pub and sub")
+	f.StringVar(&opts.RedisSentinelMaster, "sentinel-master", "mymaster", "Name of the master the sentinels monitor")
+	var shards string
+	f.StringVar(&shards, "shards", "", "Comma separated addresses of redis servers to spread channels over, keyspace notifications stay on sub")
+	f.IntVar(&psOpts.PubSubMode, "psmode", 1, "Pub sub mode 1: normal (default) 2: firehose 4: memory, single node without redis pub/sub 8: nats")
+	var natsServers, natsRoutes string
+	f.StringVar(&natsServers, "nats", "", "Comma separated urls of nats servers for -psmode 8, defaults to the embedded server")
+	f.BoolVar(&psOpts.NatsEmbedded, "nats-embedded", false, "Run a nats server in process for -psmode 8")
+	f.StringVar(&psOpts.NatsListen, "nats-listen", "127.0.0.1:4222", "Client address of the embedded nats server")
+	f.StringVar(&psOpts.NatsClusterListen, "nats-cluster", "", "Route address of the embedded nats server, for other nodes to connect to")
+	f.StringVar(&natsRoutes, "nats-routes", "", "Comma separated route addresses of the other nodes embedded nats servers")
+	f.IntVar(&psOpts.FanoutWorkers, "fanout-workers", psOpts.FanoutWorkers, "Goroutines delivering messages to local sockets, 0 delivers in the publishing goroutine")
+	f.IntVar(&psOpts.AppQueueSize, "app-queue-size", psOpts.AppQueueSize, "Messages from redis an app can have waiting before new ones are dropped")
+	var appWeights string
+	f.StringVar(&appWeights, "app-weights", "", "Comma separated app_id=weight, apps get weight messages dispatched per round, default 1")
+	f.StringVar(&psOpts.Envelope, "envelope", psOpts.Envelope, "How messages are sent between nodes, json or binary once every node reads binary")
+	f.IntVar(&psOpts.EnvelopeCompressAbove, "envelope-compress-above", psOpts.EnvelopeCompressAbove, "Binary envelopes larger than this many bytes are compressed, 0 never compresses")
+	f.IntVar(&psOpts.DedupeWindow, "dedupe-window", psOpts.DedupeWindow, "Message ids each node remembers to drop repeats, 0 remembers none")
 	f.StringVar(&psOpts.PubSubNodeId, "psid", "", "Pub sub node id. Auto generated if not set")
+	f.StringVar(&opts.Store, "store", server.STORE_REDIS, "Where shared state is kept, redis or memory for a single node without redis")
 	f.BoolVar(&opts.Debug, "debug", false, "Enable debug logging.")
 
 	// log.Println("args", os.Args)
@@ -81,7 +110,54 @@ func main() {
 		log.Println("problem", err)
 	}
 
-	log.Printf("options: %+v", opts)
+	opts.RedisPool.DialTimeout = redisTimeout
+	opts.RedisPool.ReadTimeout = redisTimeout
+	opts.RedisPool.WriteTimeout = redisTimeout
+	if sentinels != "" {
+		opts.RedisSentinelAddresses = strings.Split(sentinels, ",")
+		psOpts.RedisSentinelAddresses = opts.RedisSentinelAddresses
+		psOpts.RedisSentinelMaster = opts.RedisSentinelMaster
+	}
+	if shards != "" {
+		psOpts.RedisShardAddresses = strings.Split(shards, ",")
+	}
+	if natsServers != "" {
+		psOpts.NatsServers = strings.Split(natsServers, ",")
+	}
+	if natsRoutes != "" {
+		psOpts.NatsRoutes = strings.Split(natsRoutes, ",")
+	}
+	if psOpts.Envelope != pubsub.ENVELOPE_JSON && psOpts.Envelope != pubsub.ENVELOPE_BINARY {
+		log.Fatalln("invalid envelope", psOpts.Envelope)
+	}
+	if appWeights != "" {
+		psOpts.AppWeights = make(map[string]int)
+		for _, pair := range strings.Split(appWeights, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			weight := 0
+			if len(parts) == 2 {
+				weight, _ = strconv.Atoi(parts[1])
+			}
+			if weight <= 0 {
+				log.Fatalln("invalid app weight", pair)
+			}
+			psOpts.AppWeights[parts[0]] = weight
+		}
+	}
+	opts.PubSub = psOpts
+
+	// dont log redis passwords
+	logged := opts
+	logged.RedisMasterAddress = xredis.RedactURL(opts.RedisMasterAddress)
+	logged.RedisSlaveAddress = xredis.RedactURL(opts.RedisSlaveAddress)
+	logged.PubSub.RedisPubAddress = xredis.RedactURL(opts.PubSub.RedisPubAddress)
+	logged.PubSub.RedisSubAddress = xredis.RedactURL(opts.PubSub.RedisSubAddress)
+	logged.RedisPool.Password = ""
+	logged.PubSub.RedisShardAddresses = nil
+	for _, address := range opts.PubSub.RedisShardAddresses {
+		logged.PubSub.RedisShardAddresses = append(logged.PubSub.RedisShardAddresses, xredis.RedactURL(address))
+	}
+	log.Printf("options: %+v", logged)
 
 	// opts.PubSub.PubSubMode = 2 // firehose!
 
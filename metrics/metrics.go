@@ -0,0 +1,292 @@
+// Package metrics is a small collection of counters, gauges and histograms
+// that can be scraped by prometheus using its text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+type Registry struct {
+	lock    sync.RWMutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// DefaultRegistry is what the New* functions register with and Handler serves
+var DefaultRegistry = NewRegistry()
+
+func (reg *Registry) register(name string, m metric) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	reg.names[name] = true
+	reg.metrics = append(reg.metrics, m)
+}
+
+// WriteText writes every metric in the text exposition format
+func (reg *Registry) WriteText(buf *bytes.Buffer) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	for _, m := range reg.metrics {
+		m.write(buf)
+	}
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	reg.WriteText(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Handler serves the default registry, mount it on /metrics
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+// desc is the name, help and label names shared by all metric types
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// key joins label values so they can be used as a map key
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) labelPairs(key string, extra ...string) string {
+	pairs := make([]string, 0, len(d.labels)+1)
+	if len(d.labels) > 0 {
+		for idx, val := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", d.labels[idx], escapeLabel(val)))
+		}
+	}
+	for idx := 0; idx+1 < len(extra); idx += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[idx], escapeLabel(extra[idx+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// values holds a float per set of label values
+type values struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func (v *values) add(delta float64, labelValues []string) {
+	key := v.key(labelValues)
+	v.lock.Lock()
+	v.values[key] += delta
+	v.lock.Unlock()
+}
+
+func (v *values) set(val float64, labelValues []string) {
+	key := v.key(labelValues)
+	v.lock.Lock()
+	v.values[key] = val
+	v.lock.Unlock()
+}
+
+func (v *values) write(buf *bytes.Buffer) {
+	v.writeHeader(buf)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", v.name, v.labelPairs(key), formatFloat(v.values[key]))
+	}
+}
+
+type Counter struct {
+	values
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{values{desc: desc{name, help, "counter", labels}, values: make(map[string]float64)}}
+	DefaultRegistry.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot go down")
+	}
+	c.add(delta, labelValues)
+}
+
+type Gauge struct {
+	values
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{values{desc: desc{name, help, "gauge", labels}, values: make(map[string]float64)}}
+	DefaultRegistry.register(name, g)
+	return g
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.add(-1, labelValues)
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+func (g *Gauge) Set(val float64, labelValues ...string) {
+	g.set(val, labelValues)
+}
+
+// GaugeFunc is a gauge without labels whose value is read when scraped
+type GaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func NewGaugeFunc(name string, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc{name, help, "gauge", nil}, f}
+	DefaultRegistry.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	g.writeHeader(buf)
+	fmt.Fprintf(buf, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// DefaultBuckets suit latencies measured in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type histogramValues struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValues
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValues),
+	}
+	DefaultRegistry.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(val float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for idx, upper := range h.buckets {
+		if val <= upper {
+			hv.counts[idx]++
+		}
+	}
+	hv.sum += val
+	hv.count++
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.writeHeader(buf)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for idx, upper := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(upper)), hv.counts[idx])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(hv.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, h.labelPairs(key), hv.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
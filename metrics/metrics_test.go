@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// text writes the default registry, the metrics each test adds to it have
+// names of their own
+func text() string {
+	buf := &bytes.Buffer{}
+	DefaultRegistry.WriteText(buf)
+	return buf.String()
+}
+
+func expectLines(t *testing.T, lines ...string) {
+	out := text()
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A counter.", "app")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`b"\`)
+	expectLines(t,
+		"# HELP test_counter_total A counter.",
+		"# TYPE test_counter_total counter",
+		`test_counter_total{app="a"} 3`,
+		`test_counter_total{app="b\"\\"} 1`,
+	)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a counter going down to panic")
+		}
+	}()
+	c.Add(-1, "a")
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A gauge.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	NewGaugeFunc("test_gauge_func", "A gauge read when scraped.", func() float64 { return 1.5 })
+	expectLines(t, "test_gauge 1", "test_gauge_func 1.5")
+	g.Set(7)
+	expectLines(t, "test_gauge 7")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "A histogram.", []float64{0.1, 1})
+	for _, val := range []float64{0.05, 0.5, 5} {
+		h.Observe(val)
+	}
+	expectLines(t,
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+	)
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	NewCounter("test_twice_total", "Registered twice.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a duplicate name to panic")
+		}
+	}()
+	NewCounter("test_twice_total", "Registered twice.")
+}
+
+func TestLabelCountPanics(t *testing.T) {
+	c := NewCounter("test_labels_total", "Two labels.", "app", "reason")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected the wrong number of label values to panic")
+		}
+	}()
+	c.Inc("app")
+}
@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"github.com/screencloud/subhub/xredis"
+	"sync"
+	"time"
+)
+
+// Publishes to redis are batched per shard. The shards publisher takes what
+// has queued up, waits up to PUBLISH_BATCH_WINDOW for more, and sends the lot
+// as one pipeline. There is one publisher per shard sending in queue order, so
+// each channels messages reach redis in the order they were published. Once
+// the shard is closed every publish still queued, or published after, fails
+// with ErrDisconnected, so no callback is left waiting.
+
+const (
+	PUBLISH_BATCH_WINDOW = 1 * time.Millisecond
+	PUBLISH_BATCH_SIZE   = 256  // most PUBLISH commands in one pipeline
+	PUBLISH_QUEUE_SIZE   = 4096 // publishes waiting before callers block
+)
+
+// PublishCallback gets how many subscribers and nodes a PublishAsync reached,
+// it runs on the publisher goroutine so it should be quick
+type PublishCallback func(num int64, err error)
+
+type publishRequest struct {
+	channel  string
+	payload  string
+	callback PublishCallback
+}
+
+type batcher struct {
+	sh    *shard
+	queue chan *publishRequest
+	quit  chan bool // closed with the shard
+
+	// held to enqueue, so once stop has set closed nothing more is queued
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newBatcher(sh *shard) *batcher {
+	return &batcher{
+		sh:    sh,
+		queue: make(chan *publishRequest, PUBLISH_QUEUE_SIZE),
+		quit:  make(chan bool),
+	}
+}
+
+func (b *batcher) publish(channel string, payload string, callback PublishCallback) {
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		callback(0, ErrDisconnected)
+		return
+	}
+	b.queue <- &publishRequest{channel: channel, payload: payload, callback: callback}
+	b.lock.RUnlock()
+}
+
+func (b *batcher) stop() {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return
+	}
+	b.closed = true
+	b.lock.Unlock()
+	close(b.quit)
+}
+
+// drain fails what was queued before the shard closed
+func (b *batcher) drain() {
+	for {
+		select {
+		case req := <-b.queue:
+			req.callback(0, ErrDisconnected)
+		default:
+			return
+		}
+	}
+}
+
+func (b *batcher) run() {
+	batch := make([]*publishRequest, 0, PUBLISH_BATCH_SIZE)
+	for {
+		select {
+		case req := <-b.queue:
+			batch = append(batch[:0], req)
+		case <-b.quit:
+			b.drain()
+			return
+		}
+		timer := time.NewTimer(PUBLISH_BATCH_WINDOW)
+	collect:
+		for len(batch) < PUBLISH_BATCH_SIZE {
+			select {
+			case req := <-b.queue:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.send(batch)
+	}
+}
+
+func (b *batcher) send(batch []*publishRequest) {
+	publishBatchHistogram.Observe(float64(len(batch)))
+	pl := b.sh.pub().Pipeline()
+	for _, req := range batch {
+		pl.Command("PUBLISH", req.channel, req.payload)
+	}
+	replies, err := pl.Exec()
+	for idx, req := range batch {
+		var num int64 = 0
+		replyErr := err
+		if replyErr == nil {
+			num, replyErr = xredis.IntegerReply(replies[idx])
+		}
+		req.callback(num, replyErr)
+	}
+}
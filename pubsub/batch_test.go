@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchedPublish(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.ln.Close()
+	address := fr.ln.Addr().String()
+	ps := New(&Options{PubSubNodeId: "test", RedisPubAddress: address, RedisSubAddress: address})
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	local := &testSubscriber{id: "local"}
+	ps.Subscribe(local, "a")
+
+	channels := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	counts := map[string][]int64{}
+	for idx := 0; idx < 300; idx++ {
+		channel := channels[idx%len(channels)]
+		wg.Add(1)
+		ps.PublishAsync(nil, channel, &Message{Name: strconv.Itoa(idx)}, func(num int64, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			lock.Lock()
+			counts[channel] = append(counts[channel], num)
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for _, channel := range channels {
+		// the local subscriber on a as well as the one from redis
+		expected := int64(1)
+		if channel == "a" {
+			expected = 2
+		}
+		for _, num := range counts[channel] {
+			if num != expected {
+				t.Fatalf("expected %s to reach %d got %d", channel, expected, num)
+			}
+		}
+		fr.lock.Lock()
+		published := fr.published[channel]
+		fr.lock.Unlock()
+		if len(published) != 100 {
+			t.Fatalf("expected 100 on %s got %d", channel, len(published))
+		}
+		last := -1
+		for _, payload := range published {
+			msg := &Message{}
+			json.Unmarshal([]byte(payload), msg)
+			idx, _ := strconv.Atoi(msg.Name)
+			if idx <= last {
+				t.Fatalf("%s published out of order, %d after %d", channel, idx, last)
+			}
+			last = idx
+		}
+	}
+
+	// an error only fails its own publish
+	if _, err := ps.Publish(nil, "bad", &Message{Name: "bad"}); err == nil {
+		t.Errorf("expected an error publishing to bad")
+	}
+	if num, err := ps.Publish(nil, "b", &Message{Name: "good"}); err != nil || num != 1 {
+		t.Errorf("expected 1 and no error got %d %v", num, err)
+	}
+}
+
+// publishes racing the shard being removed all get an answer
+func TestPublishAcrossClose(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.ln.Close()
+	address := fr.ln.Addr().String()
+	ps := New(&Options{PubSubNodeId: "test", RedisPubAddress: address, RedisSubAddress: address})
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sh := ps.(*pubsub).primary
+	done := make(chan error, 1000)
+	var wg sync.WaitGroup
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				sh.batcher.publish("a", "payload", func(num int64, err error) {
+					done <- err
+				})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	sh.close()
+	wg.Wait()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 1000; i++ {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatalf("only %d of 1000 publishes were answered", i)
+		}
+	}
+	// and after
+	var err error
+	sh.batcher.publish("a", "payload", func(num int64, publishErr error) { err = publishErr })
+	if err != ErrDisconnected {
+		t.Errorf("expected a publish after close to fail got %v", err)
+	}
+}
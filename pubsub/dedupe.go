@@ -0,0 +1,72 @@
+package pubsub
+
+import (
+	"github.com/screencloud/subhub/uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+// Every message is stamped with a version 7 uuid when it is first published,
+// publishers can set their own for a resend to keep the id it was first sent
+// with. Each node remembers the last few ids it delivered and drops repeats,
+// the window is a count rather than a time so its memory use is bounded.
+
+const DEDUPE_WINDOW = 10000 // ids remembered
+
+type dedupe struct {
+	lock sync.Mutex
+	seen map[string]bool
+	ids  []string // ring of the ids in seen, oldest at next
+	next int
+}
+
+// newDedupe returns nil for no window, which lets everything through
+func newDedupe(size int) *dedupe {
+	if size <= 0 {
+		return nil
+	}
+	return &dedupe{
+		seen: make(map[string]bool, size),
+		ids:  make([]string, size),
+	}
+}
+
+// repeat records id, returning true if it was already in the window.
+// Messages without an id, like keyspace notifications, are never repeats.
+func (d *dedupe) repeat(id string) bool {
+	if d == nil || id == "" {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.seen[id] {
+		duplicatesCounter.Inc()
+		return true
+	}
+	delete(d.seen, d.ids[d.next])
+	d.ids[d.next] = id
+	d.seen[id] = true
+	d.next = (d.next + 1) % len(d.ids)
+	return false
+}
+
+// stamp fills in who published msg, from where and when unless the publisher
+// already said when, and gives it an id if it has none. It returns false if the id was delivered here already.
+func stamp(msg *Message, pub Publisher, nodeId string, d *dedupe) bool {
+	if pub != nil {
+		msg.Sender = pub.ID()
+	}
+	msg.NodeId = nodeId
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixNano() // utc?
+	}
+	if msg.Id == "" {
+		msg.Id = uuid.NewV7().String()
+	}
+	if d.repeat(msg.Id) {
+		log.Println("skip, already delivered", msg.Id)
+		return false
+	}
+	return true
+}
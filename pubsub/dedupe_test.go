@@ -0,0 +1,54 @@
+package pubsub
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	d := newDedupe(3)
+	for _, id := range []string{"a", "b", "c"} {
+		if d.repeat(id) {
+			t.Errorf("expected %s to be new", id)
+		}
+	}
+	if !d.repeat("a") || !d.repeat("c") {
+		t.Errorf("expected a and c to be repeats")
+	}
+	// d pushes a out of the window
+	d.repeat("d")
+	if d.repeat("a") {
+		t.Errorf("expected a to have been forgotten")
+	}
+	if d.repeat("") || d.repeat("") {
+		t.Errorf("expected messages without ids to go through")
+	}
+	var none *dedupe
+	if none.repeat("a") || none.repeat("a") {
+		t.Errorf("expected no window to let everything through")
+	}
+}
+
+func TestPublishDedupe(t *testing.T) {
+	ps := New(&Options{PubSubMode: PubSubModeMemory, PubSubNodeId: "test", DedupeWindow: 100})
+	sub := &testSubscriber{id: "sub"}
+	ps.Subscribe(sub, "chat")
+	msg := &Message{Name: "hello"}
+	ps.Publish(nil, "chat", msg)
+	if msg.Id == "" {
+		t.Fatalf("expected the message to be given an id")
+	}
+	// a resend with the same id
+	if num, _ := ps.Publish(nil, "chat", &Message{Id: msg.Id, Name: "hello"}); num != 0 {
+		t.Errorf("expected the repeat to be dropped, went to %d", num)
+	}
+	ids := map[string]bool{msg.Id: true}
+	for idx := 0; idx < 10; idx++ {
+		msg := &Message{Name: strconv.Itoa(idx)}
+		ps.Publish(nil, "chat", msg)
+		ids[msg.Id] = true
+	}
+	if sub.count() != 11 || len(ids) != 11 {
+		t.Errorf("expected 11 messages with their own ids, got %d and %d ids", sub.count(), len(ids))
+	}
+}
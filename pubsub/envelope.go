@@ -0,0 +1,143 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Messages cross between nodes in an envelope. Nodes have always sent JSON,
+// the binary envelope is smaller and cheaper to build, the data isnt escaped
+// into a JSON string and large bodies are compressed. Every node reads both,
+// a JSON envelope always starts with '{' and a binary one with its version
+// byte, so for a rolling upgrade nodes keep sending JSON until none of the
+// old ones are left and are then switched over to binary.
+//
+// binary version 1 is
+//   version byte, flags byte, then the body, deflated when the flag is set
+//   body is name, data, sender, node id, app id, each a uvarint length then
+//   the bytes, the timestamp as a varint, then the id like the strings and
+//   the channel sequence number as a varint
+// Fields added later go on the end, readers ignore what follows the fields
+// they know and leave missing ones empty, so they dont need a new version.
+
+const (
+	ENVELOPE_JSON   = "json"
+	ENVELOPE_BINARY = "binary"
+
+	ENVELOPE_BINARY_V1       byte = 0x01
+	ENVELOPE_FLAG_COMPRESSED byte = 0x01
+
+	// bodies larger than this are compressed
+	ENVELOPE_COMPRESS_ABOVE = 1024
+)
+
+var ErrEnvelopeTruncated = errors.New("pubsub: envelope truncated")
+
+func encodeEnvelope(msg *Message, format string, compressAbove int) ([]byte, error) {
+	if format != ENVELOPE_BINARY {
+		return json.Marshal(msg)
+	}
+	var body bytes.Buffer
+	for _, field := range []string{msg.Name, msg.Data, msg.Sender, msg.NodeId, msg.AppId} {
+		writeEnvelopeString(&body, field)
+	}
+	var varint [binary.MaxVarintLen64]byte
+	body.Write(varint[:binary.PutVarint(varint[:], msg.Timestamp)])
+	writeEnvelopeString(&body, msg.Id)
+	body.Write(varint[:binary.PutVarint(varint[:], msg.Seq)])
+
+	flags := byte(0)
+	payload := body.Bytes()
+	if compressAbove > 0 && len(payload) > compressAbove {
+		var compressed bytes.Buffer
+		w, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+		w.Write(payload)
+		w.Close()
+		// random data can come out bigger
+		if compressed.Len() < len(payload) {
+			payload = compressed.Bytes()
+			flags |= ENVELOPE_FLAG_COMPRESSED
+		}
+	}
+	buf := make([]byte, 2, 2+len(payload))
+	buf[0], buf[1] = ENVELOPE_BINARY_V1, flags
+	return append(buf, payload...), nil
+}
+
+func writeEnvelopeString(buf *bytes.Buffer, s string) {
+	var varint [binary.MaxVarintLen64]byte
+	buf.Write(varint[:binary.PutUvarint(varint[:], uint64(len(s)))])
+	buf.WriteString(s)
+}
+
+func decodeEnvelope(buf []byte) (*Message, error) {
+	if len(buf) == 0 {
+		return nil, ErrEnvelopeTruncated
+	}
+	msg := &Message{}
+	switch buf[0] {
+	case '{':
+		err := json.Unmarshal(buf, msg)
+		return msg, err
+	case ENVELOPE_BINARY_V1:
+	default:
+		return nil, fmt.Errorf("pubsub: unknown envelope version %d", buf[0])
+	}
+	if len(buf) < 2 {
+		return nil, ErrEnvelopeTruncated
+	}
+	flags, body := buf[1], buf[2:]
+	if flags&^ENVELOPE_FLAG_COMPRESSED != 0 {
+		return nil, fmt.Errorf("pubsub: unknown envelope flags %d", flags)
+	}
+	if flags&ENVELOPE_FLAG_COMPRESSED != 0 {
+		r := flate.NewReader(bytes.NewReader(body))
+		defer r.Close()
+		var err error
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	for _, field := range []*string{&msg.Name, &msg.Data, &msg.Sender, &msg.NodeId, &msg.AppId} {
+		if body, err = readEnvelopeString(body, field); err != nil {
+			return nil, err
+		}
+	}
+	timestamp, size := binary.Varint(body)
+	if size <= 0 {
+		return nil, ErrEnvelopeTruncated
+	}
+	msg.Timestamp = timestamp
+	body = body[size:]
+	// added since, missing from older nodes
+	if len(body) > 0 {
+		if body, err = readEnvelopeString(body, &msg.Id); err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > 0 {
+		seq, size := binary.Varint(body)
+		if size <= 0 {
+			return nil, ErrEnvelopeTruncated
+		}
+		msg.Seq = seq
+	}
+	return msg, nil
+}
+
+// readEnvelopeString reads a length prefixed string into s and returns what
+// follows it
+func readEnvelopeString(body []byte, s *string) ([]byte, error) {
+	n, size := binary.Uvarint(body)
+	if size <= 0 || uint64(len(body)-size) < n {
+		return nil, ErrEnvelopeTruncated
+	}
+	*s = string(body[size : size+int(n)])
+	return body[size+int(n):], nil
+}
@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+)
+
+var testEnvelopeMessage = &Message{
+	Id:        "0157d6a1-3e00-7abc-8def-0123456789ab",
+	Name:      "update",
+	Data:      `{"playlist":"7f0c2a","items":["intro","menu","specials"]}`,
+	Sender:    "socket",
+	Timestamp: 1476861600000000000,
+	NodeId:    "node",
+	AppId:     "app",
+	Seq:       1042,
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	for _, format := range []string{ENVELOPE_JSON, ENVELOPE_BINARY} {
+		buf, err := encodeEnvelope(testEnvelopeMessage, format, ENVELOPE_COMPRESS_ABOVE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := decodeEnvelope(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if *msg != *testEnvelopeMessage {
+			t.Errorf("%s: expected %+v got %+v", format, testEnvelopeMessage, msg)
+		}
+	}
+}
+
+func TestEnvelopeBinaryIsSmaller(t *testing.T) {
+	jsonBuf, _ := encodeEnvelope(testEnvelopeMessage, ENVELOPE_JSON, 0)
+	binaryBuf, _ := encodeEnvelope(testEnvelopeMessage, ENVELOPE_BINARY, 0)
+	if len(binaryBuf) >= len(jsonBuf) {
+		t.Errorf("expected binary %d to be smaller than json %d", len(binaryBuf), len(jsonBuf))
+	}
+}
+
+func TestEnvelopeCompressed(t *testing.T) {
+	msg := *testEnvelopeMessage
+	msg.Data = strings.Repeat(msg.Data, 100)
+	buf, _ := encodeEnvelope(&msg, ENVELOPE_BINARY, ENVELOPE_COMPRESS_ABOVE)
+	if buf[1]&ENVELOPE_FLAG_COMPRESSED == 0 || len(buf) >= len(msg.Data) {
+		t.Fatalf("expected %d bytes to be compressed, got %d", len(msg.Data), len(buf))
+	}
+	decoded, err := decodeEnvelope(buf)
+	if err != nil || decoded.Data != msg.Data {
+		t.Errorf("unexpected decode %v", err)
+	}
+	// below the threshold is left alone
+	if buf, _ = encodeEnvelope(testEnvelopeMessage, ENVELOPE_BINARY, ENVELOPE_COMPRESS_ABOVE); buf[1] != 0 {
+		t.Errorf("expected a small message not to be compressed")
+	}
+}
+
+// what nodes sent before there were envelopes
+func TestEnvelopeOldJSON(t *testing.T) {
+	msg, err := decodeEnvelope([]byte(`{"name":"update","data":"{\"a\":1}","sender":"s","timestamp":5,"node_id":"old"}`))
+	if err != nil || msg.Name != "update" || msg.Data != `{"a":1}` || msg.NodeId != "old" || msg.Timestamp != 5 {
+		t.Errorf("unexpected decode %+v %v", msg, err)
+	}
+}
+
+// what binary nodes sent before messages had ids
+func TestEnvelopeWithoutId(t *testing.T) {
+	msg := *testEnvelopeMessage
+	msg.Id = ""
+	msg.Seq = 0
+	buf, _ := encodeEnvelope(&msg, ENVELOPE_BINARY, 0)
+	decoded, err := decodeEnvelope(buf[:len(buf)-2]) // the empty ids length and the seq
+	if err != nil || *decoded != msg {
+		t.Errorf("unexpected decode %+v %v", decoded, err)
+	}
+}
+
+// what binary nodes sent before messages had sequence numbers
+func TestEnvelopeWithoutSeq(t *testing.T) {
+	msg := *testEnvelopeMessage
+	msg.Seq = 0
+	buf, _ := encodeEnvelope(&msg, ENVELOPE_BINARY, 0)
+	decoded, err := decodeEnvelope(buf[:len(buf)-1])
+	if err != nil || *decoded != msg {
+		t.Errorf("unexpected decode %+v %v", decoded, err)
+	}
+}
+
+func TestEnvelopeInvalid(t *testing.T) {
+	buf, _ := encodeEnvelope(testEnvelopeMessage, ENVELOPE_BINARY, 0)
+	for _, invalid := range [][]byte{
+		nil,
+		{0x7f, 0},
+		{ENVELOPE_BINARY_V1},
+		{ENVELOPE_BINARY_V1, 0x80},
+		buf[:len(buf)-1],
+		buf[:10],
+	} {
+		if _, err := decodeEnvelope(invalid); err == nil {
+			t.Errorf("expected an error decoding %v", invalid)
+		}
+	}
+}
+
+func benchmarkEnvelope(b *testing.B, format string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, _ := encodeEnvelope(testEnvelopeMessage, format, ENVELOPE_COMPRESS_ABOVE)
+		decodeEnvelope(buf)
+	}
+}
+
+func BenchmarkEnvelopeJSON(b *testing.B) {
+	benchmarkEnvelope(b, ENVELOPE_JSON)
+}
+
+func BenchmarkEnvelopeBinary(b *testing.B) {
+	benchmarkEnvelope(b, ENVELOPE_BINARY)
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"sync"
+)
+
+// Messages from redis are queued per app and dispatched round robin, each app
+// with messages waiting gets up to its weight in messages per round, so one
+// busy app cant starve the rest off the subscriber loop. Once an app has its
+// cap of messages waiting new ones are dropped, and reported to the
+// DropHandler. Messages whose fan-out worker is full are dropped the same way
+// rather than holding up every other app. Keyspace notifications and messages without an app share the
+// "" queue.
+
+const (
+	APP_QUEUE_SIZE = 10000 // messages an app can have waiting
+	APP_WEIGHT     = 1     // messages per round for apps without a weight
+)
+
+// DropHandler is called for each message dropped because its app had too
+// many waiting or its channel couldnt keep up
+type DropHandler func(appId string, channel string)
+
+type pendingMessage struct {
+	appId   string
+	channel string
+	msg     *Message
+}
+
+type appQueue struct {
+	appId    string
+	weight   int
+	messages []*pendingMessage
+}
+
+type fairScheduler struct {
+	lock    sync.Mutex
+	size    int
+	weights map[string]int
+	queues  map[string]*appQueue
+	active  []*appQueue // apps with messages waiting, in dispatch order
+	wake    chan bool
+
+	deliver     func(channel string, msg *Message) bool
+	dropHandler DropHandler
+}
+
+func newFairScheduler(size int, weights map[string]int, deliver func(string, *Message) bool) *fairScheduler {
+	if size <= 0 {
+		size = APP_QUEUE_SIZE
+	}
+	return &fairScheduler{
+		size:    size,
+		weights: weights,
+		queues:  make(map[string]*appQueue),
+		wake:    make(chan bool, 1),
+		deliver: deliver,
+	}
+}
+
+func (fs *fairScheduler) handleDrops(handler DropHandler) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.dropHandler = handler
+}
+
+// push queues msg for dispatch, it returns false if it was dropped
+func (fs *fairScheduler) push(appId string, channel string, msg *Message) bool {
+	fs.lock.Lock()
+	q, ok := fs.queues[appId]
+	if !ok {
+		weight := fs.weights[appId]
+		if weight <= 0 {
+			weight = APP_WEIGHT
+		}
+		q = &appQueue{appId: appId, weight: weight}
+		fs.queues[appId] = q
+	}
+	if len(q.messages) >= fs.size {
+		fs.lock.Unlock()
+		fs.dropped(appId, channel)
+		return false
+	}
+	q.messages = append(q.messages, &pendingMessage{appId: appId, channel: channel, msg: msg})
+	if len(q.messages) == 1 {
+		fs.active = append(fs.active, q)
+	}
+	fs.lock.Unlock()
+	appQueuedGauge.Inc()
+	select {
+	case fs.wake <- true:
+	default: // already woken
+	}
+	return true
+}
+
+func (fs *fairScheduler) dropped(appId string, channel string) {
+	fs.lock.Lock()
+	handler := fs.dropHandler
+	fs.lock.Unlock()
+	droppedCounter.Inc()
+	if handler != nil {
+		handler(appId, channel)
+	}
+}
+
+// next takes the next apps share of messages, or nil when nothing is waiting
+func (fs *fairScheduler) next() []*pendingMessage {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if len(fs.active) == 0 {
+		return nil
+	}
+	q := fs.active[0]
+	fs.active = fs.active[1:]
+	n := q.weight
+	if n > len(q.messages) {
+		n = len(q.messages)
+	}
+	batch := q.messages[:n:n]
+	q.messages = q.messages[n:]
+	if len(q.messages) > 0 {
+		fs.active = append(fs.active, q) // back of the line
+	} else {
+		q.messages = nil
+		delete(fs.queues, q.appId)
+	}
+	appQueuedGauge.Add(-float64(n))
+	return batch
+}
+
+func (fs *fairScheduler) run() {
+	for {
+		batch := fs.next()
+		if batch == nil {
+			<-fs.wake
+			continue
+		}
+		for _, pending := range batch {
+			if !fs.deliver(pending.channel, pending.msg) {
+				fs.dropped(pending.appId, pending.channel)
+			}
+		}
+	}
+}
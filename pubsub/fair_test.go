@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain dispatches everything waiting, returning the app of each message in
+// the order they went out
+func drain(fs *fairScheduler) []string {
+	order := []string{}
+	for batch := fs.next(); batch != nil; batch = fs.next() {
+		for _, pending := range batch {
+			order = append(order, pending.msg.AppId)
+		}
+	}
+	return order
+}
+
+func pushN(fs *fairScheduler, appId string, n int) int {
+	queued := 0
+	for idx := 0; idx < n; idx++ {
+		if fs.push(appId, "channel", &Message{AppId: appId}) {
+			queued++
+		}
+	}
+	return queued
+}
+
+func TestFairRoundRobin(t *testing.T) {
+	fs := newFairScheduler(0, nil, nil)
+	pushN(fs, "noisy", 100)
+	pushN(fs, "quiet", 3)
+	order := drain(fs)
+	if len(order) != 103 {
+		t.Fatalf("expected 103 messages got %d", len(order))
+	}
+	// quiet is not stuck behind everything noisy sent first
+	if got := strings.Join(order[:6], ","); got != "noisy,quiet,noisy,quiet,noisy,quiet" {
+		t.Errorf("expected apps to alternate got %s", got)
+	}
+}
+
+func TestFairWeights(t *testing.T) {
+	fs := newFairScheduler(0, map[string]int{"big": 3}, nil)
+	pushN(fs, "big", 6)
+	pushN(fs, "small", 6)
+	order := drain(fs)
+	if got := strings.Join(order[:8], ","); got != "big,big,big,small,big,big,big,small" {
+		t.Errorf("expected 3 big for each small got %s", got)
+	}
+}
+
+func TestFairDrops(t *testing.T) {
+	fs := newFairScheduler(10, nil, nil)
+	dropped := map[string]int{}
+	fs.handleDrops(func(appId string, channel string) {
+		dropped[appId]++
+	})
+	if queued := pushN(fs, "noisy", 15); queued != 10 {
+		t.Errorf("expected 10 queued got %d", queued)
+	}
+	if queued := pushN(fs, "quiet", 5); queued != 5 {
+		t.Errorf("expected quiet to be unaffected got %d", queued)
+	}
+	if dropped["noisy"] != 5 || dropped["quiet"] != 0 {
+		t.Errorf("unexpected drops %v", dropped)
+	}
+	// room again once dispatched
+	drain(fs)
+	if queued := pushN(fs, "noisy", 1); queued != 1 {
+		t.Errorf("expected noisy to queue again")
+	}
+}
+
+func TestFairRun(t *testing.T) {
+	sub := &testSubscriber{id: "sub"}
+	fs := newFairScheduler(0, nil, func(channel string, msg *Message) bool {
+		sub.Receive(channel, msg)
+		return true
+	})
+	go fs.run()
+	fs.push("app", "chat", &Message{Name: "hello"})
+	if !waitForCount(sub, 1) {
+		t.Errorf("expected the message to be dispatched")
+	}
+}
+
+func TestFairFullFanout(t *testing.T) {
+	ps := New(&Options{PubSubNodeId: "test", FanoutWorkers: 2}).(*pubsub)
+	// a channel on the other worker
+	quiet := "quiet"
+	for idx := 0; ps.fanout.worker(quiet) == ps.fanout.worker("noisy"); idx++ {
+		quiet = "quiet" + strconv.Itoa(idx)
+	}
+	blocking := &blockingSubscriber{release: make(chan bool)}
+	defer close(blocking.release)
+	ps.registry.add(blocking, "noisy")
+	sub := &testSubscriber{id: "sub"}
+	ps.registry.add(sub, quiet)
+	var lock sync.Mutex
+	dropped := map[string]int{}
+	ps.HandleDrops(func(appId string, channel string) {
+		lock.Lock()
+		dropped[appId]++
+		lock.Unlock()
+	})
+	go ps.fair.run()
+
+	// one held by the worker, a queue full and then some
+	for idx := 0; idx < FANOUT_QUEUE_SIZE+10; idx++ {
+		ps.fair.push("noisy", "noisy", &Message{AppId: "noisy"})
+	}
+	ps.fair.push("quiet", quiet, &Message{AppId: "quiet"})
+	if !waitForCount(sub, 1) {
+		t.Fatalf("expected quiet to be dispatched while noisy's worker is stuck")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lock.Lock()
+		noisy := dropped["noisy"]
+		lock.Unlock()
+		if noisy > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if dropped["noisy"] == 0 || dropped["quiet"] != 0 {
+		t.Errorf("expected only noisy to be dropped got %v", dropped)
+	}
+}
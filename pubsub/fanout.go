@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// Fan-out hands a message to a channels local subscribers. With workers it
+// happens off the publishing goroutine, so one big channel doesnt hold up
+// delivery on the others. A channel always goes to the same worker, so its
+// messages arrive in the order they were published, messages on different
+// channels can arrive in any order.
+
+const (
+	FANOUT_QUEUE_SIZE = 1024            // messages waiting per worker before publishers block
+	FANOUT_SLOW_LAG   = 1 * time.Second // channels slower than this get logged
+)
+
+type fanoutJob struct {
+	channel string
+	msg     *Message
+	list    []interface{}
+	encoder FrameEncoder
+	queued  time.Time
+}
+
+type fanout struct {
+	queues []chan *fanoutJob
+}
+
+// newFanout returns nil for no workers, delivering in the publishing goroutine
+func newFanout(workers int) *fanout {
+	if workers <= 0 {
+		return nil
+	}
+	f := &fanout{queues: make([]chan *fanoutJob, workers)}
+	for idx := range f.queues {
+		f.queues[idx] = make(chan *fanoutJob, FANOUT_QUEUE_SIZE)
+		go f.work(f.queues[idx])
+	}
+	return f
+}
+
+// send delivers msg to the subscribers in list, skipping its sender, and
+// returns how many it goes to. With workers it returns before they get it.
+func (f *fanout) send(encoder FrameEncoder, channel string, msg *Message, list []interface{}) int64 {
+	num, _ := f.enqueue(encoder, channel, msg, list, true)
+	return num
+}
+
+// trySend is send without waiting on a full worker queue, it returns false
+// and drops msg when the channels worker is that far behind
+func (f *fanout) trySend(encoder FrameEncoder, channel string, msg *Message, list []interface{}) (int64, bool) {
+	return f.enqueue(encoder, channel, msg, list, false)
+}
+
+func (f *fanout) enqueue(encoder FrameEncoder, channel string, msg *Message, list []interface{}, wait bool) (int64, bool) {
+	var num int64 = 0
+	for _, item := range list {
+		if item.(Subscriber).ID() != msg.Sender {
+			num++
+		}
+	}
+	if num == 0 {
+		return 0, true
+	}
+	job := &fanoutJob{
+		channel: channel,
+		msg:     msg,
+		list:    list,
+		encoder: encoder,
+		queued:  time.Now(),
+	}
+	if f == nil {
+		job.run()
+		return num, true
+	}
+	// the publisher may reuse its message once we return
+	local := *msg
+	job.msg = &local
+	queue := f.queues[f.worker(channel)]
+	if wait {
+		fanoutQueuedGauge.Inc()
+		queue <- job
+		return num, true
+	}
+	select {
+	case queue <- job:
+		fanoutQueuedGauge.Inc()
+		return num, true
+	default:
+		return 0, false
+	}
+}
+
+func (f *fanout) worker(channel string) int {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return int(h.Sum32() % uint32(len(f.queues)))
+}
+
+func (f *fanout) work(queue chan *fanoutJob) {
+	for job := range queue {
+		fanoutQueuedGauge.Dec()
+		job.run()
+	}
+}
+
+func (job *fanoutJob) run() {
+	msg := framed(job.encoder, job.channel, job.msg)
+	for _, item := range job.list {
+		sub := item.(Subscriber)
+		if sub.ID() == msg.Sender {
+			continue // dont send to self
+		}
+		sub.Receive(job.channel, msg)
+		deliveredCounter.Inc()
+	}
+	lag := time.Since(job.queued)
+	fanoutLagHistogram.Observe(lag.Seconds())
+	slowChannels.record(job.channel, lag, len(job.list), time.Now())
+	if lag > FANOUT_SLOW_LAG {
+		log.Printf("slow fan-out on %s, %d subscribers took %s", job.channel, len(job.list), lag)
+	}
+}
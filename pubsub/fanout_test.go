@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blockingSubscriber holds up its fan-out worker until released
+type blockingSubscriber struct {
+	release chan bool
+}
+
+func (bs *blockingSubscriber) ID() string { return "blocking" }
+func (bs *blockingSubscriber) Receive(channel string, msg *Message) {
+	<-bs.release
+}
+
+func waitForCount(ts *testSubscriber, n int) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.count() < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return ts.count() == n
+}
+
+func TestFanoutOrder(t *testing.T) {
+	ps := New(&Options{PubSubMode: PubSubModeMemory, PubSubNodeId: "test", FanoutWorkers: 4})
+	a, b := &testSubscriber{id: "a"}, &testSubscriber{id: "b"}
+	ps.Subscribe(a, "chat")
+	ps.Subscribe(b, "chat")
+	for idx := 0; idx < 500; idx++ {
+		if num, _ := ps.Publish(a, "chat", &Message{Name: strconv.Itoa(idx)}); num != 1 {
+			t.Fatalf("expected 1 delivery got %d", num)
+		}
+	}
+	if !waitForCount(b, 500) {
+		t.Fatalf("expected 500 messages got %d", b.count())
+	}
+	for idx, received := range b.received {
+		if received != "chat "+strconv.Itoa(idx) {
+			t.Fatalf("message %d out of order, got %s", idx, received)
+		}
+	}
+	if a.count() != 0 {
+		t.Errorf("expected the sender to be skipped")
+	}
+}
+
+func TestFanoutSlowChannel(t *testing.T) {
+	ps := New(&Options{PubSubMode: PubSubModeMemory, PubSubNodeId: "test", FanoutWorkers: 2})
+	f := ps.(*memory).fanout
+	// a channel on the other worker
+	fast := "fast"
+	for idx := 0; f.worker(fast) == f.worker("slow"); idx++ {
+		fast = "fast" + strconv.Itoa(idx)
+	}
+	blocking := &blockingSubscriber{release: make(chan bool)}
+	defer close(blocking.release)
+	ps.Subscribe(blocking, "slow")
+	sub := &testSubscriber{id: "sub"}
+	ps.Subscribe(sub, fast)
+
+	ps.Publish(nil, "slow", &Message{Name: "stuck"})
+	ps.Publish(nil, fast, &Message{Name: "through"})
+	if !waitForCount(sub, 1) {
+		t.Errorf("expected %s to be delivered while slow is stuck", fast)
+	}
+}
+
+func TestLagTracker(t *testing.T) {
+	lt := newLagTracker(2, time.Minute)
+	now := time.Now()
+	lt.record("quick", FANOUT_TRACK_LAG/2, 1, now)
+	lt.record("a", 100*time.Millisecond, 5, now)
+	lt.record("a", 300*time.Millisecond, 7, now)
+	lt.record("b", 200*time.Millisecond, 1, now)
+	// only room for two, c pushes out b but d is too quick to get in
+	lt.record("c", time.Second, 1, now)
+	lt.record("d", 60*time.Millisecond, 1, now)
+
+	slowest := lt.slowest(now)
+	if len(slowest) != 2 || slowest[0].Channel != "c" || slowest[1].Channel != "a" {
+		t.Fatalf("expected c then a got %+v", slowest)
+	}
+	if a := slowest[1]; a.MaxLagMs != 300 || a.Slow != 2 || a.Subscribers != 7 {
+		t.Errorf("unexpected lag for a %+v", a)
+	}
+
+	// once they havent been slow for the window they go
+	lt.record("a", 100*time.Millisecond, 7, now.Add(45*time.Second))
+	if slowest := lt.slowest(now.Add(90 * time.Second)); len(slowest) != 1 || slowest[0].Channel != "a" {
+		t.Errorf("expected only a left got %+v", slowest)
+	}
+}
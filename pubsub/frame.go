@@ -0,0 +1,18 @@
+package pubsub
+
+// FrameEncoder builds what local subscribers send on for a message on a
+// channel. It is called once per message and channel, rather than once per
+// subscriber, and every subscriber gets the same frame in Message.Frame.
+// Returning "" leaves the frame empty for subscribers to build their own.
+type FrameEncoder func(channel string, msg *Message) string
+
+// framed returns a copy of msg with its frame for channel built, the callers
+// message is left alone as it may be published again on another channel
+func framed(encoder FrameEncoder, channel string, msg *Message) *Message {
+	if encoder == nil {
+		return msg
+	}
+	local := *msg
+	local.Frame = encoder(channel, msg)
+	return &local
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The lag histogram cant say which channels are slow, channels are too many
+// to label. Instead the slowest few channels over the last few minutes are
+// kept, by the worst lag each had, for the stats api. Fan-outs quicker than
+// FANOUT_TRACK_LAG are skipped, so the usual case doesnt take the lock.
+
+const (
+	FANOUT_TRACK_LAG     = 50 * time.Millisecond
+	FANOUT_SLOW_CHANNELS = 10              // channels kept
+	FANOUT_SLOW_WINDOW   = 5 * time.Minute // a channel is forgotten once it hasnt been slow for this long
+)
+
+type ChannelLag struct {
+	Channel     string `json:"channel"`
+	MaxLagMs    int64  `json:"max_lag_ms"`
+	Slow        int    `json:"slow"`        // fan-outs slower than FANOUT_TRACK_LAG
+	Subscribers int    `json:"subscribers"` // when it was slowest
+
+	seen time.Time
+}
+
+type lagTracker struct {
+	lock     sync.Mutex
+	size     int
+	window   time.Duration
+	channels map[string]*ChannelLag
+}
+
+func newLagTracker(size int, window time.Duration) *lagTracker {
+	return &lagTracker{size: size, window: window, channels: make(map[string]*ChannelLag)}
+}
+
+var slowChannels = newLagTracker(FANOUT_SLOW_CHANNELS, FANOUT_SLOW_WINDOW)
+
+// SlowChannels returns the slowest channels fanned out on this node lately,
+// slowest first
+func SlowChannels() []*ChannelLag {
+	return slowChannels.slowest(time.Now())
+}
+
+func (lt *lagTracker) record(channel string, lag time.Duration, subscribers int, now time.Time) {
+	if lag < FANOUT_TRACK_LAG {
+		return
+	}
+	ms := int64(lag / time.Millisecond)
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.forget(now)
+	cl, ok := lt.channels[channel]
+	if !ok {
+		if len(lt.channels) >= lt.size {
+			// make room by dropping the quickest, unless this is quicker still
+			var quickest *ChannelLag
+			for _, other := range lt.channels {
+				if quickest == nil || other.MaxLagMs < quickest.MaxLagMs {
+					quickest = other
+				}
+			}
+			if quickest.MaxLagMs >= ms {
+				return
+			}
+			delete(lt.channels, quickest.Channel)
+		}
+		cl = &ChannelLag{Channel: channel}
+		lt.channels[channel] = cl
+	}
+	cl.Slow++
+	cl.seen = now
+	if ms >= cl.MaxLagMs {
+		cl.MaxLagMs = ms
+		cl.Subscribers = subscribers
+	}
+}
+
+// forget drops channels that havent been slow within the window
+func (lt *lagTracker) forget(now time.Time) {
+	for channel, cl := range lt.channels {
+		if now.Sub(cl.seen) > lt.window {
+			delete(lt.channels, channel)
+		}
+	}
+}
+
+func (lt *lagTracker) slowest(now time.Time) []*ChannelLag {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.forget(now)
+	list := make([]*ChannelLag, 0, len(lt.channels))
+	for _, cl := range lt.channels {
+		copied := *cl
+		list = append(list, &copied)
+	}
+	sort.Sort(slowestFirst(list))
+	return list
+}
+
+type slowestFirst []*ChannelLag
+
+func (s slowestFirst) Len() int           { return len(s) }
+func (s slowestFirst) Less(i, j int) bool { return s[i].MaxLagMs > s[j].MaxLagMs }
+func (s slowestFirst) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,240 @@
+package pubsub
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// memory is a PubSub that never leaves the process, for a single node or for
+// tests. Messages only reach local subscribers and occupancy is just the local
+// subscriber count. Nothing publishes keyspace notifications, so subscribers
+// to those topics never hear anything.
+//
+// Occupancy changes are queued in order under the lock and handed to the
+// handler one at a time, by whichever goroutine finds nobody else doing so,
+// so a topic is never reported vacated before the occupied it follows.
+
+var ErrShardsUnsupported = errors.New("pubsub: shards are only supported with redis pub/sub")
+
+type memory struct {
+	lock sync.RWMutex
+	opts *Options
+
+	registry *registry
+	fanout   *fanout
+	dedupe   *dedupe
+
+	occupancyHandler OccupancyHandler
+	frameEncoder     FrameEncoder
+
+	// occupancy changes waiting for the handler, see flushOccupancy
+	notifyLock  sync.Mutex
+	notifyQueue []*occupancyChange
+	notifying   bool
+}
+
+type occupancyChange struct {
+	sub      Subscriber
+	topic    string
+	occupied bool
+}
+
+func newMemory(opts *Options) *memory {
+	return &memory{
+		opts:     opts,
+		registry: newRegistry(),
+		fanout:   newFanout(opts.FanoutWorkers),
+		dedupe:   newDedupe(opts.DedupeWindow),
+	}
+}
+
+func (m *memory) Start() error {
+	log.Println("pubsub in memory, messages stay on this node")
+	return nil
+}
+
+func (m *memory) SetShards(addresses []string) error {
+	return ErrShardsUnsupported
+}
+
+func (m *memory) HandleOccupancy(handler OccupancyHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.occupancyHandler = handler
+}
+
+// HandleDrops does nothing, messages are never queued in memory
+func (m *memory) HandleDrops(handler DropHandler) {}
+
+func (m *memory) SetFrameEncoder(encoder FrameEncoder) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.frameEncoder = encoder
+}
+
+// notifyOccupancy is called without the lock, so the handler can use the pubsub
+func (m *memory) notifyOccupancy(sub Subscriber, topic string, occupied bool) {
+	m.lock.RLock()
+	handler := m.occupancyHandler
+	m.lock.RUnlock()
+	if handler != nil && tracksOccupancy(topic) {
+		handler(sub, topic, occupied)
+	}
+}
+
+// queueOccupancy is called with the lock held, so changes queue in the order
+// they happened
+func (m *memory) queueOccupancy(sub Subscriber, topic string, occupied bool) {
+	m.notifyLock.Lock()
+	m.notifyQueue = append(m.notifyQueue, &occupancyChange{sub, topic, occupied})
+	m.notifyLock.Unlock()
+}
+
+// flushOccupancy notifies the queued changes in order, unless another
+// goroutine, or a handler further up this one, is already doing so
+func (m *memory) flushOccupancy() {
+	m.notifyLock.Lock()
+	if m.notifying {
+		m.notifyLock.Unlock()
+		return
+	}
+	m.notifying = true
+	for len(m.notifyQueue) > 0 {
+		change := m.notifyQueue[0]
+		m.notifyQueue = m.notifyQueue[1:]
+		m.notifyLock.Unlock()
+		m.notifyOccupancy(change.sub, change.topic, change.occupied)
+		m.notifyLock.Lock()
+	}
+	m.notifyQueue = nil
+	m.notifying = false
+	m.notifyLock.Unlock()
+}
+
+func (m *memory) Subscribe(sub Subscriber, topic string) {
+	m.subscribe(sub, topic)
+}
+
+// subscribe returns how many local subscribers the topic has afterwards, or 0
+// when sub was already subscribed
+func (m *memory) subscribe(sub Subscriber, topic string) int {
+	log.Println("subscribe", topic)
+	m.lock.Lock()
+	numSubs := m.registry.add(sub, topic)
+	if numSubs == 1 {
+		m.queueOccupancy(sub, topic, true)
+	}
+	m.lock.Unlock()
+	if numSubs == 0 {
+		log.Println("already subscribed, return")
+		return 0 // dont sub again
+	}
+
+	subscriptionsGauge.Inc()
+	if numSubs == 1 {
+		topicsGauge.Inc()
+		m.flushOccupancy()
+	}
+	return numSubs
+}
+
+func (m *memory) Unsubscribe(sub Subscriber, topic string) {
+	m.unsubscribe(sub, topic)
+}
+
+// unsubscribe returns how many local subscribers the topic has left, or -1
+// when sub wasnt subscribed
+func (m *memory) unsubscribe(sub Subscriber, topic string) int {
+	log.Println("unsubscribe", topic)
+	m.lock.Lock()
+	numSubs := m.registry.remove(sub, topic)
+	if numSubs == 0 {
+		m.queueOccupancy(sub, topic, false)
+	}
+	m.lock.Unlock()
+	if numSubs < 0 {
+		return -1 // not subscribed
+	}
+
+	subscriptionsGauge.Dec()
+	if numSubs == 0 {
+		topicsGauge.Dec()
+		m.flushOccupancy()
+	}
+	return numSubs
+}
+
+func (m *memory) UnsubscribeAll(sub Subscriber) {
+	log.Println("unsubscribe all")
+	for _, topic := range m.SubscribedList(sub) {
+		m.Unsubscribe(sub, topic.(string))
+	}
+}
+
+func (m *memory) IsSubscribed(sub Subscriber, topic string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.registry.has(sub, topic)
+}
+
+func (m *memory) SubscribedList(sub Subscriber) []interface{} {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.registry.subscribed(sub)
+}
+
+func (m *memory) SubscriberList(topic string) []interface{} {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.registry.subscribers(topic)
+}
+
+// Publish hands the message to every local subscriber but the sender and
+// returns how many got it, none if it was delivered already
+func (m *memory) Publish(pub Publisher, channel string, msg *Message) (int64, error) {
+	if !stamp(msg, pub, m.opts.PubSubNodeId, m.dedupe) {
+		return 0, nil
+	}
+	return m.deliver(channel, msg), nil
+}
+
+// PublishAsync is Publish, the callback runs before it returns
+func (m *memory) PublishAsync(pub Publisher, channel string, msg *Message, callback PublishCallback) {
+	num, err := m.Publish(pub, channel, msg)
+	if callback != nil {
+		callback(num, err)
+	}
+}
+
+func (m *memory) deliver(channel string, msg *Message) int64 {
+	list := m.registry.match(channel)
+	if len(list) == 0 {
+		return 0
+	}
+	m.lock.RLock()
+	encoder := m.frameEncoder
+	m.lock.RUnlock()
+	return m.fanout.send(encoder, channel, msg, list)
+}
+
+// topicList lists the topics with local subscribers
+func (m *memory) topicList() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.registry.topicList()
+}
+
+// notifyGap tells local subscribers they may have missed messages, reason is
+// the JSON data of the gap event
+func (m *memory) notifyGap(topics []string, reason string) {
+	for _, topic := range topics {
+		m.deliver(topic, &Message{
+			Name:      EVENT_NAME_GAP,
+			Data:      reason,
+			NodeId:    m.opts.PubSubNodeId,
+			Timestamp: time.Now().UnixNano(),
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSubscriber struct {
+	id       string
+	lock     sync.Mutex
+	received []string
+}
+
+func (ts *testSubscriber) ID() string {
+	return ts.id
+}
+
+func (ts *testSubscriber) Receive(channel string, msg *Message) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.received = append(ts.received, channel+" "+msg.Name)
+}
+
+func (ts *testSubscriber) count() int {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return len(ts.received)
+}
+
+func newTestMemory() PubSub {
+	return New(&Options{PubSubMode: PubSubModeMemory, PubSubNodeId: "test"})
+}
+
+func TestMemoryPublish(t *testing.T) {
+	ps := newTestMemory()
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := &testSubscriber{id: "a"}, &testSubscriber{id: "b"}, &testSubscriber{id: "c"}
+	ps.Subscribe(a, "chat")
+	ps.Subscribe(a, "chat") // twice is once
+	ps.Subscribe(b, "chat")
+	ps.Subscribe(c, "other")
+
+	num, err := ps.Publish(a, "chat", &Message{Name: "hello"})
+	if err != nil || num != 1 {
+		t.Fatalf("expected 1 delivery got %d %v", num, err)
+	}
+	if a.count() != 0 || b.count() != 1 || c.count() != 0 {
+		t.Errorf("expected only b to receive, got %v %v %v", a.received, b.received, c.received)
+	}
+	if b.received[0] != "chat hello" {
+		t.Errorf("unexpected message %v", b.received)
+	}
+
+	// a publish without a publisher goes to everyone
+	if num, _ := ps.Publish(nil, "chat", &Message{Name: "all"}); num != 2 {
+		t.Errorf("expected 2 deliveries got %d", num)
+	}
+}
+
+func TestMemoryUnsubscribe(t *testing.T) {
+	ps := newTestMemory()
+	a := &testSubscriber{id: "a"}
+	ps.Subscribe(a, "one")
+	ps.Subscribe(a, "two")
+	if !ps.IsSubscribed(a, "one") || len(ps.SubscribedList(a)) != 2 {
+		t.Fatalf("expected two subscriptions got %v", ps.SubscribedList(a))
+	}
+	ps.Unsubscribe(a, "one")
+	if ps.IsSubscribed(a, "one") || len(ps.SubscriberList("one")) != 0 {
+		t.Error("expected to be unsubscribed from one")
+	}
+	ps.UnsubscribeAll(a)
+	if len(ps.SubscribedList(a)) != 0 || len(ps.SubscriberList("two")) != 0 {
+		t.Errorf("expected no subscriptions got %v", ps.SubscribedList(a))
+	}
+	if num, _ := ps.Publish(nil, "two", &Message{Name: "gone"}); num != 0 || a.count() != 0 {
+		t.Errorf("expected nothing delivered got %d", num)
+	}
+}
+
+func TestMemoryOccupancy(t *testing.T) {
+	ps := newTestMemory()
+	events := make([]string, 0)
+	ps.HandleOccupancy(func(sub Subscriber, topic string, occupied bool) {
+		if occupied {
+			events = append(events, "occupied "+topic)
+		} else {
+			events = append(events, "vacated "+topic)
+		}
+	})
+	a, b := &testSubscriber{id: "a"}, &testSubscriber{id: "b"}
+	ps.Subscribe(a, "room")
+	ps.Subscribe(b, "room")
+	ps.Subscribe(a, KEYSPACE_NOTIFICATION_PREFIX+"0__:key")
+	ps.Unsubscribe(a, "room")
+	ps.UnsubscribeAll(b)
+	if len(events) != 2 || events[0] != "occupied room" || events[1] != "vacated room" {
+		t.Errorf("unexpected occupancy events %v", events)
+	}
+}
+
+func TestMemoryOccupancyOrder(t *testing.T) {
+	ps := newTestMemory()
+	var lock sync.Mutex
+	events := make([]bool, 0)
+	ps.HandleOccupancy(func(sub Subscriber, topic string, occupied bool) {
+		if !occupied {
+			time.Sleep(time.Microsecond) // let the next occupied overtake if it can
+		}
+		lock.Lock()
+		events = append(events, occupied)
+		lock.Unlock()
+	})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(sub Subscriber) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				ps.Subscribe(sub, "room")
+				ps.Unsubscribe(sub, "room")
+			}
+		}(&testSubscriber{id: strconv.Itoa(w)})
+	}
+	wg.Wait()
+	lock.Lock()
+	defer lock.Unlock()
+	for idx, occupied := range events {
+		if occupied != (idx%2 == 0) {
+			t.Fatalf("expected occupied and vacated to alternate, event %d of %d is %v", idx, len(events), occupied)
+		}
+	}
+	if len(events)%2 != 0 {
+		t.Errorf("expected room to end vacated after %d events", len(events))
+	}
+}
+
+func TestMemoryShards(t *testing.T) {
+	if err := newTestMemory().SetShards([]string{"127.0.0.1:6379"}); err != ErrShardsUnsupported {
+		t.Errorf("expected ErrShardsUnsupported got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package pubsub
+
+import (
+	"github.com/screencloud/subhub/metrics"
+)
+
+var (
+	subscriptionsGauge = metrics.NewGauge("subhub_pubsub_subscriptions",
+		"Subscriptions held by local subscribers.")
+	topicsGauge = metrics.NewGauge("subhub_pubsub_topics",
+		"Topics with at least one local subscriber.")
+	deliveredCounter = metrics.NewCounter("subhub_messages_delivered_total",
+		"Messages handed to local subscribers.")
+	reconnectsCounter = metrics.NewCounter("subhub_redis_pubsub_reconnects_total",
+		"Times the redis subscriber connection has been re-established.")
+)
+
+// channels are too many to label, FANOUT_SLOW_LAG logs the slow ones by name
+// and SlowChannels keeps the slowest few, see lag.go
+var (
+	fanoutQueuedGauge = metrics.NewGauge("subhub_fanout_queued",
+		"Messages waiting for a fan-out worker.")
+	fanoutLagHistogram = metrics.NewHistogram("subhub_fanout_lag_seconds",
+		"Time from a message arriving on a channel to its last local subscriber getting it.", nil)
+)
+
+var (
+	appQueuedGauge = metrics.NewGauge("subhub_pubsub_app_queued",
+		"Messages from redis waiting to be dispatched.")
+	droppedCounter = metrics.NewCounter("subhub_pubsub_dropped_total",
+		"Messages from redis dropped because their app had too many waiting or their fan-out worker was full.")
+)
+
+var publishBatchHistogram = metrics.NewHistogram("subhub_redis_publish_batch_size",
+	"PUBLISH commands sent to redis in one pipeline.", []float64{1, 2, 4, 8, 16, 32, 64, 128, 256})
+
+var duplicatesCounter = metrics.NewCounter("subhub_pubsub_duplicates_total",
+	"Messages dropped because their id was delivered already.")
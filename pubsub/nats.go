@@ -0,0 +1,342 @@
+package pubsub
+
+import (
+	"bytes"
+	"fmt"
+	gnatsd "github.com/apcera/gnatsd/server"
+	"github.com/apcera/nats"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPubSub keeps local subscribers like memory and fans messages out to the
+// other nodes over NATS, one subject per channel that has local subscribers.
+// NATS drops messages for a subscriber that cant keep up rather than letting
+// it back up the server, local subscribers are then sent a gap event.
+// Each node can run an embedded gnatsd, routed to the other nodes, so a
+// cluster needs no outside services for pub/sub. Occupancy is per node and
+// keyspace notifications are not received, as neither goes through redis.
+
+const (
+	NATS_SUBJECT_PREFIX = "subhub.channel."
+	NATS_ROUTE_SCHEME   = "nats-route://"
+	NATS_DEFAULT_LISTEN = "127.0.0.1:4222"
+	NATS_START_TIMEOUT  = 5 * time.Second
+	NATS_RECONNECT_WAIT = time.Second
+	// messages buffered per subscription before nats counts us as a slow consumer
+	NATS_SUBSCRIPTION_PENDING = 65536
+)
+
+const GAP_REASON_SLOW_CONSUMER = `{"reason":"slow_consumer"}`
+
+type natsPubSub struct {
+	*memory
+	server *gnatsd.Server // embedded, nil when using outside servers
+
+	subLock       sync.Mutex
+	conn          *nats.Conn
+	subscriptions map[string]*nats.Subscription // topic to subscription
+}
+
+func newNats(opts *Options) *natsPubSub {
+	return &natsPubSub{
+		memory:        newMemory(opts),
+		subscriptions: make(map[string]*nats.Subscription),
+	}
+}
+
+// channelSubject maps a channel to a subject of its own, anything nats treats
+// specially, like the . token separator and the * and > wildcards, is escaped
+// as %XX so no channel can match another channels subject
+func channelSubject(channel string) string {
+	var buf bytes.Buffer
+	buf.WriteString(NATS_SUBJECT_PREFIX)
+	for idx := 0; idx < len(channel); idx++ {
+		c := channel[idx]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			strings.IndexByte("_-=@,;:", c) >= 0:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// subjectChannel reverses channelSubject
+func subjectChannel(subject string) (string, error) {
+	if !strings.HasPrefix(subject, NATS_SUBJECT_PREFIX) {
+		return "", fmt.Errorf("pubsub: %s is not a channel subject", subject)
+	}
+	escaped := subject[len(NATS_SUBJECT_PREFIX):]
+	channel := make([]byte, 0, len(escaped))
+	for idx := 0; idx < len(escaped); idx++ {
+		if escaped[idx] != '%' {
+			channel = append(channel, escaped[idx])
+			continue
+		}
+		if idx+2 >= len(escaped) {
+			return "", fmt.Errorf("pubsub: bad escape in subject %s", subject)
+		}
+		c, err := strconv.ParseUint(escaped[idx+1:idx+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("pubsub: bad escape in subject %s", subject)
+		}
+		channel = append(channel, byte(c))
+		idx += 2
+	}
+	return string(channel), nil
+}
+
+func (np *natsPubSub) Start() error {
+	if np.opts.NatsEmbedded {
+		if err := np.startServer(); err != nil {
+			log.Println("Unable to start embedded nats", err)
+			return err
+		}
+	}
+	opts := nats.DefaultOptions
+	opts.Servers = np.servers()
+	opts.Name = "subhub " + np.opts.PubSubNodeId
+	opts.MaxReconnect = -1 // forever
+	opts.ReconnectWait = NATS_RECONNECT_WAIT
+	opts.SubChanLen = NATS_SUBSCRIPTION_PENDING
+	opts.DisconnectedCB = func(conn *nats.Conn) {
+		log.Println("disconnected from nats")
+	}
+	opts.ReconnectedCB = func(conn *nats.Conn) {
+		// the subscriptions are made again by the client, but anything
+		// published while we were away is gone
+		log.Println("reconnected to nats", conn.ConnectedUrl())
+		np.notifyGap(np.topicList(), GAP_REASON_RECONNECT)
+	}
+	opts.AsyncErrorCB = np.asyncError
+	conn, err := opts.Connect()
+	if err != nil {
+		log.Println("Unable to connect to nats", opts.Servers, err)
+		if np.server != nil {
+			np.server.Shutdown()
+		}
+		return err
+	}
+	log.Println("pubsub connected to nats", conn.ConnectedUrl())
+	np.subLock.Lock()
+	np.conn = conn
+	np.subLock.Unlock()
+	// catch up with anyone subscribed before we were connected
+	for _, topic := range np.topicList() {
+		np.sync(topic)
+	}
+	return nil
+}
+
+func (np *natsPubSub) servers() []string {
+	if len(np.opts.NatsServers) > 0 {
+		return np.opts.NatsServers
+	}
+	if np.opts.NatsEmbedded {
+		return []string{"nats://" + np.listen()}
+	}
+	return []string{nats.DefaultURL}
+}
+
+func (np *natsPubSub) listen() string {
+	if np.opts.NatsListen == "" {
+		return NATS_DEFAULT_LISTEN
+	}
+	return np.opts.NatsListen
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	return host, port, err
+}
+
+// startServer runs gnatsd in this process, routed to the other nodes
+func (np *natsPubSub) startServer() error {
+	host, port, err := splitHostPort(np.listen())
+	if err != nil {
+		return err
+	}
+	opts := &gnatsd.Options{
+		Host:   host,
+		Port:   port,
+		NoLog:  true,
+		NoSigs: true,
+	}
+	if np.opts.NatsClusterListen != "" {
+		if opts.ClusterHost, opts.ClusterPort, err = splitHostPort(np.opts.NatsClusterListen); err != nil {
+			return err
+		}
+	}
+	for _, route := range np.opts.NatsRoutes {
+		if !strings.Contains(route, "://") {
+			route = NATS_ROUTE_SCHEME + route
+		}
+		routeURL, err := url.Parse(route)
+		if err != nil {
+			return err
+		}
+		opts.Routes = append(opts.Routes, routeURL)
+	}
+	server := gnatsd.New(opts)
+	go server.Start()
+
+	// Start doesnt return until shutdown, so wait for the listener
+	deadline := time.Now().Add(NATS_START_TIMEOUT)
+	for {
+		conn, err := net.DialTimeout("tcp", np.listen(), NATS_START_TIMEOUT)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			server.Shutdown()
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Println("embedded nats listening on", np.listen(), "routes", np.opts.NatsRoutes)
+	np.server = server
+	return nil
+}
+
+// close disconnects and stops the embedded server
+func (np *natsPubSub) close() {
+	np.subLock.Lock()
+	conn := np.conn
+	np.conn = nil
+	np.subscriptions = make(map[string]*nats.Subscription)
+	np.subLock.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if np.server != nil {
+		np.server.Shutdown()
+	}
+}
+
+func (np *natsPubSub) connection() *nats.Conn {
+	np.subLock.Lock()
+	defer np.subLock.Unlock()
+	return np.conn
+}
+
+// sync subscribes to the topics subject while it has local subscribers and
+// unsubscribes once it has none, it is idempotent so racing subscribes and
+// unsubscribes always settle on the right state
+func (np *natsPubSub) sync(topic string) {
+	np.subLock.Lock()
+	defer np.subLock.Unlock()
+	if np.conn == nil {
+		return // Start picks it up
+	}
+	want := len(np.SubscriberList(topic)) > 0
+	subscription, have := np.subscriptions[topic]
+	switch {
+	case want && !have:
+		subscription, err := np.conn.Subscribe(channelSubject(topic), np.receive)
+		if err != nil {
+			log.Println("unable to subscribe nats to", topic, err)
+			return
+		}
+		np.subscriptions[topic] = subscription
+	case !want && have:
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Println("unable to unsubscribe nats from", topic, err)
+		}
+		delete(np.subscriptions, topic)
+	}
+}
+
+func (np *natsPubSub) Subscribe(sub Subscriber, topic string) {
+	if np.subscribe(sub, topic) == 1 {
+		np.sync(topic)
+	}
+}
+
+func (np *natsPubSub) Unsubscribe(sub Subscriber, topic string) {
+	if np.unsubscribe(sub, topic) == 0 {
+		np.sync(topic)
+	}
+}
+
+func (np *natsPubSub) UnsubscribeAll(sub Subscriber) {
+	log.Println("unsubscribe all")
+	for _, topic := range np.SubscribedList(sub) {
+		np.Unsubscribe(sub, topic.(string))
+	}
+}
+
+// Publish delivers to local subscribers straight away and sends the message
+// on to the other nodes, the count is of local subscribers only
+func (np *natsPubSub) Publish(pub Publisher, channel string, msg *Message) (int64, error) {
+	if !stamp(msg, pub, np.opts.PubSubNodeId, np.dedupe) {
+		return 0, nil
+	}
+	num := np.deliver(channel, msg)
+	conn := np.connection()
+	if conn == nil || !conn.IsConnected() {
+		// fail fast rather than let the client buffer it
+		return num, ErrDisconnected
+	}
+	buf, err := encodeEnvelope(msg, np.opts.Envelope, np.opts.EnvelopeCompressAbove)
+	if err != nil {
+		log.Println("unable to encode envelope", err)
+		return num, err
+	}
+	return num, conn.Publish(channelSubject(channel), buf)
+}
+
+// PublishAsync is Publish, the nats client already buffers and sends in the
+// background
+func (np *natsPubSub) PublishAsync(pub Publisher, channel string, msg *Message, callback PublishCallback) {
+	num, err := np.Publish(pub, channel, msg)
+	if callback != nil {
+		callback(num, err)
+	}
+}
+
+func (np *natsPubSub) receive(natsMsg *nats.Msg) {
+	channel, err := subjectChannel(natsMsg.Subject)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	msg, err := decodeEnvelope(natsMsg.Data)
+	if err != nil {
+		log.Println("error decoding envelope", err.Error())
+		return
+	}
+	if msg.NodeId == np.opts.PubSubNodeId {
+		return // already delivered by Publish
+	}
+	if np.dedupe.repeat(msg.Id) {
+		return
+	}
+	np.deliver(channel, msg)
+}
+
+func (np *natsPubSub) asyncError(conn *nats.Conn, subscription *nats.Subscription, err error) {
+	if err != nats.ErrSlowConsumer || subscription == nil {
+		log.Println("nats error", err)
+		return
+	}
+	channel, cerr := subjectChannel(subscription.Subject)
+	if cerr != nil {
+		log.Println(cerr)
+		return
+	}
+	log.Println("nats dropped messages for slow consumer", channel)
+	np.notifyGap([]string{channel}, GAP_REASON_SLOW_CONSUMER)
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChannelSubject(t *testing.T) {
+	channels := map[string]string{
+		"chat":                    "subhub.channel.chat",
+		"presence-room.1":         "subhub.channel.presence-room%2E1",
+		"private-a*b>c":           "subhub.channel.private-a%2Ab%3Ec",
+		"__keyspace@0__:user:1":   "subhub.channel.__keyspace@0__:user:1",
+		"with space%":             "subhub.channel.with%20space%25",
+		"private-encrypted-=@,;x": "subhub.channel.private-encrypted-=@,;x",
+	}
+	for channel, subject := range channels {
+		if got := channelSubject(channel); got != subject {
+			t.Errorf("expected %s for %s got %s", subject, channel, got)
+		}
+		back, err := subjectChannel(subject)
+		if err != nil || back != channel {
+			t.Errorf("expected %s back from %s got %s %v", channel, subject, back, err)
+		}
+	}
+	for _, subject := range []string{"other.chat", "subhub.channel.bad%2", "subhub.channel.bad%zz"} {
+		if _, err := subjectChannel(subject); err == nil {
+			t.Errorf("expected an error for %s", subject)
+		}
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestNatsEmbeddedCluster(t *testing.T) {
+	clusterA := freeAddress(t)
+	a := newNats(&Options{PubSubMode: PubSubModeNats, PubSubNodeId: "a",
+		NatsEmbedded: true, NatsListen: freeAddress(t), NatsClusterListen: clusterA})
+	b := newNats(&Options{PubSubMode: PubSubModeNats, PubSubNodeId: "b",
+		NatsEmbedded: true, NatsListen: freeAddress(t), NatsClusterListen: freeAddress(t),
+		NatsRoutes: []string{clusterA}})
+	for _, np := range []*natsPubSub{a, b} {
+		if err := np.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer np.close()
+	}
+
+	local, remote := &testSubscriber{id: "local"}, &testSubscriber{id: "remote"}
+	a.Subscribe(local, "room.1")
+	b.Subscribe(remote, "room.1")
+
+	// the route between the servers takes a moment to come up
+	published := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for remote.count() == 0 && time.Now().Before(deadline) {
+		published++
+		if _, err := a.Publish(nil, "room.1", &Message{Name: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if remote.count() == 0 {
+		t.Fatal("message never reached the other node")
+	}
+	if remote.received[0] != "room.1 hello" {
+		t.Errorf("unexpected message %v", remote.received)
+	}
+	// the publishing node delivers locally once, not again off nats
+	time.Sleep(50 * time.Millisecond)
+	if local.count() != published {
+		t.Errorf("expected local to get each of %d messages once, got %d", published, local.count())
+	}
+
+	b.Unsubscribe(remote, "room.1")
+	if _, ok := b.subscriptions["room.1"]; ok {
+		t.Error("expected the nats subscription to be dropped")
+	}
+}
@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/screencloud/subhub/xredis"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Occupancy is tracked cluster wide in a redis hash per topic, holding the
+// number of subscribers each node has plus a running total. The total is what
+// decides when a topic becomes occupied or vacated, so exactly one node sees
+// each transition. Nodes heartbeat a key while they are alive, if one dies
+// another node takes its counts off the totals, and if it was only slow it
+// puts them back when it next heartbeats. The node count, the total and
+// the nodes topic set are changed together in a script, so a node dying part
+// way through cant leave them disagreeing.
+
+const (
+	REDIS_OCCUPANCY_HASH   = "subhub://pubsub/occupancy/%s"
+	REDIS_NODES_SET        = "subhub://pubsub/nodes"
+	REDIS_NODE_KEY         = "subhub://pubsub/node/%s"
+	REDIS_NODE_TOPICS_SET  = "subhub://pubsub/node/%s/topics"
+	OCCUPANCY_TOTAL_FIELD  = "total"
+	NODE_HEARTBEAT         = 10 * time.Second
+	NODE_HEARTBEAT_TIMEOUT = 30 * time.Second
+)
+
+// OccupancyHandler is called when the number of subscribers to a topic across
+// the whole cluster goes from 0 to 1 (occupied) or from 1 to 0 (vacated).
+// sub is the subscriber that caused it, or nil when the topic was vacated
+// because the node holding the subscribers went away, or occupied again when
+// that node came back.
+type OccupancyHandler func(sub Subscriber, topic string, occupied bool)
+
+func occupancyKey(topic string) string {
+	return fmt.Sprintf(REDIS_OCCUPANCY_HASH, topic)
+}
+
+func (ps *pubsub) HandleOccupancy(handler OccupancyHandler) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.occupancyHandler = handler
+}
+
+func (ps *pubsub) notifyOccupancy(sub Subscriber, topic string, occupied bool) {
+	ps.lock.RLock()
+	handler := ps.occupancyHandler
+	ps.lock.RUnlock()
+	if handler != nil {
+		handler(sub, topic, occupied)
+	}
+}
+
+// tracksOccupancy is false for internal topics, like keyspace notifications
+func tracksOccupancy(topic string) bool {
+	return !strings.HasPrefix(topic, KEYSPACE_NOTIFICATION_PREFIX)
+}
+
+// KEYS occupancy hash, node topics set ARGV node id, delta, topic
+var occupancyUpdateScript = xredis.NewScript(2, `
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])
+if count > 0 then
+	redis.call('SADD', KEYS[2], ARGV[3])
+else
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('SREM', KEYS[2], ARGV[3])
+end
+return redis.call('HINCRBY', KEYS[1], '`+OCCUPANCY_TOTAL_FIELD+`', ARGV[2])`)
+
+// KEYS occupancy hash ARGV node id, returns the total or nil when the node
+// had nothing to take off
+var occupancyRemoveNodeScript = xredis.NewScript(1, `
+local count = tonumber(redis.call('HGET', KEYS[1], ARGV[1])) or 0
+if redis.call('HDEL', KEYS[1], ARGV[1]) == 0 or count <= 0 then
+	return false
+end
+return redis.call('HINCRBY', KEYS[1], '`+OCCUPANCY_TOTAL_FIELD+`', -count)`)
+
+// updateOccupancy applies a subscribe (+1) or unsubscribe (-1) to the cluster
+// counts, or a whole topics count when the node rejoins
+func (ps *pubsub) updateOccupancy(sub Subscriber, topic string, delta int) {
+	if !tracksOccupancy(topic) {
+		return
+	}
+	nodeTopics := fmt.Sprintf(REDIS_NODE_TOPICS_SET, ps.opts.PubSubNodeId)
+	reply, err := ps.pub().Eval(occupancyUpdateScript, occupancyKey(topic), nodeTopics,
+		ps.opts.PubSubNodeId, strconv.Itoa(delta), topic)
+	if err != nil {
+		log.Println("problem updating occupancy", err)
+		return
+	}
+	total, err := xredis.IntegerReply(reply)
+	if err != nil {
+		log.Println("problem updating occupancy", err)
+		return
+	}
+	switch {
+	case delta > 0 && total == int64(delta):
+		ps.notifyOccupancy(sub, topic, true)
+	case delta < 0 && total == 0:
+		ps.notifyOccupancy(sub, topic, false)
+	}
+}
+
+func (ps *pubsub) occupancyLoop() {
+	for {
+		ps.sweepDeadNodes()
+		time.Sleep(NODE_HEARTBEAT)
+		ps.heartbeat()
+	}
+}
+
+// heartbeat keeps the node alive, and back in the nodes set if another node
+// took it out while we were too slow to heartbeat. The node that took it out
+// also took its counts off, so they are put back. Start sends the first
+// heartbeat before anything can subscribe, so joining doesnt count twice.
+func (ps *pubsub) heartbeat() {
+	nodeKey := fmt.Sprintf(REDIS_NODE_KEY, ps.opts.PubSubNodeId)
+	err := ps.pub().Setex(nodeKey, int(NODE_HEARTBEAT_TIMEOUT/time.Second), strconv.FormatInt(time.Now().Unix(), 10))
+	if err != nil {
+		log.Println("problem sending node heartbeat", err)
+	}
+	added, err := ps.pub().SAdd(REDIS_NODES_SET, ps.opts.PubSubNodeId)
+	if err != nil {
+		log.Println("problem adding node", err)
+		return
+	}
+	if added == 1 {
+		ps.restoreOccupancy()
+	}
+}
+
+// restoreOccupancy puts this nodes subscriber counts back after it was swept
+func (ps *pubsub) restoreOccupancy() {
+	ps.lock.RLock()
+	counts := ps.registry.counts()
+	ps.lock.RUnlock()
+	if len(counts) > 0 {
+		log.Println("node rejoined, restoring occupancy of", len(counts), "topics")
+	}
+	for topic, count := range counts {
+		ps.updateOccupancy(nil, topic, count)
+	}
+}
+
+// sweepDeadNodes removes the counts of any node whose heartbeat has expired,
+// firing vacated for topics that only it was holding open
+func (ps *pubsub) sweepDeadNodes() {
+	nodes, err := ps.pub().SMembers(REDIS_NODES_SET)
+	if err != nil {
+		log.Println("problem listing nodes", err)
+		return
+	}
+	for _, nodeId := range nodes {
+		if nodeId == ps.opts.PubSubNodeId {
+			continue
+		}
+		alive, err := ps.pub().Exists(fmt.Sprintf(REDIS_NODE_KEY, nodeId))
+		if err != nil || alive {
+			continue
+		}
+		// whoever removes it from the set does the clean up
+		if n, err := ps.pub().SRem(REDIS_NODES_SET, nodeId); err != nil || n == 0 {
+			continue
+		}
+		log.Println("node gone, removing its occupancy", nodeId)
+		nodeTopics := fmt.Sprintf(REDIS_NODE_TOPICS_SET, nodeId)
+		topics, err := ps.pub().SMembers(nodeTopics)
+		if err != nil {
+			log.Println("problem listing node topics", err)
+			continue
+		}
+		for _, topic := range topics {
+			ps.removeNodeOccupancy(nodeId, topic)
+		}
+		ps.pub().Del(nodeTopics)
+	}
+}
+
+func (ps *pubsub) removeNodeOccupancy(nodeId string, topic string) {
+	reply, err := ps.pub().Eval(occupancyRemoveNodeScript, occupancyKey(topic), nodeId)
+	if err != nil {
+		log.Println("problem removing node occupancy", err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+	total, err := xredis.IntegerReply(reply)
+	if err != nil {
+		log.Println("problem updating occupancy total", err)
+		return
+	}
+	if total <= 0 {
+		ps.notifyOccupancy(nil, topic, false)
+	}
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedisOccupancy(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.ln.Close()
+	address := fr.ln.Addr().String()
+	ps := New(&Options{PubSubNodeId: "test", RedisPubAddress: address, RedisSubAddress: address}).(*pubsub)
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	occupied := 0
+	ps.HandleOccupancy(func(sub Subscriber, topic string, isOccupied bool) {
+		if isOccupied {
+			occupied++
+		}
+	})
+
+	// the counts change in one script, the fake says the total is 1
+	sub := &testSubscriber{id: "sub"}
+	ps.Subscribe(sub, "a")
+	ps.Unsubscribe(sub, "a")
+	if occupied != 1 {
+		t.Errorf("expected occupied once got %d", occupied)
+	}
+	if fr.sent("EVALSHA") != 2 || fr.sent("HINCRBY") != 0 {
+		t.Errorf("expected 2 scripts and no HINCRBY got %d and %d", fr.sent("EVALSHA"), fr.sent("HINCRBY"))
+	}
+
+	// every heartbeat puts the node back in the set
+	deadline := time.Now().Add(5 * time.Second)
+	for fr.sent("SADD") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	added := fr.sent("SADD")
+	ps.heartbeat()
+	ps.heartbeat()
+	if fr.sent("SADD") != added+2 {
+		t.Errorf("expected the node added on each heartbeat got %d then %d", added, fr.sent("SADD"))
+	}
+}
+
+func TestRedisOccupancyRejoin(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.ln.Close()
+	address := fr.ln.Addr().String()
+	ps := New(&Options{PubSubNodeId: "test", RedisPubAddress: address, RedisSubAddress: address}).(*pubsub)
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ps.Subscribe(&testSubscriber{id: "sub"}, "a")
+	var restored []string
+	ps.HandleOccupancy(func(sub Subscriber, topic string, isOccupied bool) {
+		if isOccupied && sub == nil {
+			restored = append(restored, topic)
+		}
+	})
+
+	// still in the nodes set, nothing to put back
+	scripts := fr.sent("EVALSHA")
+	ps.heartbeat()
+	if fr.sent("EVALSHA") != scripts {
+		t.Errorf("expected no scripts got %d", fr.sent("EVALSHA")-scripts)
+	}
+	// swept by another node, the count goes back on and a is occupied again
+	fr.lock.Lock()
+	fr.swept = true
+	fr.lock.Unlock()
+	ps.heartbeat()
+	if fr.sent("EVALSHA") != scripts+1 {
+		t.Errorf("expected the count restored got %d scripts", fr.sent("EVALSHA")-scripts)
+	}
+	if len(restored) != 1 || restored[0] != "a" {
+		t.Errorf("expected a occupied again got %v", restored)
+	}
+}
@@ -1,12 +1,10 @@
 package pubsub
 
 import (
-	"encoding/json"
-	"github.com/apcera/gnatsd/sublist"
 	"github.com/screencloud/subhub/uuid"
-	"github.com/xuyu/goredis"
-	"gopkg.in/fatih/set.v0"
+	"github.com/screencloud/subhub/xredis"
 	"log"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +13,8 @@ import (
 const (
 	PubSubModeNormal int = 1 << iota
 	PubSubModeFirehose
+	PubSubModeMemory // no redis, messages stay in the process
+	PubSubModeNats   // messages go between nodes over nats, see nats.go
 )
 
 type Options struct {
@@ -22,34 +22,77 @@ type Options struct {
 	PubSubMode      int    `json:"pubsub_mode"`
 	RedisPubAddress string `json:"redis_pub_address"`
 	RedisSubAddress string `json:"redis_sub_address"`
+	// when set pub and sub both go to the master found through sentinel
+	RedisSentinelAddresses []string `json:"redis_sentinels"`
+	RedisSentinelMaster    string   `json:"redis_sentinel_master"`
+	// channels are spread over these redis servers, see SetShards
+	RedisShardAddresses []string `json:"redis_shards"`
+	// nats mode, defaults to the embedded server when NatsEmbedded is set
+	NatsServers       []string `json:"nats_servers"`
+	NatsEmbedded      bool     `json:"nats_embedded"`       // run gnatsd in this process
+	NatsListen        string   `json:"nats_listen"`         // client address of the embedded server
+	NatsClusterListen string   `json:"nats_cluster_listen"` // route address of the embedded server
+	NatsRoutes        []string `json:"nats_routes"`         // route addresses of the other nodes
+	// goroutines delivering to local subscribers, see fanout.go, 0 delivers
+	// in the publishing goroutine
+	FanoutWorkers int `json:"fanout_workers"`
+	// messages from redis an app can have waiting, and how many each app gets
+	// dispatched per round, see fair.go
+	AppQueueSize int            `json:"app_queue_size"`
+	AppWeights   map[string]int `json:"app_weights"`
+	// how messages are sent to other nodes, json or binary, see envelope.go
+	Envelope              string `json:"envelope"`
+	EnvelopeCompressAbove int    `json:"envelope_compress_above"`
+	// message ids remembered to drop repeats, 0 remembers none
+	DedupeWindow int `json:"dedupe_window"`
 }
 
 var DefaultRedisAddress = "127.0.0.1:6379"
 var DefaultOptions = Options{
-	RedisPubAddress: DefaultRedisAddress,
-	RedisSubAddress: DefaultRedisAddress,
+	RedisPubAddress:       DefaultRedisAddress,
+	RedisSubAddress:       DefaultRedisAddress,
+	FanoutWorkers:         runtime.NumCPU(),
+	AppQueueSize:          APP_QUEUE_SIZE,
+	Envelope:              ENVELOPE_JSON,
+	EnvelopeCompressAbove: ENVELOPE_COMPRESS_ABOVE,
+	DedupeWindow:          DEDUPE_WINDOW,
 }
 
 type Message struct {
+	Id        string `json:"id,omitempty"` // see dedupe.go
 	Name      string `json:"name"`
 	Data      string `json:"data"`
 	Sender    string `json:"sender"`
 	Timestamp int64  `json:"timestamp"`
 	NodeId    string `json:"node_id"`
+	AppId     string `json:"app_id,omitempty"`
+	// per channel sequence number, 0 when the message isnt sequenced
+	Seq int64 `json:"seq,omitempty"`
+	// built once for all local subscribers, see FrameEncoder
+	Frame string `json:"-"`
 }
 
+// The lock guards the registry and the shard list. Subscribe and Unsubscribe
+// hold it while they send the redis SUBSCRIBE or UNSUBSCRIBE for a topics
+// first or last local subscriber, so the commands go out in the same order as
+// the refcount changes that caused them. They are only written to the
+// connection, not waited on, so holding it is cheap.
 type pubsub struct {
 	lock sync.RWMutex
 	opts *Options
 
 	// redis clients - todo: switch over to using xredis wrapper
-	redisPub        *goredis.Redis  // used for pub
-	redisSub        *goredis.Redis  // used for sub
-	redisSubscriber *goredis.PubSub // used for subscribe, unsubscribe
+	primary *shard
+	shards  []*shard
+	ring    *hashRing // nil when there are no shards
 
-	sublist *sublist.Sublist
-	topics  map[string]*set.Set
-	subs    map[Subscriber]*set.Set
+	registry *registry
+	fanout   *fanout // nil when delivering in the publishing goroutine
+	fair     *fairScheduler
+	dedupe   *dedupe
+
+	occupancyHandler OccupancyHandler
+	frameEncoder     FrameEncoder
 }
 
 type Subscriber interface {
@@ -69,17 +112,16 @@ type PubSub interface {
 	SubscribedList(Subscriber) []interface{} // todo: cast to []Subscriber
 	SubscriberList(string) []interface{}     // todo: cast to []string
 	Publish(Publisher, string, *Message) (int64, error)
+	PublishAsync(Publisher, string, *Message, PublishCallback)
 	// Publish(string, *Message) (int64, error)
+	HandleOccupancy(OccupancyHandler)
+	HandleDrops(DropHandler)
+	SetFrameEncoder(FrameEncoder)
+	SetShards([]string) error
 	Start() error
 }
 
 func New(opts *Options) PubSub { // todo: this should return PubSub iface
-	ps := &pubsub{
-		opts:    opts,
-		sublist: sublist.New(),
-		subs:    make(map[Subscriber]*set.Set),
-		topics:  make(map[string]*set.Set),
-	}
 	// set to random id if not set
 	if opts.PubSubNodeId == "" {
 		log.Println("pub sub node id not set, setting to uuid")
@@ -87,12 +129,23 @@ func New(opts *Options) PubSub { // todo: this should return PubSub iface
 		opts.PubSubNodeId = uuid.NewRandom().String()
 	}
 	log.Println("pub sub node id:", opts.PubSubNodeId)
+	switch opts.PubSubMode {
+	case PubSubModeMemory:
+		return newMemory(opts)
+	case PubSubModeNats:
+		return newNats(opts)
+	}
 	if opts.PubSubMode != PubSubModeNormal && opts.PubSubMode != PubSubModeFirehose {
 		log.Println("pub sub mode not set using normal mode")
 		opts.PubSubMode = PubSubModeNormal
 	}
-	// Ensure interface compliance
-	var _ PubSub = ps
+	ps := &pubsub{
+		opts:     opts,
+		registry: newRegistry(),
+		fanout:   newFanout(opts.FanoutWorkers),
+		dedupe:   newDedupe(opts.DedupeWindow),
+	}
+	ps.fair = newFairScheduler(opts.AppQueueSize, opts.AppWeights, ps.dispatch)
 	return ps
 }
 
@@ -101,42 +154,41 @@ func (ps *pubsub) Start() error {
 	if err != nil {
 		return err
 	}
-	if ps.opts.PubSubMode == PubSubModeFirehose {
-		// turn on the firehose
-		ps.redisSubscriber.PSubscribe("*")
+	// turns on the firehose if enabled
+	err = ps.primary.subscribeAll(ps.primary.subscriber())
+	if err != nil {
+		return err
 	}
-	go ps.subLoop()
+	go ps.fair.run()
+	ps.primary.start()
+	if len(ps.opts.RedisShardAddresses) > 0 {
+		err = ps.SetShards(ps.opts.RedisShardAddresses)
+		if err != nil {
+			return err
+		}
+	}
+	ps.heartbeat()
+	go ps.occupancyLoop()
 	return nil
 }
 
 func (ps *pubsub) connectRedis() error {
-	ps.lock.Lock()
-	defer ps.lock.Unlock()
-
 	log.Println("pubsub connect redis")
 
-	redisPub, err := goredis.Dial(&goredis.DialConfig{
-		Address: ps.opts.RedisPubAddress})
-	if err != nil {
-		log.Fatal("Unable to connect to redis pub", err)
-		return err
+	var sentinel *xredis.Sentinel
+	if len(ps.opts.RedisSentinelAddresses) > 0 {
+		sentinel = xredis.NewSentinel(ps.opts.RedisSentinelAddresses, ps.opts.RedisSentinelMaster)
 	}
-	ps.redisPub = redisPub
-
-	redisSub, err := goredis.Dial(&goredis.DialConfig{
-		Address: ps.opts.RedisSubAddress})
-	if err != nil {
-		log.Fatal("Unable to connect to redis sub", err)
+	primary := newShard(ps, ps.opts.RedisPubAddress, ps.opts.RedisSubAddress, sentinel)
+	if err := primary.connect(); err != nil {
 		return err
 	}
-	ps.redisSub = redisSub
-
-	redisSubscriber, err := redisSub.PubSub()
-	if err != nil {
-		log.Fatal("Unable to create redis subscriber", err)
-		return err
+	ps.lock.Lock()
+	ps.primary = primary
+	ps.lock.Unlock()
+	if sentinel != nil {
+		go sentinel.Watch(primary.switchMaster)
 	}
-	ps.redisSubscriber = redisSubscriber
 	return nil
 }
 
@@ -149,119 +201,103 @@ const (
 	EVENT_PUNSUBSCRIBE = "punsubscribe"
 )
 
-const KEYSPACE_NOTIFICATION_PREFIX = "__keyspace@0__:"
+// KEYSPACE_NOTIFICATION_PREFIX matches keyspace notifications for any
+// database, see xredis.KeyspacePrefix
+const KEYSPACE_NOTIFICATION_PREFIX = "__keyspace@"
 
-func (ps *pubsub) subLoop() {
-	for {
-		log.Println("trying to recieve")
-		list, err := ps.redisSubscriber.Receive()
-		if err != nil {
-			log.Fatal("Unable to recieve from redis", err)
-			break
-		}
-		log.Println("list", list)
-
-		idx := 0
-		switch list[0] {
-		case EVENT_MESSAGE:
-			idx++
-		case EVENT_PMESSAGE:
-			idx += 2
-		case EVENT_SUBSCRIBE:
-			continue
-		case EVENT_UNSUBSCRIBE:
-			continue
-		case EVENT_PSUBSCRIBE:
-			continue
-		case EVENT_PUNSUBSCRIBE:
-			continue
-		default:
-			log.Println("unespected pubsub type", list)
-		}
-		channel := list[idx]
+// receive handles a reply read by a shard subscriber connection
+func (ps *pubsub) receive(list []string) {
+	log.Println("list", list)
+
+	idx := 0
+	switch list[0] {
+	case EVENT_MESSAGE:
 		idx++
-		payload := list[idx]
+	case EVENT_PMESSAGE:
+		idx += 2
+	case EVENT_SUBSCRIBE:
+		return
+	case EVENT_UNSUBSCRIBE:
+		return
+	case EVENT_PSUBSCRIBE:
+		return
+	case EVENT_PUNSUBSCRIBE:
+		return
+	default:
+		log.Println("unespected pubsub type", list)
+	}
+	channel := list[idx]
+	idx++
+	payload := list[idx]
+
+	// special case to deal with keyspace notifications
+	if strings.HasPrefix(channel, KEYSPACE_NOTIFICATION_PREFIX) {
 		msg := &Message{}
+		msg.Name = payload
+		// set the timestamp here... does it need .UTC(). ?
+		msg.Timestamp = time.Now().UnixNano()
+		ps.fair.push("", channel, msg)
+		return
+	}
 
-		// special case to deal with keyspace notifications
-		if strings.HasPrefix(channel, KEYSPACE_NOTIFICATION_PREFIX) {
-			msg.Name = payload
-			// set the timestamp here... does it need .UTC(). ?
-			msg.Timestamp = time.Now().UnixNano()
-			ps.forwardToLocal(channel, msg)
-			continue
+	if msg, err := decodeEnvelope([]byte(payload)); err == nil {
+		if msg.NodeId == ps.opts.PubSubNodeId {
+			log.Println("skip, same node id")
+			return
 		}
-
-		if err := json.Unmarshal([]byte(payload), msg); err == nil {
-			if msg.NodeId == ps.opts.PubSubNodeId {
-				log.Println("skip, same node id")
-				continue
-			}
-			ps.forwardToLocal(channel, msg)
-		} else {
-			log.Println("error decoding json %s", err.Error())
+		if ps.dedupe.repeat(msg.Id) {
+			return
 		}
-
+		ps.fair.push(msg.AppId, channel, msg)
+	} else {
+		log.Println("error decoding envelope", err.Error())
 	}
-	log.Println("subloop end")
 }
 
 func (ps *pubsub) Subscribe(sub Subscriber, topic string) {
 	log.Println("subscribe", topic)
-	topics := ps.topicsSet(sub)
-	if topics.Has(topic) {
+	ps.lock.Lock()
+	numSubs := ps.registry.add(sub, topic)
+	if numSubs == 1 && ps.opts.PubSubMode == PubSubModeNormal {
+		log.Println("subscribe redis to", topic)
+		ps.lookupShard(topic).subscribe(topic)
+	}
+	ps.lock.Unlock()
+	if numSubs == 0 {
 		log.Println("already subscribed, return")
 		return // dont sub again
 	}
-	topics.Add(topic)
-	subs := ps.subsSet(topic)
-	numSubs := subs.Size()
-	subs.Add(sub)
-	numSubs++
-	ps.sublist.Insert([]byte(topic), sub)
 	log.Println("numSubs", numSubs)
+	subscriptionsGauge.Inc()
 	if numSubs == 1 {
-		if ps.opts.PubSubMode == PubSubModeNormal {
-			// assuming redis pubsub client is also thread safe
-			log.Println("subscribe redis to", topic)
-			ps.redisSubscriber.Subscribe(topic)
-		} else {
-			log.Println("firehose mode?")
-		}
+		topicsGauge.Inc()
 	}
+	ps.updateOccupancy(sub, topic, 1)
 }
 
 func (ps *pubsub) Unsubscribe(sub Subscriber, topic string) {
-	log.Println("unsubscribe %s", topic)
-	subs := ps.subsSet(topic)
-	topics := ps.topicsSet(sub)
-	if topics.Has(topic) == false {
-		return // not subscribed
+	log.Println("unsubscribe", topic)
+	ps.lock.Lock()
+	numSubs := ps.registry.remove(sub, topic)
+	if numSubs == 0 && ps.opts.PubSubMode == PubSubModeNormal {
+		log.Println("unsubscribe redis from", topic)
+		ps.lookupShard(topic).unsubscribe(topic)
 	}
-	topics.Remove(topic)
-	subs.Remove(sub)
-	ps.sublist.Remove([]byte(topic), sub)
-	if subs.Size() == 0 {
-		if ps.opts.PubSubMode == PubSubModeNormal {
-			log.Println("unsubscribe redis from", topic)
-			ps.redisSubscriber.UnSubscribe(topic)
-		}
-		ps.lock.Lock()
-		delete(ps.topics, topic)
-		ps.lock.Unlock()
+	ps.lock.Unlock()
+	if numSubs < 0 {
+		return // not subscribed
 	}
-	if topics.Size() == 0 {
-		ps.lock.Lock()
-		delete(ps.subs, sub)
-		ps.lock.Unlock()
+	subscriptionsGauge.Dec()
+	if numSubs == 0 {
+		topicsGauge.Dec()
 	}
+	ps.updateOccupancy(sub, topic, -1)
 }
 
 func (ps *pubsub) UnsubscribeAll(sub Subscriber) {
 	// iterate over subs and unsub each one
 	log.Println("unsubscribe all")
-	topics := ps.topicsSet(sub).List()
-	for _, topic := range topics {
+	for _, topic := range ps.SubscribedList(sub) {
 		ps.Unsubscribe(sub, topic.(string))
 	}
 }
@@ -271,107 +307,99 @@ var emptyList = make([]interface{}, 0)
 func (ps *pubsub) IsSubscribed(sub Subscriber, topic string) bool {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
-	if s, ok := ps.subs[sub]; ok {
-		return s.Has(topic)
-	}
-	return false
+	return ps.registry.has(sub, topic)
 }
 
 func (ps *pubsub) SubscribedList(sub Subscriber) []interface{} {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
-	if s, ok := ps.subs[sub]; ok {
-		return s.List()
-	}
-	return emptyList
+	return ps.registry.subscribed(sub)
 }
 
 func (ps *pubsub) SubscriberList(topic string) []interface{} {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
-	if s, ok := ps.topics[topic]; ok {
-		return s.List()
-	}
-	return emptyList
+	return ps.registry.subscribers(topic)
 }
 
+// Publish waits for redis to take the message, see PublishAsync
 func (ps *pubsub) Publish(pub Publisher, channel string, msg *Message) (int64, error) {
-	if pub != nil {
-		msg.Sender = pub.ID()
-	}
-	msg.NodeId = ps.opts.PubSubNodeId
-	msg.Timestamp = time.Now().UnixNano() // utc?
+	done := make(chan bool, 1)
 	var count int64 = 0
-	var num int64 = 0
 	var err error = nil
-	num, err = ps.forwardToLocal(channel, msg)
-	if err != nil {
-		return count, err
-	} else {
-		count += num
-	}
-	num, err = ps.forwardToRemote(channel, msg)
-	count += num
+	ps.PublishAsync(pub, channel, msg, func(num int64, publishErr error) {
+		count, err = num, publishErr
+		done <- true
+	})
+	<-done
 	return count, err
 }
 
-func (ps *pubsub) forwardToLocal(channel string, msg *Message) (int64, error) {
-	// use sublist to find local subs, send them a copy
-	list := ps.sublist.Match([]byte(channel))
-	var err error = nil
-	var num int64 = int64(len(list))
-	if num == 0 {
-		return 0, nil // nothing to do
+// PublishAsync delivers to local subscribers and queues the message for redis,
+// callback gets the local and remote count once redis has it, it can be nil
+func (ps *pubsub) PublishAsync(pub Publisher, channel string, msg *Message, callback PublishCallback) {
+	if callback == nil {
+		callback = func(int64, error) {}
 	}
-	for index, item := range list {
-		log.Printf("match: %i, %+v", index, item)
-		sub := item.(Subscriber)
-		if sub.ID() == msg.Sender {
-			log.Println("skip, dont deliever msg to sender")
-			num--
-			continue // dont send to self
-		}
-		sub.Receive(channel, msg)
+	if !stamp(msg, pub, ps.opts.PubSubNodeId, ps.dedupe) {
+		callback(0, nil)
+		return
 	}
-	return num, err
-}
-
-func (ps *pubsub) forwardToRemote(channel string, msg *Message) (int64, error) {
-	// set the via/hub then
-	// serialize to json
-	buf, err := json.Marshal(msg)
+	local, err := ps.forwardToLocal(channel, msg)
+	if err != nil {
+		callback(local, err)
+		return
+	}
+	sh := ps.shardFor(channel)
+	if !sh.isConnected() {
+		// fail fast rather than wait on redis
+		callback(local, ErrDisconnected)
+		return
+	}
+	// serialize, then push to the redis shard the channel lives on
+	buf, err := encodeEnvelope(msg, ps.opts.Envelope, ps.opts.EnvelopeCompressAbove)
 	if err != nil {
-		log.Println("unalbe to marshal json")
+		log.Println("unable to encode envelope", err)
+		callback(local, err)
+		return
 	}
-	// push to redis
-	num, err := ps.redisPub.Publish(channel, string(buf))
-	return num, err
+	sh.batcher.publish(channel, string(buf), func(num int64, err error) {
+		callback(local+num, err)
+	})
+}
+
+func (ps *pubsub) HandleDrops(handler DropHandler) {
+	ps.fair.handleDrops(handler)
+}
+
+func (ps *pubsub) SetFrameEncoder(encoder FrameEncoder) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.frameEncoder = encoder
 }
 
-func (ps *pubsub) topicsSet(sub Subscriber) *set.Set {
-	// var s *set.Set = nil
+func (ps *pubsub) forwardToLocal(channel string, msg *Message) (int64, error) {
+	// use sublist to find local subs, they all share one copy
+	list := ps.registry.match(channel)
+	if len(list) == 0 {
+		return 0, nil // nothing to do
+	}
 	ps.lock.RLock()
-	s, ok := ps.subs[sub]
+	encoder := ps.frameEncoder
 	ps.lock.RUnlock()
-	if !ok {
-		s = set.New()
-		ps.lock.Lock()
-		ps.subs[sub] = s
-		ps.lock.Unlock()
-	}
-	return s
+	return ps.fanout.send(encoder, channel, msg, list), nil
 }
 
-func (ps *pubsub) subsSet(topic string) *set.Set {
-	// var s *set.Set = nil
+// dispatch is forwardToLocal for the fair scheduler, it doesnt wait on a
+// full fan-out worker and returns false when msg was dropped instead
+func (ps *pubsub) dispatch(channel string, msg *Message) bool {
+	list := ps.registry.match(channel)
+	if len(list) == 0 {
+		return true
+	}
 	ps.lock.RLock()
-	s, ok := ps.topics[topic]
+	encoder := ps.frameEncoder
 	ps.lock.RUnlock()
-	if !ok {
-		s = set.New()
-		ps.lock.Lock()
-		ps.topics[topic] = s
-		ps.lock.Unlock()
-	}
-	return s
+	_, ok := ps.fanout.trySend(encoder, channel, msg, list)
+	return ok
 }
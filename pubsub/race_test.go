@@ -0,0 +1,233 @@
+package pubsub
+
+import (
+	"bufio"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers just enough for a pubsub to start and records the
+// SUBSCRIBE and UNSUBSCRIBE commands and the PUBLISHes it is sent, in order,
+// per topic, and how many of each command. Publishing to "bad" is an error.
+type fakeRedis struct {
+	ln        net.Listener
+	lock      sync.Mutex
+	commands  map[string][]string // topic to commands
+	published map[string][]string // channel to payloads
+	calls     map[string]int      // command to times sent
+	swept     bool                // the next SADD adds the node back
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{ln: ln, commands: make(map[string][]string), published: make(map[string][]string), calls: make(map[string]int)}
+	go fr.serve()
+	return fr
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		fr.lock.Lock()
+		fr.calls[cmd]++
+		fr.lock.Unlock()
+		switch cmd {
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			fr.lock.Lock()
+			for _, topic := range args[1:] {
+				fr.commands[topic] = append(fr.commands[topic], cmd)
+			}
+			fr.lock.Unlock()
+		case "PUBLISH":
+			fr.lock.Lock()
+			fr.published[args[1]] = append(fr.published[args[1]], args[2])
+			fr.lock.Unlock()
+			if args[1] == "bad" {
+				conn.Write([]byte("-ERR bad channel\r\n"))
+			} else {
+				conn.Write([]byte(":1\r\n"))
+			}
+		case "PSUBSCRIBE":
+		case "PING":
+			conn.Write([]byte("+PONG\r\n"))
+		case "SETEX":
+			conn.Write([]byte("+OK\r\n"))
+		case "SMEMBERS":
+			conn.Write([]byte("*0\r\n"))
+		case "SADD":
+			fr.lock.Lock()
+			swept := fr.swept
+			fr.swept = false
+			fr.lock.Unlock()
+			if swept {
+				conn.Write([]byte(":1\r\n"))
+			} else {
+				conn.Write([]byte(":0\r\n"))
+			}
+		default:
+			conn.Write([]byte(":1\r\n"))
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for idx := range args {
+		if _, err := r.ReadString('\n'); err != nil { // $len
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[idx] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (fr *fakeRedis) sent(cmd string) int {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.calls[cmd]
+}
+
+func (fr *fakeRedis) topicCommands(topic string) []string {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return append([]string{}, fr.commands[topic]...)
+}
+
+// churn has each worker subscribe and unsubscribe its own subscribers to a
+// few shared topics at random
+func churn(ps PubSub, topics []string) {
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			subs := make([]*testSubscriber, 4)
+			for idx := range subs {
+				subs[idx] = &testSubscriber{id: strconv.Itoa(w) + "-" + strconv.Itoa(idx)}
+			}
+			for i := 0; i < 300; i++ {
+				sub := subs[rnd.Intn(len(subs))]
+				topic := topics[rnd.Intn(len(topics))]
+				switch rnd.Intn(5) {
+				case 0, 1:
+					ps.Subscribe(sub, topic)
+				case 2, 3:
+					ps.Unsubscribe(sub, topic)
+				default:
+					ps.UnsubscribeAll(sub)
+				}
+				ps.IsSubscribed(sub, topic)
+				ps.SubscriberList(topic)
+			}
+			// leave the odd workers subscribed
+			if w%2 == 0 {
+				for _, sub := range subs {
+					ps.UnsubscribeAll(sub)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestRegistryRefcounts(t *testing.T) {
+	ps := newTestMemory()
+	topics := []string{"a", "b", "c"}
+	churn(ps, topics)
+
+	m := ps.(*memory)
+	total := 0
+	for _, topic := range topics {
+		subs := ps.SubscriberList(topic)
+		total += len(subs)
+		for _, sub := range subs {
+			if !ps.IsSubscribed(sub.(Subscriber), topic) {
+				t.Errorf("%s lists %v but it isnt subscribed", topic, sub)
+			}
+		}
+		if len(subs) == 0 {
+			if _, ok := m.registry.topics[topic]; ok {
+				t.Errorf("expected %s to be dropped once empty", topic)
+			}
+		}
+	}
+	listed := 0
+	for sub := range m.registry.subs {
+		listed += len(ps.SubscribedList(sub))
+	}
+	if listed != total {
+		t.Errorf("subscribers have %d subscriptions but topics have %d", listed, total)
+	}
+}
+
+func TestRedisSubscribeOrder(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.ln.Close()
+	address := fr.ln.Addr().String()
+	ps := New(&Options{PubSubNodeId: "test", RedisPubAddress: address, RedisSubAddress: address})
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	topics := []string{"a", "b", "c", "d"}
+	churn(ps, topics)
+
+	// commands are written in order on one connection, once the marker is
+	// seen everything before it has been too
+	ps.Subscribe(&testSubscriber{id: "marker"}, "marker")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fr.topicCommands("marker")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, topic := range topics {
+		commands := fr.topicCommands(topic)
+		for idx, cmd := range commands {
+			// each topic alternates, starting with a subscribe
+			want := "SUBSCRIBE"
+			if idx%2 == 1 {
+				want = "UNSUBSCRIBE"
+			}
+			if cmd != want {
+				t.Fatalf("%s command %d was %s, expected %s in %v", topic, idx, cmd, want, commands)
+			}
+		}
+		subscribed := len(commands)%2 == 1
+		if listening := len(ps.SubscriberList(topic)) > 0; subscribed != listening {
+			t.Errorf("%s redis subscribed %v but has local subscribers %v", topic, subscribed, listening)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"errors"
+	"github.com/screencloud/subhub/xredis"
+	"log"
+	"time"
+)
+
+const (
+	RECONNECT_MIN_BACKOFF = 100 * time.Millisecond
+	RECONNECT_MAX_BACKOFF = 30 * time.Second
+)
+
+// EVENT_NAME_GAP is delivered to local subscribers of every topic after the
+// subscriber connection was lost, anything published meanwhile was missed
+const EVENT_NAME_GAP = "subhub:gap"
+const GAP_REASON_RECONNECT = `{"reason":"reconnect"}`
+
+// ErrDisconnected is returned by Publish while redis is unreachable, the
+// message is still delivered to local subscribers
+var ErrDisconnected = errors.New("pubsub: redis disconnected")
+
+// pub returns the primary redis client, used for occupancy
+func (ps *pubsub) pub() *xredis.Redis {
+	return ps.primary.pub()
+}
+
+// subscribeAll issues the subscribe for every topic on the shard we have local
+// subscribers for, or turns on the firehose
+func (sh *shard) subscribeAll(redisSubscriber *xredis.PubSub) error {
+	if sh.ps.opts.PubSubMode == PubSubModeFirehose {
+		return redisSubscriber.PSubscribe("*")
+	}
+	// hold the lock so no topic comes or goes between listing and subscribing
+	sh.ps.lock.RLock()
+	defer sh.ps.lock.RUnlock()
+	topics := sh.ps.lookupShardTopics(sh)
+	if len(topics) == 0 {
+		return nil
+	}
+	return redisSubscriber.Subscribe(topics...)
+}
+
+// reconnect replaces a broken subscriber connection, backing off until redis
+// is back, then tells local subscribers they may have missed messages
+func (sh *shard) reconnect() {
+	sh.lock.Lock()
+	broken := sh.redisSubscriber
+	sh.redisSubscriber = nil
+	sh.lock.Unlock()
+	if broken != nil {
+		broken.Close()
+	}
+
+	backoff := RECONNECT_MIN_BACKOFF
+	for {
+		time.Sleep(backoff)
+		if sh.isClosed() {
+			return
+		}
+		// connect installs the new subscriber before we resubscribe, any topic
+		// subscribed to from here on either sees the new connection or is
+		// picked up by subscribeAll
+		err := sh.connect()
+		if err == nil {
+			redisSubscriber := sh.subscriber()
+			if err = sh.subscribeAll(redisSubscriber); err == nil {
+				break
+			}
+			sh.lock.Lock()
+			sh.redisSubscriber = nil
+			sh.lock.Unlock()
+			redisSubscriber.Close()
+		}
+		log.Println("unable to reconnect to redis, retrying in", backoff, err)
+		backoff *= 2
+		if backoff > RECONNECT_MAX_BACKOFF {
+			backoff = RECONNECT_MAX_BACKOFF
+		}
+	}
+	log.Println("reconnected to redis", sh.subAddress)
+	reconnectsCounter.Inc()
+	sh.ps.notifyGap(sh.ps.shardTopics(sh))
+}
+
+// switchMaster is called by the sentinel watch after a failover, dropping the
+// subscriber makes the loop reconnect, which moves pub and sub to the new
+// master and resubscribes every topic
+func (sh *shard) switchMaster(masterAddress string) {
+	log.Println("pubsub following redis master to", masterAddress)
+	if redisSubscriber := sh.subscriber(); redisSubscriber != nil {
+		redisSubscriber.Close()
+	}
+}
+
+func (ps *pubsub) notifyGap(topics []string) {
+	for _, topic := range topics {
+		msg := &Message{
+			Name:      EVENT_NAME_GAP,
+			Data:      GAP_REASON_RECONNECT,
+			NodeId:    ps.opts.PubSubNodeId,
+			Timestamp: time.Now().UnixNano(),
+		}
+		ps.forwardToLocal(topic, msg)
+	}
+}
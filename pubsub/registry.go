@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"github.com/apcera/gnatsd/sublist"
+	"gopkg.in/fatih/set.v0"
+)
+
+// registry tracks which local subscribers are on which topics. It has no lock
+// of its own, the owner holds its lock around each change and around whatever
+// the change triggers, like the redis SUBSCRIBE for a topics first subscriber,
+// so refcounts and the commands they cause happen in one order. Only match
+// can be called without the lock, the sublist guards itself.
+type registry struct {
+	sublist *sublist.Sublist
+	topics  map[string]*set.Set     // topic to subscribers
+	subs    map[Subscriber]*set.Set // subscriber to topics
+}
+
+func newRegistry() *registry {
+	return &registry{
+		sublist: sublist.New(),
+		topics:  make(map[string]*set.Set),
+		subs:    make(map[Subscriber]*set.Set),
+	}
+}
+
+// add returns how many subscribers the topic has afterwards, or 0 when sub
+// was already subscribed
+func (r *registry) add(sub Subscriber, topic string) int {
+	topics, ok := r.subs[sub]
+	if !ok {
+		topics = set.New()
+		r.subs[sub] = topics
+	}
+	if topics.Has(topic) {
+		return 0
+	}
+	topics.Add(topic)
+	subs, ok := r.topics[topic]
+	if !ok {
+		subs = set.New()
+		r.topics[topic] = subs
+	}
+	subs.Add(sub)
+	r.sublist.Insert([]byte(topic), sub)
+	return subs.Size()
+}
+
+// remove returns how many subscribers the topic has left, or -1 when sub
+// wasnt subscribed
+func (r *registry) remove(sub Subscriber, topic string) int {
+	topics, ok := r.subs[sub]
+	if !ok || !topics.Has(topic) {
+		return -1
+	}
+	topics.Remove(topic)
+	if topics.Size() == 0 {
+		delete(r.subs, sub)
+	}
+	subs := r.topics[topic]
+	subs.Remove(sub)
+	numSubs := subs.Size()
+	if numSubs == 0 {
+		delete(r.topics, topic)
+	}
+	r.sublist.Remove([]byte(topic), sub)
+	return numSubs
+}
+
+func (r *registry) has(sub Subscriber, topic string) bool {
+	if s, ok := r.subs[sub]; ok {
+		return s.Has(topic)
+	}
+	return false
+}
+
+func (r *registry) subscribed(sub Subscriber) []interface{} {
+	if s, ok := r.subs[sub]; ok {
+		return s.List()
+	}
+	return emptyList
+}
+
+func (r *registry) subscribers(topic string) []interface{} {
+	if s, ok := r.topics[topic]; ok {
+		return s.List()
+	}
+	return emptyList
+}
+
+func (r *registry) topicList() []string {
+	topics := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// counts is how many subscribers each topic has
+func (r *registry) counts() map[string]int {
+	counts := make(map[string]int, len(r.topics))
+	for topic, subs := range r.topics {
+		counts[topic] = subs.Size()
+	}
+	return counts
+}
+
+func (r *registry) match(topic string) []interface{} {
+	return r.sublist.Match([]byte(topic))
+}
@@ -0,0 +1,354 @@
+package pubsub
+
+import (
+	"github.com/screencloud/subhub/xredis"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channels can be spread over several redis servers (shards), each channel is
+// mapped to a shard by consistent hashing so every node agrees where a channel
+// lives without talking to each other, as long as they share the shard list.
+// Each node keeps a publish client and a subscriber connection per shard.
+// The primary redis (pub/sub addresses or sentinel) is always used for
+// keyspace notifications, as it holds the keys, and for occupancy. When no
+// shards are configured every channel uses the primary.
+
+const (
+	SHARD_VIRTUAL_NODES = 160
+	// after a rebalance the old shard is kept subscribed for a while, for nodes
+	// that are still publishing with the old shard list
+	SHARD_REBALANCE_GRACE = 5 * time.Second
+)
+
+type shard struct {
+	ps         *pubsub
+	pubAddress string // host:port or a redis url
+	subAddress string
+	sentinel   *xredis.Sentinel // follow the master, primary only
+
+	lock            sync.RWMutex
+	redisPub        *xredis.Redis  // used for pub
+	redisSubscriber *xredis.PubSub // used for subscribe, unsubscribe
+	closed          bool
+
+	batcher *batcher // publishes, see batch.go
+}
+
+func newShard(ps *pubsub, pubAddress string, subAddress string, sentinel *xredis.Sentinel) *shard {
+	sh := &shard{
+		ps:         ps,
+		pubAddress: pubAddress,
+		subAddress: subAddress,
+		sentinel:   sentinel,
+	}
+	sh.batcher = newBatcher(sh)
+	return sh
+}
+
+// connect sets up the pub client and opens the subscriber connection, when
+// using sentinel both go to the current master with the credentials, database
+// and tls from the configured addresses
+func (sh *shard) connect() error {
+	pubConfig, subConfig := xredis.DefaultPoolConfig, xredis.DefaultPoolConfig
+	if err := pubConfig.ApplyURL(sh.pubAddress); err != nil {
+		log.Println("Invalid redis pub address", err)
+		return err
+	}
+	if err := subConfig.ApplyURL(sh.subAddress); err != nil {
+		log.Println("Invalid redis sub address", err)
+		return err
+	}
+	if sh.sentinel != nil {
+		masterAddress, err := sh.sentinel.MasterAddress()
+		if err != nil {
+			log.Println("Unable to find redis master", err)
+			return err
+		}
+		pubConfig.Address, subConfig.Address = masterAddress, masterAddress
+	}
+
+	pubPool := xredis.NewPool("pubsub/"+pubConfig.Address, &pubConfig)
+	if _, err := pubPool.Do("PING"); err != nil {
+		log.Println("Unable to connect to redis pub", err)
+		pubPool.Close()
+		return err
+	}
+
+	redisSubscriber, err := xredis.DialPubSub(&subConfig)
+	if err != nil {
+		log.Println("Unable to create redis subscriber", err)
+		pubPool.Close()
+		return err
+	}
+
+	sh.lock.Lock()
+	old := sh.redisPub
+	sh.redisPub = xredis.New(pubPool, pubPool)
+	sh.redisSubscriber = redisSubscriber
+	sh.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// pub returns the redis client used for publishing
+func (sh *shard) pub() *xredis.Redis {
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.redisPub
+}
+
+// subscriber returns the redis subscriber connection, or nil while reconnecting
+func (sh *shard) subscriber() *xredis.PubSub {
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.redisSubscriber
+}
+
+func (sh *shard) isConnected() bool {
+	return sh.subscriber() != nil
+}
+
+func (sh *shard) isClosed() bool {
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	return sh.closed
+}
+
+func (sh *shard) subscribe(topic string) {
+	// if we are reconnecting the topic is subscribed once we are back
+	if redisSubscriber := sh.subscriber(); redisSubscriber != nil {
+		redisSubscriber.Subscribe(topic)
+	}
+}
+
+func (sh *shard) unsubscribe(topic string) {
+	if redisSubscriber := sh.subscriber(); redisSubscriber != nil {
+		redisSubscriber.UnSubscribe(topic)
+	}
+}
+
+// close stops the shard once it has been removed from the shard list
+func (sh *shard) close() {
+	sh.lock.Lock()
+	if sh.closed {
+		sh.lock.Unlock()
+		return
+	}
+	sh.closed = true
+	redisSubscriber := sh.redisSubscriber
+	sh.redisSubscriber = nil
+	redisPub := sh.redisPub
+	sh.lock.Unlock()
+	if redisSubscriber != nil {
+		redisSubscriber.Close()
+	}
+	if redisPub != nil {
+		redisPub.Close()
+	}
+	sh.batcher.stop()
+}
+
+// start runs the publisher and the subscriber loop once connected
+func (sh *shard) start() {
+	go sh.batcher.run()
+	go sh.loop()
+}
+
+func (sh *shard) loop() {
+	for {
+		log.Println("trying to recieve")
+		redisSubscriber := sh.subscriber()
+		if redisSubscriber == nil {
+			return // closed
+		}
+		list, err := redisSubscriber.Receive()
+		if err != nil {
+			if sh.isClosed() {
+				return
+			}
+			log.Println("Unable to recieve from redis, reconnecting", err)
+			sh.reconnect()
+			continue
+		}
+		sh.ps.receive(list)
+	}
+}
+
+// hashRing maps keys to shards, each shard is placed on the ring many times
+// so channels spread evenly and adding or removing a shard only moves the
+// channels that shard gains or loses
+type hashRing struct {
+	hashes []uint32
+	shards map[uint32]int // hash to index in the shard list
+}
+
+func newHashRing(addresses []string) *hashRing {
+	ring := &hashRing{
+		hashes: make([]uint32, 0, len(addresses)*SHARD_VIRTUAL_NODES),
+		shards: make(map[uint32]int),
+	}
+	for idx, address := range addresses {
+		for v := 0; v < SHARD_VIRTUAL_NODES; v++ {
+			hash := crc32.ChecksumIEEE([]byte(address + "#" + strconv.Itoa(v)))
+			if _, ok := ring.shards[hash]; ok {
+				continue // collision, first one wins
+			}
+			ring.shards[hash] = idx
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Sort(uint32Slice(ring.hashes))
+	return ring
+}
+
+func (ring *hashRing) get(key string) int {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if idx == len(ring.hashes) {
+		idx = 0
+	}
+	return ring.shards[ring.hashes[idx]]
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// lookupShard expects the lock to be held
+func (ps *pubsub) lookupShard(topic string) *shard {
+	if ps.ring == nil || strings.HasPrefix(topic, KEYSPACE_NOTIFICATION_PREFIX) {
+		return ps.primary
+	}
+	return ps.shards[ps.ring.get(topic)]
+}
+
+func (ps *pubsub) shardFor(topic string) *shard {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return ps.lookupShard(topic)
+}
+
+// shardTopics lists the topics with local subscribers that live on a shard
+func (ps *pubsub) shardTopics(sh *shard) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return ps.lookupShardTopics(sh)
+}
+
+// lookupShardTopics expects the lock to be held
+func (ps *pubsub) lookupShardTopics(sh *shard) []string {
+	topics := make([]string, 0)
+	for topic := range ps.registry.topics {
+		if ps.lookupShard(topic) == sh {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+type shardMove struct {
+	from *shard
+	to   *shard
+}
+
+// SetShards replaces the list of redis shards, connecting to new ones and
+// moving subscriptions for channels that now map elsewhere. Every node should
+// be given the same list.
+func (ps *pubsub) SetShards(addresses []string) error {
+	ps.lock.RLock()
+	existing := make(map[string]*shard)
+	for _, sh := range ps.shards {
+		existing[sh.subAddress] = sh
+	}
+	ps.lock.RUnlock()
+
+	shards := make([]*shard, len(addresses))
+	for idx, address := range addresses {
+		if sh, ok := existing[address]; ok {
+			shards[idx] = sh
+			delete(existing, address)
+			continue
+		}
+		sh := newShard(ps, address, address, nil)
+		err := sh.connect()
+		if err == nil {
+			// only turns on the firehose, no topics map here yet
+			err = sh.subscribeAll(sh.subscriber())
+		}
+		if err != nil {
+			for _, added := range shards[:idx] {
+				if added != nil && !ps.hasShard(added) {
+					added.close()
+				}
+			}
+			return err
+		}
+		sh.start()
+		shards[idx] = sh
+	}
+
+	var ring *hashRing
+	if len(shards) > 0 {
+		ring = newHashRing(addresses)
+	}
+
+	// subscribe on the new shards under the lock, like Subscribe does, so an
+	// unsubscribe cant slip in between
+	ps.lock.Lock()
+	moves := make(map[string]*shardMove)
+	for topic := range ps.registry.topics {
+		moves[topic] = &shardMove{from: ps.lookupShard(topic)}
+	}
+	ps.shards, ps.ring = shards, ring
+	for topic, move := range moves {
+		move.to = ps.lookupShard(topic)
+		if move.to == move.from {
+			delete(moves, topic)
+		} else if ps.opts.PubSubMode == PubSubModeNormal {
+			move.to.subscribe(topic)
+		}
+	}
+	ps.lock.Unlock()
+	log.Println("pubsub shards set to", addresses, "moving", len(moves), "topics")
+
+	removed := existing
+	time.AfterFunc(SHARD_REBALANCE_GRACE, func() {
+		ps.lock.RLock()
+		for topic, move := range moves {
+			// the topic may have moved back in the meantime
+			if ps.lookupShard(topic) != move.from {
+				move.from.unsubscribe(topic)
+			}
+		}
+		ps.lock.RUnlock()
+		for _, sh := range removed {
+			if !ps.hasShard(sh) {
+				sh.close()
+			}
+		}
+	})
+	return nil
+}
+
+func (ps *pubsub) hasShard(sh *shard) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	for _, s := range ps.shards {
+		if s == sh {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRingSpread(t *testing.T) {
+	addresses := []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}
+	ring := newHashRing(addresses)
+	counts := make([]int, len(addresses))
+	for i := 0; i < 30000; i++ {
+		counts[ring.get("channel-"+strconv.Itoa(i))]++
+	}
+	for idx, n := range counts {
+		// each shard should get roughly a third
+		if n < 7000 || n > 13000 {
+			t.Errorf("shard %d got %d of 30000 channels %v", idx, n, counts)
+		}
+	}
+}
+
+func TestHashRingStable(t *testing.T) {
+	before := newHashRing([]string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"})
+	after := newHashRing([]string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379", "10.0.0.4:6379"})
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		channel := "channel-" + strconv.Itoa(i)
+		from, to := before.get(channel), after.get(channel)
+		if from != to {
+			moved++
+			if to != 3 {
+				t.Fatalf("%s moved between existing shards %d to %d", channel, from, to)
+			}
+		}
+	}
+	// adding a fourth shard should only move about a quarter of the channels
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("expected about 2500 channels to move, %d did", moved)
+	}
+}
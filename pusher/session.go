@@ -241,4 +241,11 @@ func (s *session) Send(msg string) error {
 
 func (s *session) ID() string { return s.id }
 
+// Buffered returns the number of frames waiting for a receiver to be attached
+func (s *session) Buffered() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sendBuffer)
+}
+
 func (s *session) Path() string { return s.path }
@@ -12,6 +12,7 @@ type AppSettings struct {
 	Name               string `json:"name"`
 	ForceEncryption    bool   `json:"force_encryption"`
 	EnableClientEvents bool   `json:"enable_client_events"`
+	EnableUserInbox    bool   `json:"enable_user_inbox"` // see inbox.go
 	// EnableKeyspaceEvents bool `json:"enable_keyspace_events"`
 }
 
@@ -26,8 +27,7 @@ func appKey(appId string) string {
 func (s *server) createApp() string {
 	appId := newId()
 	log.Println("create app", appId)
-	key := appKey(appId)
-	err := s.redis.HMSetJSON(key, &AppSettings{})
+	err := s.store.SaveApp(appId, &AppSettings{})
 	if err != nil {
 		log.Println("error", err)
 	}
@@ -36,26 +36,23 @@ func (s *server) createApp() string {
 }
 
 func (s *server) loadApp(appId string) *AppSettings {
-	key := appKey(appId)
-	settings := &AppSettings{}
-	err := s.redis.HGetAllJSON(key, settings)
+	settings, err := s.store.LoadApp(appId)
 	if err != nil {
 		log.Println("error fetching settings")
+		return &AppSettings{}
 	}
 	return settings
 }
 
 func (s *server) deleteApp(appId string) {
-	key := appKey(appId)
-	_, err := s.redis.Del(key)
+	err := s.store.DeleteApp(appId)
 	if err != nil {
 		log.Println("error deleting app", err)
 	}
 }
 
 func (s *server) saveApp(appId string, settings *AppSettings) {
-	key := appKey(appId)
-	err := s.redis.HMSetJSON(key, settings)
+	err := s.store.SaveApp(appId, settings)
 	if err != nil {
 		log.Println("problem saving app", err)
 	}
@@ -12,17 +12,39 @@ import (
 	"strings"
 )
 
-func (s *server) verifyAuth(auth string, message string) bool {
+// verifyAuth checks auth, "<key>:<signature>", signs message with a key of
+// the app
+func (s *server) verifyAuth(appId string, auth string, message string) bool {
 	log.Println("message", message)
 	parts := strings.Split(auth, ":")
+	if len(parts) != 2 {
+		return false
+	}
 	authKey := parts[0]
-	authSecret, _ := s.lookupAuthSecret(authKey)
+	authSecret, ok := s.appAuthSecret(appId, authKey)
+	if !ok {
+		return false
+	}
 	log.Println("key", authKey)
-	log.Println("secret", authSecret)
 	hmac0 := parts[1]
 	hmac1 := hmacSha256HexSignature([]byte(message), []byte(authSecret))
-	log.Println("hmac", hmac0, hmac1)
-	return hmac0 == hmac1
+	return hmac.Equal([]byte(hmac0), []byte(hmac1))
+}
+
+// appAuthSecret returns the secret for key, only if the key is known and
+// belongs to appId, an unknown key would otherwise be checked against ""
+func (s *server) appAuthSecret(appId string, key string) (string, bool) {
+	secret, err := s.lookupAuthSecret(key)
+	if err != nil || secret == "" {
+		log.Println("unknown auth key", key, err)
+		return "", false
+	}
+	keyAppId, err := s.store.AuthKeyApp(key)
+	if err != nil || keyAppId == "" || keyAppId != appId {
+		log.Println("auth key", key, "doesnt belong to app", appId, err)
+		return "", false
+	}
+	return secret, true
 }
 
 func (s *server) verifyToken(tokenData string) {
@@ -39,20 +61,18 @@ func (s *server) verifyToken(tokenData string) {
 
 }
 
-const REDIS_AUTH_KEYS = "subhub://auth/keys"
+const (
+	REDIS_AUTH_KEYS     = "subhub://auth/keys"
+	REDIS_AUTH_KEY_APPS = "subhub://auth/apps" // key to the app it belongs to
+)
 
 func (s *server) saveAuth(key string, secret string) error {
-	_, err := s.redis.HSet(REDIS_AUTH_KEYS, key, secret)
-	return err
+	return s.store.SaveAuthSecret(key, secret)
 }
 
 func (s *server) lookupAuthSecret(key string) (string, error) {
 	// todo: add a key cache here..
-	secret, err := s.redis.HGet(REDIS_AUTH_KEYS, key)
-	if err != nil {
-		return "", err
-	}
-	return string(secret), nil
+	return s.store.AuthSecret(key)
 }
 
 // checkMAC returns true if messageMAC is a valid HMAC tag for message.
@@ -124,8 +144,8 @@ func (s *server) newAuthHandlerFunc() authHandlerFunc {
 		resp := &Response{Auth: auth, ChannelData: channelData}
 		data, _ := json.Marshal(resp)
 
-		log.Println("resp %+v", resp)
-		log.Println("callback %s", callback)
+		log.Printf("resp %+v", resp)
+		log.Printf("callback %s", callback)
 
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		// w.Header().Add("Access-Control-Allow-Methods", "*")
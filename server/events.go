@@ -7,6 +7,9 @@ const (
 	EVENT_SUBSCRIBE                       = "pusher:subscribe"
 	EVENT_UNSUBSCRIBE                     = "pusher:unsubscribe"
 	EVENT_ERROR                           = "pusher:error"
+	EVENT_ACK                             = "pusher:ack"
+	EVENT_SIGNIN                          = "pusher:signin"
+	EVENT_SIGNIN_SUCCESS                  = "pusher:signin_success"
 	EVENT_INTERNAL_SUBSCRIPTION_SUCCEEDED = "pusher_internal:subscription_succeeded"
 	// ??? is there unsubscription_succeeded too
 	EVENT_INTERNAL_MEMBER_ADDED   = "pusher_internal:member_added"
@@ -41,10 +44,11 @@ const (
 const RAW_CONNECTION_ESTABLISHED = `{"event":"pusher:connection_established","data":"{\"socket_id\":\"%s\",\"activity_timeout\":120}"}`
 const RAW_PING = "{\"event\":\"pusher:ping\",\"data\":\"{}\"}"
 const RAW_PONG = "{\"event\":\"pusher:pong\",\"data\":\"{}\"}"
+const RAW_SIGNIN_SUCCEEDED = `{"event":"pusher:signin_success","data":%s}`
 const RAW_SUBSCRIPTION_SUCCEEDED = `{"event":"pusher_internal:subscription_succeeded","channel":"%s","data":%s}`
 
 // const RAW_PRESENSE_SUBSCRIPTION_SUCCEEDED = `{"event":"pusher_internal:subscription_succeeded","data":"{\"channel\":\"%s\", \"presense\": %s}"}`
-const RAW_CHANNEL_EVENT = `{"event":"%s","channel":"%s","data":%s, "timestamp":%d}`
+const RAW_CHANNEL_EVENT = `{"event":"%s","channel":"%s","data":%s, "timestamp":%d, "id":"%s", "seq":%d}`
 
 type ConnectionEstablishedData struct {
 	SocketId        string `json:"socket_id"`
@@ -55,6 +59,8 @@ type SubscribeData struct {
 	Channel     string                 `json:"channel"`
 	Auth        string                 `json:"auth,omitempty"`
 	ChannelData map[string]interface{} `json:"channel_data,omitempty"`
+	LastSeq     int64                  `json:"last_seq,omitempty"`
+	ClientId    string                 `json:"client_id,omitempty"`
 }
 
 type UnsubscribeData struct {
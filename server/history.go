@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"github.com/screencloud/subhub/uuid"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// Events on a channel, from clients or the rest api, are numbered in the order
+// they are published. The number comes from an INCR on the channels seq key,
+// the same call keeps the event in a short history sorted by it. A client that
+// reconnects subscribes with the last seq it saw as last_seq and is sent what
+// it missed from the history, or a subhub:gap event when the history doesnt go
+// back that far, so it knows to resync. Internal events, like presence, arent
+// numbered and go out with seq 0. The history goes an hour after the last event
+// but the seq is kept for a month, so a quiet channel carries on counting up.
+//
+// A node holds the channels seq lock from the INCR until the event is handed to
+// the pubsub, so its own events go out in seq order. Two nodes publishing at
+// once can still deliver their events out of seq order, and an event published
+// while a client resubscribes can arrive both replayed and live, clients should
+// skip any seq they have already seen rather than anything below the last one.
+
+const (
+	REDIS_CHANNEL_SEQ          = "subhub://channel/%s/seq"
+	REDIS_CHANNEL_HISTORY_ZSET = "subhub://channel/%s/history"
+
+	CHANNEL_HISTORY_SIZE = 100
+	CHANNEL_HISTORY_TTL  = time.Hour
+	CHANNEL_SEQ_TTL      = 30 * 24 * time.Hour
+
+	CHANNEL_SEQ_LOCKS = 256 // channels share these by hash
+)
+
+// sent as the data of a subhub:gap event when a resume cant be replayed
+const GAP_REASON_HISTORY = `{"reason":"history","last_seq":%d,"seq":%d}`
+
+type HistoryEntry struct {
+	Seq  int64
+	Data string // the message as JSON, without its seq
+}
+
+func historyKeys(channel string) (string, string) {
+	return fmt.Sprintf(REDIS_CHANNEL_SEQ, channel), fmt.Sprintf(REDIS_CHANNEL_HISTORY_ZSET, channel)
+}
+
+// seqLock serialises sequence and publish on channel, hold it until the
+// sequenced message is handed to the pubsub
+func (s *server) seqLock(channel string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(channel))
+	return &s.seqLocks[h.Sum32()%CHANNEL_SEQ_LOCKS]
+}
+
+// sequence gives msg the next seq on the channel and keeps it in the history,
+// if that fails it goes out unsequenced
+func (s *server) sequence(channel string, msg *pubsub.Message) {
+	if msg.Id == "" {
+		msg.Id = uuid.NewV7().String()
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixNano()
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("problem encoding message for history", err)
+		return
+	}
+	seq, err := s.store.AppendHistory(channel, string(data), CHANNEL_HISTORY_SIZE, CHANNEL_HISTORY_TTL, CHANNEL_SEQ_TTL)
+	if err != nil {
+		log.Println("problem sequencing message", channel, err)
+		return
+	}
+	msg.Seq = seq
+}
+
+// resume sends sock what it missed on channel since lastSeq, or a gap event
+// if that cant be done
+func (s *server) resume(sock *socket, channel string, lastSeq int64) {
+	entries, latest, err := s.store.History(channel, lastSeq)
+	if err != nil {
+		log.Println("problem reading channel history", channel, err)
+	}
+	if err == nil && latest == lastSeq {
+		return // nothing missed
+	}
+	// the seq went backwards if it expired, or the history was trimmed or expired
+	if err != nil || latest < lastSeq || len(entries) == 0 || entries[0].Seq != lastSeq+1 {
+		sock.session.Send(channelEventFrame(channel, &pubsub.Message{
+			Name:      pubsub.EVENT_NAME_GAP,
+			Data:      fmt.Sprintf(GAP_REASON_HISTORY, lastSeq, latest),
+			Timestamp: time.Now().UnixNano(),
+		}))
+		return
+	}
+	for _, entry := range entries {
+		msg := &pubsub.Message{}
+		if err := json.Unmarshal([]byte(entry.Data), msg); err != nil {
+			log.Println("problem decoding channel history", channel, err)
+			continue
+		}
+		msg.Seq = entry.Seq
+		sock.session.Send(channelEventFrame(channel, msg))
+	}
+}
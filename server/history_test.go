@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSession keeps every frame sent
+type recordSession struct {
+	frames []string
+}
+
+func (rs *recordSession) ID() string                               { return "resumed" }
+func (rs *recordSession) Recv() (string, error)                    { return "", io.EOF }
+func (rs *recordSession) Close(status uint32, reason string) error { return nil }
+func (rs *recordSession) Send(frame string) error {
+	rs.frames = append(rs.frames, frame)
+	return nil
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	ms := newMemoryStore()
+	for i := 1; i <= 5; i++ {
+		seq, err := ms.AppendHistory("screens", fmt.Sprint(i), 3, time.Minute, time.Hour)
+		if err != nil || seq != int64(i) {
+			t.Fatalf("expected seq %d got %d %v", i, seq, err)
+		}
+	}
+	// kept to size
+	entries, latest, _ := ms.History("screens", 0)
+	if latest != 5 || len(entries) != 3 || entries[0].Seq != 3 || entries[2].Data != "5" {
+		t.Errorf("unexpected history %d %+v", latest, entries)
+	}
+	if entries, _, _ = ms.History("screens", 4); len(entries) != 1 || entries[0].Seq != 5 {
+		t.Errorf("expected what came after 4 got %+v", entries)
+	}
+	// an expired history keeps counting
+	ms.AppendHistory("menus", "a", 3, -time.Second, time.Hour)
+	if entries, latest, _ := ms.History("menus", 0); len(entries) != 0 || latest != 1 {
+		t.Errorf("expected the history gone but the seq kept got %d %+v", latest, entries)
+	}
+	if seq, _ := ms.AppendHistory("menus", "b", 3, time.Minute, time.Hour); seq != 2 {
+		t.Errorf("expected the seq to go up after the history expired got %d", seq)
+	}
+	if entries, _, _ := ms.History("menus", 0); len(entries) != 1 || entries[0].Seq != 2 {
+		t.Errorf("expected only the new entry got %+v", entries)
+	}
+	// only once the seq expires does it start again
+	ms.AppendHistory("boards", "a", 3, -time.Second, -time.Second)
+	if seq, _ := ms.AppendHistory("boards", "b", 3, time.Minute, time.Hour); seq != 1 {
+		t.Errorf("expected an expired seq to start again got %d", seq)
+	}
+}
+
+func TestEventsAreSequenced(t *testing.T) {
+	s := newTestServer()
+	sessions := subscribeSockets(s, "screens", 1)
+	for i := 1; i <= 2; i++ {
+		if _, err := s.publishEvent("app", &EventJSON{Name: "update", Data: `{}`, Channel: "screens"}); err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf(`"seq":%d}`, i); !strings.HasSuffix(sessions[0].last, expected) {
+			t.Errorf("expected %s in %s", expected, sessions[0].last)
+		}
+	}
+}
+
+// slowHistoryStore widens the gap between a seq being handed out and used
+type slowHistoryStore struct {
+	Store
+}
+
+func (ss *slowHistoryStore) AppendHistory(channel string, data string, size int, ttl time.Duration, seqTTL time.Duration) (int64, error) {
+	seq, err := ss.Store.AppendHistory(channel, data, size, ttl, seqTTL)
+	time.Sleep(time.Duration(seq%3) * time.Millisecond)
+	return seq, err
+}
+
+func TestConcurrentEventsInSeqOrder(t *testing.T) {
+	s := newTestServer()
+	s.store = &slowHistoryStore{s.store}
+	session := &recordSession{}
+	s.pubsub.Subscribe(s.newSocket(session, "/app/test", TRANSPORT_WEBSOCKET), "screens")
+	var wg sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				s.publishEvent("app", &EventJSON{Name: "update", Data: `{}`, Channel: "screens"})
+			}
+		}()
+	}
+	wg.Wait()
+	if len(session.frames) != 200 {
+		t.Fatalf("expected 200 events got %d", len(session.frames))
+	}
+	for idx, frame := range session.frames {
+		if expected := fmt.Sprintf(`"seq":%d}`, idx+1); !strings.HasSuffix(frame, expected) {
+			t.Fatalf("expected %s in %s", expected, frame)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	s := newTestServer()
+	for i := 0; i < CHANNEL_HISTORY_SIZE+10; i++ {
+		s.sequence("screens", &pubsub.Message{Name: "update", Data: fmt.Sprintf(`{"n":%d}`, i)})
+	}
+	latest := int64(CHANNEL_HISTORY_SIZE + 10)
+	for _, test := range []struct {
+		lastSeq int64
+		frames  int
+		gap     bool
+	}{
+		{latest, 0, false},
+		{latest - 2, 2, false},
+		{10, CHANNEL_HISTORY_SIZE, false},
+		{9, 1, true},          // trimmed
+		{latest + 5, 1, true}, // the seq expired and started again
+	} {
+		session := &recordSession{}
+		sock := s.newSocket(session, "/app/test", TRANSPORT_WEBSOCKET)
+		s.resume(sock, "screens", test.lastSeq)
+		if len(session.frames) != test.frames {
+			t.Errorf("resuming from %d expected %d frames got %d", test.lastSeq, test.frames, len(session.frames))
+			continue
+		}
+		if gap := test.frames > 0 && strings.Contains(session.frames[0], pubsub.EVENT_NAME_GAP); gap != test.gap {
+			t.Errorf("resuming from %d expected gap %v got %s", test.lastSeq, test.gap, session.frames[0])
+		}
+		if !test.gap && test.frames > 0 {
+			if first := fmt.Sprintf(`"seq":%d}`, test.lastSeq+1); !strings.HasSuffix(session.frames[0], first) {
+				t.Errorf("expected the replay to start with %s got %s", first, session.frames[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"log"
+	"time"
+)
+
+// Apps with enable_user_inbox set keep what is sent to a user while none of
+// their sockets are signed in, anywhere. An event on a users channel that
+// nobody received is put in their inbox, which is kept to USER_INBOX_SIZE
+// dropping the oldest and goes USER_INBOX_TTL after the last event put in it.
+// When the user next signs in the inbox is emptied and sent in order.
+//
+// Whether anyone received an event comes from the publish count, which only
+// says no for a topic no node is subscribed to in the default pubsub mode, so
+// the inbox doesnt work in the firehose or nats modes.
+
+const REDIS_USER_INBOX_LIST = "subhub://app/%s/user/%s/inbox"
+
+const (
+	USER_INBOX_SIZE = 100
+	USER_INBOX_TTL  = 7 * 24 * time.Hour
+)
+
+func userInboxKey(appId string, userId string) string {
+	return fmt.Sprintf(REDIS_USER_INBOX_LIST, appId, userId)
+}
+
+// keepForOfflineUser puts an event on a users channel that reached nobody in
+// their inbox, if the app has one
+func (s *server) keepForOfflineUser(appId string, channel string, msg *pubsub.Message) {
+	if !s.loadApp(appId).EnableUserInbox {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("unable to marshal inbox message", err)
+		return
+	}
+	userId := channel[len(CHANNEL_PREFIX_USER):]
+	if err := s.store.PushInbox(appId, userId, string(data), USER_INBOX_SIZE, USER_INBOX_TTL); err != nil {
+		log.Println("problem adding to user inbox", userId, err)
+		return
+	}
+	inboxQueuedCounter.Inc(s.metricsApp(appId))
+}
+
+// flushInbox sends and empties the users inbox
+func (s *server) flushInbox(sock *socket, userId string) {
+	list, err := s.store.TakeInbox(sock.appId, userId)
+	if err != nil {
+		log.Println("problem taking user inbox", userId, err)
+		return
+	}
+	channel := userChannel(userId)
+	for _, msg := range decodeInbox(list) {
+		sock.session.Send(channelEventFrame(channel, msg))
+	}
+}
+
+func decodeInbox(list []string) []*pubsub.Message {
+	messages := make([]*pubsub.Message, 0, len(list))
+	for _, data := range list {
+		msg := &pubsub.Message{}
+		if err := json.Unmarshal([]byte(data), msg); err != nil {
+			log.Println("error decoding inbox message", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func (s *server) listInbox(appId string, userId string) []*pubsub.Message {
+	list, err := s.store.Inbox(appId, userId)
+	if err != nil {
+		log.Println("error reading user inbox", err)
+	}
+	return decodeInbox(list)
+}
+
+// purgeInbox empties the users inbox and returns how much was in it
+func (s *server) purgeInbox(appId string, userId string) int {
+	list, err := s.store.TakeInbox(appId, userId)
+	if err != nil {
+		log.Println("problem purging user inbox", err)
+	}
+	return len(list)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signin(s *server, sock *socket, secret string, userData string) {
+	signinWithKey(s, sock, "key", secret, userData)
+}
+
+func signinWithKey(s *server, sock *socket, key string, secret string, userData string) {
+	message := fmt.Sprintf(SIGNIN_MESSAGE_FORMAT, sock.ID(), userData)
+	s.handleSignin(sock, key+":"+hmacSha256HexSignature([]byte(message), []byte(secret)), userData)
+}
+
+func saveKey(s *server, appId string, key string, secret string) {
+	s.store.SaveAuthSecret(key, secret)
+	s.store.SaveAuthKeyApp(key, appId)
+}
+
+func sendToUser(t *testing.T, s *server, userId string, n int) {
+	event := &EventJSON{Name: "notify", Data: fmt.Sprintf(`{"n":%d}`, n), Channel: userChannel(userId)}
+	if _, err := s.publishEvent("app", event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignin(t *testing.T) {
+	s := newTestServer()
+	saveKey(s, "app", "key", "secret")
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/app", TRANSPORT_WEBSOCKET)
+
+	for _, userData := range []string{`{"name":"no id"}`, `not json`} {
+		signin(s, sock, "secret", userData)
+	}
+	signin(s, sock, "wrong", `{"id":"u1"}`)
+	if len(session.frames) != 0 || sock.userId != "" {
+		t.Fatalf("expected the sign ins to fail got %v", session.frames)
+	}
+
+	signin(s, sock, "secret", `{"id":"u1"}`)
+	if len(session.frames) != 1 || !strings.Contains(session.frames[0], EVENT_SIGNIN_SUCCESS) {
+		t.Fatalf("expected signin success got %v", session.frames)
+	}
+	if !s.pubsub.IsSubscribed(sock, userTopic("app", "u1")) {
+		t.Errorf("expected the socket on the users channel")
+	}
+	// signing in as someone else moves it
+	signin(s, sock, "secret", `{"id":"u2"}`)
+	if s.pubsub.IsSubscribed(sock, userTopic("app", "u1")) || !s.pubsub.IsSubscribed(sock, userTopic("app", "u2")) {
+		t.Errorf("expected the socket moved to the new users channel")
+	}
+}
+
+func TestUserInbox(t *testing.T) {
+	s := newTestServer()
+	saveKey(s, "app", "key", "secret")
+
+	// off by default
+	sendToUser(t, s, "u1", 0)
+	if inbox := s.listInbox("app", "u1"); len(inbox) != 0 {
+		t.Fatalf("expected no inbox got %+v", inbox)
+	}
+
+	s.saveApp("app", &AppSettings{EnableUserInbox: true})
+	for i := 1; i <= 3; i++ {
+		sendToUser(t, s, "u1", i)
+	}
+	if inbox := s.listInbox("app", "u1"); len(inbox) != 3 || inbox[0].Data != `{"n":1}` {
+		t.Fatalf("expected 3 kept oldest first got %+v", inbox)
+	}
+
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/app", TRANSPORT_WEBSOCKET)
+	signin(s, sock, "secret", `{"id":"u1"}`)
+	if len(session.frames) != 4 {
+		t.Fatalf("expected signin and 3 events got %v", session.frames)
+	}
+	for i, frame := range session.frames[1:] {
+		if !strings.Contains(frame, fmt.Sprintf(`{\"n\":%d}`, i+1)) || !strings.Contains(frame, userChannel("u1")) {
+			t.Errorf("expected event %d in order got %s", i+1, frame)
+		}
+	}
+	if inbox := s.listInbox("app", "u1"); len(inbox) != 0 {
+		t.Errorf("expected the inbox emptied got %+v", inbox)
+	}
+
+	// online users get it straight away
+	sendToUser(t, s, "u1", 4)
+	if len(session.frames) != 5 || len(s.listInbox("app", "u1")) != 0 {
+		t.Errorf("expected the event delivered live got %d frames", len(session.frames))
+	}
+
+	sendToUser(t, s, "u2", 1)
+	if n := s.purgeInbox("app", "u2"); n != 1 || len(s.listInbox("app", "u2")) != 0 {
+		t.Errorf("expected 1 purged got %d", n)
+	}
+}
+
+// signin needs a known key of the sockets own app, an unknown key would
+// otherwise be checked against an empty secret
+func TestSigninKeys(t *testing.T) {
+	s := newTestServer()
+	s.saveApp("app", &AppSettings{EnableUserInbox: true})
+	saveKey(s, "other", "other-key", "other-secret")
+	sendToUser(t, s, "u1", 1)
+
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/app", TRANSPORT_WEBSOCKET)
+	signinWithKey(s, sock, "unknown", "", `{"id":"u1"}`)
+	signinWithKey(s, sock, "other-key", "other-secret", `{"id":"u1"}`)
+	if len(session.frames) != 0 || sock.userId != "" {
+		t.Fatalf("expected the sign ins to fail got %v", session.frames)
+	}
+	if inbox := s.listInbox("app", "u1"); len(inbox) != 1 {
+		t.Errorf("expected the inbox left alone got %+v", inbox)
+	}
+}
+
+// the same user id in two apps are different users
+func TestUserChannelPerApp(t *testing.T) {
+	s := newTestServer()
+	saveKey(s, "a", "key", "secret")
+	s.saveApp("b", &AppSettings{EnableUserInbox: true})
+
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/a", TRANSPORT_WEBSOCKET)
+	signin(s, sock, "secret", `{"id":"42"}`)
+	if _, err := s.publishEvent("b", &EventJSON{Name: "notify", Data: `{}`, Channel: userChannel("42")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.frames) != 1 {
+		t.Errorf("expected app as user not to get app bs event got %v", session.frames)
+	}
+	if inbox := s.listInbox("b", "42"); len(inbox) != 1 {
+		t.Errorf("expected app bs user offline and the event kept got %+v", inbox)
+	}
+
+	// the channel clients see has no app id in it
+	if _, err := s.publishEvent("a", &EventJSON{Name: "notify", Data: `{}`, Channel: userChannel("42")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(session.frames) != 2 || !strings.Contains(session.frames[1], `"channel":"#server-to-user-42"`) {
+		t.Errorf("expected the event on the users channel got %v", session.frames)
+	}
+}
+
+func TestMemoryStoreInbox(t *testing.T) {
+	ms := newMemoryStore()
+	for i := 0; i < 5; i++ {
+		ms.PushInbox("app", "u1", fmt.Sprint(i), 3, time.Minute)
+	}
+	if inbox, _ := ms.Inbox("app", "u1"); len(inbox) != 3 || inbox[0] != "2" || inbox[2] != "4" {
+		t.Errorf("expected the newest 3 got %v", inbox)
+	}
+	ms.PushInbox("app", "u2", "a", 3, -time.Second)
+	if inbox, _ := ms.TakeInbox("app", "u2"); len(inbox) != 0 {
+		t.Errorf("expected an expired inbox to be empty got %v", inbox)
+	}
+}
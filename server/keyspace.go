@@ -6,16 +6,21 @@ import (
 	"log"
 )
 
-const KEYSPACE_NOTIFICATION_PREFIX = "__keyspace@0__:"
-
 func (s *server) handleSubscribeKeyspace(sock *socket, channel string, auth string) {
-	s.pubsub.Subscribe(sock, KEYSPACE_NOTIFICATION_PREFIX+channel)
-	sock.session.Send(fmt.Sprintf(RAW_SUBSCRIPTION_SUCCEEDED, channel))
+	if s.redis == nil {
+		log.Println("keyspace channels need the redis store")
+		return
+	}
+	s.pubsub.Subscribe(sock, s.keyspacePrefix+channel)
+	sock.session.Send(fmt.Sprintf(RAW_SUBSCRIPTION_SUCCEEDED, channel, "\"\""))
 }
 
 func (s *server) handleNotifyObjectChange(sock *socket, channel string, keyspaceEvent string) {
+	if s.redis == nil {
+		return
+	}
 
-	data, err := redisGetKeyData(s.redis.Slave(), channel)
+	data, err := redisGetKeyData(s.redis, channel)
 	if err != nil {
 		log.Println("problem subscribing to object", err.Error())
 		return
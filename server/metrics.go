@@ -0,0 +1,107 @@
+package server
+
+import (
+	"github.com/screencloud/subhub/metrics"
+	"log"
+	"sync"
+)
+
+const (
+	TRANSPORT_WEBSOCKET = "websocket"
+	TRANSPORT_SOCKJS    = "sockjs"
+)
+
+// app ids are fine as labels, there are few of them, channels and sockets are
+// not. Anyone can connect with any app id though, so only apps in the store
+// get their own label, see metricsApp.
+const METRICS_UNKNOWN_APP = "unknown"
+
+var (
+	connectionsGauge = metrics.NewGauge("subhub_connections",
+		"Open connections.", "transport", "app")
+	publishedCounter = metrics.NewCounter("subhub_messages_published_total",
+		"Messages published by clients and the rest api.", "app")
+	clientEventsRejectedCounter = metrics.NewCounter("subhub_client_events_rejected_total",
+		"Client events that were not published.", "app", "reason")
+	authFailuresCounter = metrics.NewCounter("subhub_auth_failures_total",
+		"Failed signature checks, on channel subscribe or the rest api.", "kind")
+	reliableRedeliveredCounter = metrics.NewCounter("subhub_reliable_redelivered_total",
+		"Events on reliable channels sent again for want of an ack.", "app")
+	reliableRecoveredCounter = metrics.NewCounter("subhub_reliable_recovered_total",
+		"Pending events sent again to a client that reconnected.", "app")
+	reliableUndeliveredCounter = metrics.NewCounter("subhub_reliable_undelivered_total",
+		"Events on reliable channels given up on.", "app", "reason")
+	inboxQueuedCounter = metrics.NewCounter("subhub_inbox_queued_total",
+		"Events kept in the inbox of a user who was offline.", "app")
+)
+
+// bufferedSession is a session that can say how many frames are queued up waiting to be sent
+type bufferedSession interface {
+	Buffered() int
+}
+
+// metricsApp is the label to use for appId, apps are remembered once seen
+// so only unknown ones go to the store each time
+func (s *server) metricsApp(appId string) string {
+	s.metricsAppLock.Lock()
+	known := s.metricsApps[appId]
+	s.metricsAppLock.Unlock()
+	if known {
+		return appId
+	}
+	exists, err := s.store.AppExists(appId)
+	if err != nil {
+		log.Println("problem checking app for metrics", err)
+	}
+	if !exists {
+		return METRICS_UNKNOWN_APP
+	}
+	s.metricsAppLock.Lock()
+	if s.metricsApps == nil {
+		s.metricsApps = make(map[string]bool)
+	}
+	s.metricsApps[appId] = true
+	s.metricsAppLock.Unlock()
+	return appId
+}
+
+// statsApp is the app to count stats under, "" for an app not in the store
+func (s *server) statsApp(appId string) string {
+	if s.metricsApp(appId) != appId {
+		return ""
+	}
+	return appId
+}
+
+// the metrics are global so are registered once, reading the last server made
+var (
+	registerMetricsOnce sync.Once
+	metricsServerLock   sync.RWMutex
+	metricsServer       *server
+)
+
+func (s *server) registerMetrics() {
+	metricsServerLock.Lock()
+	metricsServer = s
+	metricsServerLock.Unlock()
+	registerMetricsOnce.Do(func() {
+		metrics.NewGaugeFunc("subhub_send_queue_depth", "Frames queued for sending across all sockets.", func() float64 {
+			metricsServerLock.RLock()
+			s := metricsServer
+			metricsServerLock.RUnlock()
+			return float64(s.sendQueueDepth())
+		})
+	})
+}
+
+func (s *server) sendQueueDepth() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	depth := 0
+	for _, sock := range s.sockets {
+		if session, ok := sock.session.(bufferedSession); ok {
+			depth += session.Buffered()
+		}
+	}
+	return depth
+}
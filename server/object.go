@@ -3,7 +3,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/xuyu/goredis"
+	"github.com/screencloud/subhub/xredis"
 	"log"
 )
 
@@ -16,7 +16,7 @@ const (
 	OBJECT_TYPE_NONE   = "none"
 )
 
-func redisGetKeyData(r *goredis.Redis, key string) (string, error) {
+func redisGetKeyData(r *xredis.Redis, key string) (string, error) {
 	objectType, err := r.Type(key)
 	var data string = ""
 	if err != nil {
@@ -67,8 +67,12 @@ func (s *server) handleSubscribeObject(sock *socket, channel string, auth string
 	// panic("object channels not yet implemented")
 
 	// check the key type, is it a hash or a key
+	if s.redis == nil {
+		log.Println("object channels need the redis store")
+		return
+	}
 
-	data, err := redisGetKeyData(s.redis.Slave(), channel)
+	data, err := redisGetKeyData(s.redis, channel)
 	if err != nil {
 		log.Println("problem subscribing to object", err.Error())
 		return
@@ -88,8 +92,8 @@ func (s *server) handleSubscribeObject(sock *socket, channel string, auth string
 	}
 
 	// now subscribe to keyspace notifications
-	s.pubsub.Subscribe(sock, KEYSPACE_NOTIFICATION_PREFIX+channel)
+	s.pubsub.Subscribe(sock, s.keyspacePrefix+channel)
 
-	sock.session.Send(fmt.Sprintf(RAW_SUBSCRIPTION_SUCCEEDED, channel))
+	sock.session.Send(fmt.Sprintf(RAW_SUBSCRIPTION_SUCCEEDED, channel, "\"\""))
 	sock.session.Send(string(packet))
 }
@@ -8,31 +8,60 @@ import (
 	"strconv"
 )
 
-const REDIS_CHANNEL_MEMBERS_HASH = "subhub://channel/%s/members"
+const (
+	REDIS_CHANNEL_MEMBERS_HASH = "subhub://channel/%s/members"
+	// how many sockets each member has subscribed, a member only joins on
+	// their first socket and leaves with their last
+	REDIS_CHANNEL_MEMBER_COUNTS_HASH = "subhub://channel/%s/member_counts"
+)
+
+func presenseKeys(channel string) (string, string) {
+	return fmt.Sprintf(REDIS_CHANNEL_MEMBERS_HASH, channel), fmt.Sprintf(REDIS_CHANNEL_MEMBER_COUNTS_HASH, channel)
+}
 
-func (s *server) presenseMemberAdded(sock *socket, channel string, userId string, userData interface{}) {
+// presenseMemberAdded saves the member and reads back all the members in one
+// go, so the new member is sure to be in the list.
+// Other members are only told when this is the users first socket on the channel.
+func (s *server) presenseMemberAdded(sock *socket, channel string, userId string, userData interface{}) (map[string]string, error) {
 	userDataJSON, _ := json.Marshal(userData)
-	msg := &pubsub.Message{
-		Name: EVENT_INTERNAL_MEMBER_ADDED, //  "pusher_internal:member_removed",
-		Data: fmt.Sprintf("{\"user_id\": \"%s\", \"user_data\": %s}", userId, userDataJSON),
-	}
-	key := fmt.Sprintf(REDIS_CHANNEL_MEMBERS_HASH, channel)
-	log.Println("save", key, userId, string(userDataJSON))
-	resp, err := s.redis.HSet(key, userId, string(userDataJSON))
-	log.Println("resp", resp)
+	log.Println("save", channel, userId, string(userDataJSON))
+	count, members, err := s.store.PresenceJoin(channel, userId, string(userDataJSON))
 	if err != nil {
-		log.Println("problem adding member to hash", err, resp)
+		log.Println("problem adding member to hash", err)
+		return nil, err
+	}
+	log.Printf("presence join %s %s sockets %d members %+v", channel, userId, count, members)
+	if count == 1 {
+		msg := &pubsub.Message{
+			Name:  EVENT_INTERNAL_MEMBER_ADDED, //  "pusher_internal:member_added",
+			Data:  fmt.Sprintf("{\"user_id\": \"%s\", \"user_data\": %s}", userId, userDataJSON),
+			AppId: sock.appId,
+		}
+		s.pubsub.PublishAsync(sock, channel, msg, nil)
+		s.callWebhooks(sock.appId, &WebhookEvent{Name: WEBHOOK_MEMBER_ADDED, Channel: channel, UserId: userId})
 	}
-	s.pubsub.Publish(sock, channel, msg)
+	s.stats.user(sock.statsApp, userId)
+	return members, nil
 }
 
+// presenseMemberRemoved drops one of the users sockets, other members are
+// only told when it was the last one
 func (s *server) presenseMemberRemoved(sock *socket, channel string, userId string) {
+	count, _, err := s.store.PresenceLeave(channel, userId)
+	if err != nil {
+		log.Println("problem removing member from hash", err)
+		return
+	}
+	if count > 0 {
+		return
+	}
 	msg := &pubsub.Message{
-		Name: EVENT_INTERNAL_MEMBER_REMOVED, //  "pusher_internal:member_removed",
-		Data: fmt.Sprintf("{\"user_id\": \"%s\"}", userId),
+		Name:  EVENT_INTERNAL_MEMBER_REMOVED, //  "pusher_internal:member_removed",
+		Data:  fmt.Sprintf("{\"user_id\": \"%s\"}", userId),
+		AppId: sock.appId,
 	}
-	s.redis.HDel(fmt.Sprintf(REDIS_CHANNEL_MEMBERS_HASH, channel), userId)
-	s.pubsub.Publish(sock, channel, msg)
+	s.pubsub.PublishAsync(sock, channel, msg, nil)
+	s.callWebhooks(sock.appId, &WebhookEvent{Name: WEBHOOK_MEMBER_REMOVED, Channel: channel, UserId: userId})
 }
 
 func (s *server) handleSubscribePresense(sock *socket, channel string, channelData string) {
@@ -53,18 +82,15 @@ func (s *server) handleSubscribePresense(sock *socket, channel string, channelDa
 	}
 	log.Printf("memberData %+v", memberData)
 	userId := fmt.Sprintf("%v", memberData.UserId)
-	s.presenseMemberAdded(sock, channel, userId, memberData.UserInfo)
+	members, err := s.presenseMemberAdded(sock, channel, userId, memberData.UserInfo)
+	if err != nil {
+		// not a member, so there is nothing to leave later
+		return
+	}
 
 	// add to the sock
 	sock.presense[channel] = userId
 
-	// read from master here as we cant be sure its synced to client
-	key := fmt.Sprintf(REDIS_CHANNEL_MEMBERS_HASH, channel)
-	log.Println("key", key)
-	members, err := s.redis.HGetAll(key)
-
-	log.Printf("redis hgetall %+v %+v", members, err)
-
 	var ids []string
 	var hash = make(map[string]interface{})
 	for id := range members {
@@ -95,8 +121,14 @@ func (s *server) handleSubscribePresense(sock *socket, channel string, channelDa
 
 func (s *server) handleUnsubscribePresense(sock *socket, channel string) {
 	// lookup the userId
-	userId := sock.presense[channel]
+	userId, ok := sock.presense[channel]
+	if !ok {
+		// never joined, nothing to leave
+		s.pubsub.Unsubscribe(sock, channel)
+		return
+	}
 	// remove from the map
 	delete(sock.presense, channel)
 	s.presenseMemberRemoved(sock, channel, userId)
+	s.pubsub.Unsubscribe(sock, channel)
 }
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+// joinFailStore cant reach the presence hashes
+type joinFailStore struct {
+	Store
+	leaves int
+}
+
+func (js *joinFailStore) PresenceJoin(channel string, userId string, userData string) (int64, map[string]string, error) {
+	return 0, nil, errors.New("store down")
+}
+
+func (js *joinFailStore) PresenceLeave(channel string, userId string) (int64, map[string]string, error) {
+	js.leaves++
+	return js.Store.PresenceLeave(channel, userId)
+}
+
+func TestPresenceJoinFails(t *testing.T) {
+	s := newTestServer()
+	store := &joinFailStore{Store: s.store}
+	s.store = store
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/test", TRANSPORT_WEBSOCKET)
+	s.handleSubscribePresense(sock, "presence-room", `{"user_id":"1"}`)
+	if _, ok := sock.presense["presence-room"]; ok {
+		t.Errorf("expected no membership after a failed join")
+	}
+	if s.pubsub.IsSubscribed(sock, "presence-room") || len(session.frames) != 0 {
+		t.Errorf("expected the subscribe to fail got %v", session.frames)
+	}
+	s.handleUnsubscribePresense(sock, "presence-room")
+	s.removeSocket(sock)
+	if store.leaves != 0 {
+		t.Errorf("expected nothing to leave got %d", store.leaves)
+	}
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"log"
+	"strings"
+	"time"
+)
+
+// Channels named reliable-, or private-reliable- to need auth, get at least
+// once delivery. Every event sent to a socket on one is pending until the
+// client acks its id with pusher:ack, until then it is sent again with backoff.
+// One that runs out of attempts is logged as undelivered for the app.
+//
+// A client that subscribes with a client_id has its pending deliveries kept in
+// the store too, so when it reconnects, to this node or another, and subscribes
+// with the same client_id they are sent again, with the attempts starting
+// over. Without one they are logged as undelivered when the socket closes, and
+// a client that doesnt come back within RELIABLE_PENDING_TTL has them logged
+// as expired. Clients can see an event more than once and should drop ids they
+// have seen.
+//
+// Events are tracked on the fan-out workers, so the store writes for them are
+// queued and written in one go every RELIABLE_RETRY_INTERVAL instead, acks go
+// through the same queue so they land after the write they undo.
+
+const (
+	REDIS_CLIENT_PENDING_HASH  = "subhub://app/%s/client/%s/pending"
+	REDIS_APP_UNDELIVERED_LIST = "subhub://app/%s/undelivered"
+	// client pending hashes by when they expire, so they can be logged
+	REDIS_PENDING_EXPIRY_ZSET = "subhub://reliable/expiry"
+
+	CHANNEL_PREFIX_RELIABLE = "reliable-"
+)
+
+const (
+	RELIABLE_RETRY_INTERVAL    = 500 * time.Millisecond // how often pending deliveries are checked
+	RELIABLE_RETRY_BACKOFF     = 2 * time.Second
+	RELIABLE_RETRY_MAX_BACKOFF = time.Minute
+	RELIABLE_MAX_ATTEMPTS      = 8
+	RELIABLE_PENDING_TTL       = 24 * time.Hour
+	RELIABLE_EXPIRE_INTERVAL   = time.Minute // how often expired clients are looked for
+	UNDELIVERED_LOG_SIZE       = 1000        // kept per app, newest first
+)
+
+const (
+	UNDELIVERED_REASON_ATTEMPTS     = "attempts"
+	UNDELIVERED_REASON_DISCONNECTED = "disconnected"
+	UNDELIVERED_REASON_EXPIRED      = "expired"
+)
+
+type reliableDelivery struct {
+	AppId    string          `json:"app_id"`
+	Channel  string          `json:"channel"`
+	ClientId string          `json:"client_id,omitempty"`
+	Message  *pubsub.Message `json:"message"`
+	Attempts int             `json:"attempts"`
+	// set when it is logged as undelivered
+	Reason string `json:"reason,omitempty"`
+	TimeMs int64  `json:"time_ms,omitempty"`
+
+	due time.Time
+}
+
+// PendingWrite saves a pending delivery for a client, or removes it when Data
+// is empty
+type PendingWrite struct {
+	AppId    string
+	ClientId string
+	Id       string
+	Data     string
+}
+
+func clientPendingKey(appId string, clientId string) string {
+	return fmt.Sprintf(REDIS_CLIENT_PENDING_HASH, appId, clientId)
+}
+
+func undeliveredKey(appId string) string {
+	return fmt.Sprintf(REDIS_APP_UNDELIVERED_LIST, appId)
+}
+
+func isReliableChannel(channel string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(channel, CHANNEL_PREFIX_PRIVATE), CHANNEL_PREFIX_RELIABLE)
+}
+
+func reliableBackoff(attempt int) time.Duration {
+	backoff := RELIABLE_RETRY_BACKOFF
+	for i := 1; i < attempt && backoff < RELIABLE_RETRY_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > RELIABLE_RETRY_MAX_BACKOFF {
+		backoff = RELIABLE_RETRY_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// subscribeReliable remembers the client id for the channel and sends again
+// whatever the client left pending on it
+func (s *server) subscribeReliable(sock *socket, channel string, clientId string) {
+	sock.reliableLock.Lock()
+	sock.clientIds[channel] = clientId
+	sock.reliableLock.Unlock()
+	if clientId == "" {
+		return
+	}
+	// so what this node has queued for the client is there to read
+	s.flushPendingWrites()
+	pending, err := s.store.PendingDeliveries(sock.appId, clientId)
+	if err != nil {
+		log.Println("problem loading pending deliveries", clientId, err)
+		return
+	}
+	now := time.Now()
+	for _, data := range pending {
+		delivery := &reliableDelivery{}
+		if err := json.Unmarshal([]byte(data), delivery); err != nil || delivery.Message == nil {
+			log.Println("problem decoding pending delivery", err)
+			continue
+		}
+		if delivery.Channel != channel {
+			continue
+		}
+		sock.reliableLock.Lock()
+		_, already := sock.pending[delivery.Message.Id]
+		if !already {
+			delivery.Attempts = 1
+			delivery.due = now.Add(reliableBackoff(1))
+			sock.pending[delivery.Message.Id] = delivery
+		}
+		sock.reliableLock.Unlock()
+		if already {
+			continue
+		}
+		sock.session.Send(channelEventFrame(delivery.Channel, delivery.Message))
+		reliableRecoveredCounter.Inc(sock.metricsApp)
+	}
+}
+
+// track makes msg pending on the socket before it is first sent, it runs on
+// a fan-out worker so the store write is only queued
+func (sock *socket) track(channel string, msg *pubsub.Message) {
+	sock.reliableLock.Lock()
+	clientId := sock.clientIds[channel]
+	delivery := &reliableDelivery{
+		AppId:    sock.appId,
+		Channel:  channel,
+		ClientId: clientId,
+		Message:  msg,
+		Attempts: 1,
+		due:      time.Now().Add(reliableBackoff(1)),
+	}
+	sock.pending[msg.Id] = delivery
+	sock.reliableLock.Unlock()
+	if clientId == "" {
+		return
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println("unable to marshal pending delivery", err)
+		return
+	}
+	sock.server.queuePendingWrite(&PendingWrite{AppId: sock.appId, ClientId: clientId, Id: msg.Id, Data: string(data)})
+}
+
+// handleAck stops the delivery being sent again
+func (s *server) handleAck(sock *socket, id string) {
+	sock.reliableLock.Lock()
+	delivery, ok := sock.pending[id]
+	delete(sock.pending, id)
+	sock.reliableLock.Unlock()
+	if !ok {
+		log.Println("ack for a delivery that isnt pending", id)
+		return
+	}
+	if delivery.ClientId != "" {
+		s.queuePendingWrite(&PendingWrite{AppId: sock.appId, ClientId: delivery.ClientId, Id: id})
+	}
+}
+
+func (s *server) queuePendingWrite(write *PendingWrite) {
+	s.pendingLock.Lock()
+	s.pendingWrites = append(s.pendingWrites, write)
+	s.pendingLock.Unlock()
+}
+
+// flushPendingWrites writes what has queued up, in order, one flush at a time
+func (s *server) flushPendingWrites() {
+	s.pendingFlushLock.Lock()
+	defer s.pendingFlushLock.Unlock()
+	s.pendingLock.Lock()
+	writes := s.pendingWrites
+	s.pendingWrites = nil
+	s.pendingLock.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+	if err := s.store.WritePendingDeliveries(writes, RELIABLE_PENDING_TTL); err != nil {
+		log.Println("problem writing pending deliveries", err)
+	}
+}
+
+func (s *server) reliableLoop() {
+	ticker := time.NewTicker(RELIABLE_RETRY_INTERVAL)
+	expireTicker := time.NewTicker(RELIABLE_EXPIRE_INTERVAL)
+	for {
+		select {
+		case now := <-ticker.C:
+			s.flushPendingWrites()
+			s.lock.RLock()
+			sockets := make([]*socket, 0, len(s.sockets))
+			for _, sock := range s.sockets {
+				sockets = append(sockets, sock)
+			}
+			s.lock.RUnlock()
+			for _, sock := range sockets {
+				s.redeliver(sock, now)
+			}
+		case now := <-expireTicker.C:
+			s.expirePending(now)
+		}
+	}
+}
+
+// redeliver sends the sockets due deliveries again, or gives up on them. Each
+// is checked and bumped under the lock, so one acked meanwhile isnt put back.
+func (s *server) redeliver(sock *socket, now time.Time) {
+	var due, expired []*reliableDelivery
+	sock.reliableLock.Lock()
+	for id, delivery := range sock.pending {
+		if delivery.due.After(now) {
+			continue
+		}
+		if delivery.Attempts >= RELIABLE_MAX_ATTEMPTS {
+			delete(sock.pending, id)
+			expired = append(expired, delivery)
+			continue
+		}
+		delivery.Attempts++
+		delivery.due = now.Add(reliableBackoff(delivery.Attempts))
+		due = append(due, delivery)
+	}
+	sock.reliableLock.Unlock()
+	for _, delivery := range due {
+		sock.session.Send(channelEventFrame(delivery.Channel, delivery.Message))
+		reliableRedeliveredCounter.Inc(sock.metricsApp)
+	}
+	for _, delivery := range expired {
+		s.logUndelivered(sock.appId, delivery, UNDELIVERED_REASON_ATTEMPTS)
+		if delivery.ClientId != "" {
+			s.queuePendingWrite(&PendingWrite{AppId: sock.appId, ClientId: delivery.ClientId, Id: delivery.Message.Id})
+		}
+	}
+}
+
+// expirePending logs what clients that never came back left pending, only
+// the node that claims an expired client logs it
+func (s *server) expirePending(now time.Time) {
+	list, err := s.store.ExpirePendingDeliveries(now)
+	if err != nil {
+		log.Println("problem expiring pending deliveries", err)
+	}
+	for _, delivery := range decodeDeliveries(list) {
+		if delivery.Message == nil {
+			continue
+		}
+		s.logUndelivered(delivery.AppId, delivery, UNDELIVERED_REASON_EXPIRED)
+	}
+}
+
+// closeReliable gives up on what is pending without a client id to recover
+// it, the rest stays in the store
+func (s *server) closeReliable(sock *socket) {
+	sock.reliableLock.Lock()
+	pending := sock.pending
+	sock.pending = make(map[string]*reliableDelivery)
+	sock.reliableLock.Unlock()
+	for _, delivery := range pending {
+		if delivery.ClientId == "" {
+			s.logUndelivered(sock.appId, delivery, UNDELIVERED_REASON_DISCONNECTED)
+		}
+	}
+}
+
+func (s *server) logUndelivered(appId string, delivery *reliableDelivery, reason string) {
+	log.Println("giving up on delivery", delivery.Message.Id, reason)
+	reliableUndeliveredCounter.Inc(s.metricsApp(appId), reason)
+	delivery.Reason = reason
+	delivery.TimeMs = time.Now().UnixNano() / int64(time.Millisecond)
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println("unable to marshal undelivered message", err)
+		return
+	}
+	if err = s.store.LogUndelivered(appId, string(data), UNDELIVERED_LOG_SIZE); err != nil {
+		log.Println("problem logging undelivered message", err)
+	}
+}
+
+func decodeDeliveries(list []string) []*reliableDelivery {
+	deliveries := make([]*reliableDelivery, 0, len(list))
+	for _, data := range list {
+		delivery := &reliableDelivery{}
+		if err := json.Unmarshal([]byte(data), delivery); err != nil {
+			log.Println("error decoding delivery", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+func (s *server) listUndelivered(appId string) []*reliableDelivery {
+	list, err := s.store.Undelivered(appId)
+	if err != nil {
+		log.Println("error reading undelivered messages", err)
+	}
+	return decodeDeliveries(list)
+}
+
+func (s *server) listPendingDeliveries(appId string, clientId string) []*reliableDelivery {
+	pending, err := s.store.PendingDeliveries(appId, clientId)
+	if err != nil {
+		log.Println("error reading pending deliveries", err)
+	}
+	list := make([]string, 0, len(pending))
+	for _, data := range pending {
+		list = append(list, data)
+	}
+	return decodeDeliveries(list)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func newReliableSocket(s *server, channel string, clientId string) (*socket, *recordSession) {
+	session := &recordSession{}
+	sock := s.newSocket(session, "/app/app", TRANSPORT_WEBSOCKET)
+	s.pubsub.Subscribe(sock, channel)
+	s.subscribeReliable(sock, channel, clientId)
+	return sock, session
+}
+
+func publishReliable(t *testing.T, s *server, channel string) string {
+	body, err := s.publishEvent("app", &EventJSON{Name: "reboot", Data: `{}`, Channel: channel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, delivery := range s.listUndelivered("app") {
+		t.Fatalf("unexpected undelivered %+v", delivery)
+	}
+	return string(body)
+}
+
+func TestReliableAck(t *testing.T) {
+	s := newTestServer()
+	sock, session := newReliableSocket(s, "reliable-players", "player-1")
+	publishReliable(t, s, "reliable-players")
+	if len(session.frames) != 1 || len(sock.pending) != 1 {
+		t.Fatalf("expected one pending delivery got %d frames %d pending", len(session.frames), len(sock.pending))
+	}
+	var id string
+	for id = range sock.pending {
+	}
+	// the store write is queued off the fan-out
+	if pending := s.listPendingDeliveries("app", "player-1"); len(pending) != 0 {
+		t.Fatalf("expected nothing written until a flush got %+v", pending)
+	}
+	s.flushPendingWrites()
+	if pending := s.listPendingDeliveries("app", "player-1"); len(pending) != 1 || pending[0].Message.Id != id {
+		t.Fatalf("expected %s kept for the client got %+v", id, pending)
+	}
+
+	// not due yet, then due
+	s.redeliver(sock, time.Now())
+	s.redeliver(sock, time.Now().Add(RELIABLE_RETRY_BACKOFF))
+	if len(session.frames) != 2 || session.frames[1] != session.frames[0] {
+		t.Fatalf("expected the event sent again got %v", session.frames)
+	}
+
+	s.handleAck(sock, id)
+	s.redeliver(sock, time.Now().Add(time.Hour))
+	s.flushPendingWrites()
+	if len(session.frames) != 2 || len(sock.pending) != 0 || len(s.listPendingDeliveries("app", "player-1")) != 0 {
+		t.Errorf("expected nothing pending after the ack got %d frames", len(session.frames))
+	}
+}
+
+func TestReliableGivesUp(t *testing.T) {
+	s := newTestServer()
+	sock, session := newReliableSocket(s, "private-reliable-players", "player-1")
+	publishReliable(t, s, "private-reliable-players")
+	now := time.Now()
+	for i := 0; i < RELIABLE_MAX_ATTEMPTS; i++ {
+		now = now.Add(RELIABLE_RETRY_MAX_BACKOFF)
+		s.redeliver(sock, now)
+	}
+	s.flushPendingWrites()
+	if len(session.frames) != RELIABLE_MAX_ATTEMPTS {
+		t.Errorf("expected %d attempts got %d", RELIABLE_MAX_ATTEMPTS, len(session.frames))
+	}
+	undelivered := s.listUndelivered("app")
+	if len(undelivered) != 1 || undelivered[0].Reason != UNDELIVERED_REASON_ATTEMPTS || undelivered[0].ClientId != "player-1" {
+		t.Fatalf("expected it logged as undelivered got %+v", undelivered)
+	}
+	if len(sock.pending) != 0 || len(s.listPendingDeliveries("app", "player-1")) != 0 {
+		t.Errorf("expected nothing left pending")
+	}
+}
+
+func TestReliableRecover(t *testing.T) {
+	s := newTestServer()
+	sock, _ := newReliableSocket(s, "reliable-players", "player-1")
+	anon, _ := newReliableSocket(s, "reliable-players", "")
+	publishReliable(t, s, "reliable-players")
+	for _, closed := range []*socket{sock, anon} {
+		s.pubsub.UnsubscribeAll(closed)
+		s.closeReliable(closed)
+	}
+
+	// only the socket without a client id loses its delivery
+	undelivered := s.listUndelivered("app")
+	if len(undelivered) != 1 || undelivered[0].Reason != UNDELIVERED_REASON_DISCONNECTED {
+		t.Fatalf("expected one undelivered got %+v", undelivered)
+	}
+
+	// other channels dont get it
+	if _, session := newReliableSocket(s, "reliable-other", "player-1"); len(session.frames) != 0 {
+		t.Errorf("expected nothing for another channel got %v", session.frames)
+	}
+	back, session := newReliableSocket(s, "reliable-players", "player-1")
+	if len(session.frames) != 1 || len(back.pending) != 1 {
+		t.Fatalf("expected the pending event sent on resubscribe got %v", session.frames)
+	}
+}
+
+// an ack landing while a redelivery is being sent isnt undone by it
+func TestReliableAckDuringRedeliver(t *testing.T) {
+	s := newTestServer()
+	session := &ackingSession{}
+	sock := s.newSocket(session, "/app/app", TRANSPORT_WEBSOCKET)
+	s.pubsub.Subscribe(sock, "reliable-players")
+	s.subscribeReliable(sock, "reliable-players", "")
+	publishReliable(t, s, "reliable-players")
+	for id := range sock.pending {
+		session.ack = func() { s.handleAck(sock, id) }
+	}
+	now := time.Now()
+	for i := 0; i < RELIABLE_MAX_ATTEMPTS+1; i++ {
+		now = now.Add(RELIABLE_RETRY_MAX_BACKOFF)
+		s.redeliver(sock, now)
+	}
+	if session.sent != 2 || len(sock.pending) != 0 {
+		t.Errorf("expected one redelivery then nothing got %d sent %d pending", session.sent, len(sock.pending))
+	}
+	if undelivered := s.listUndelivered("app"); len(undelivered) != 0 {
+		t.Errorf("expected the acked event not to be given up on got %+v", undelivered)
+	}
+}
+
+// ackingSession acks each redelivery as it is sent
+type ackingSession struct {
+	recordSession
+	sent int
+	ack  func()
+}
+
+func (as *ackingSession) Send(frame string) error {
+	as.sent++
+	if as.ack != nil {
+		as.ack()
+	}
+	return nil
+}
+
+func TestReliableExpires(t *testing.T) {
+	s := newTestServer()
+	sock, _ := newReliableSocket(s, "reliable-players", "player-1")
+	publishReliable(t, s, "reliable-players")
+	s.pubsub.UnsubscribeAll(sock)
+	s.closeReliable(sock)
+	s.flushPendingWrites()
+
+	// the client never comes back
+	s.expirePending(time.Now())
+	if undelivered := s.listUndelivered("app"); len(undelivered) != 0 {
+		t.Fatalf("expected nothing expired yet got %+v", undelivered)
+	}
+	s.expirePending(time.Now().Add(RELIABLE_PENDING_TTL + time.Second))
+	undelivered := s.listUndelivered("app")
+	if len(undelivered) != 1 || undelivered[0].Reason != UNDELIVERED_REASON_EXPIRED || undelivered[0].ClientId != "player-1" {
+		t.Fatalf("expected it logged as expired got %+v", undelivered)
+	}
+	if pending := s.listPendingDeliveries("app", "player-1"); len(pending) != 0 {
+		t.Errorf("expected nothing left pending got %+v", pending)
+	}
+}
+
+func TestIsReliableChannel(t *testing.T) {
+	for channel, reliable := range map[string]bool{
+		"reliable-players":         true,
+		"private-reliable-players": true,
+		"players":                  false,
+		"presence-reliable-x":      false,
+	} {
+		if isReliableChannel(channel) != reliable {
+			t.Errorf("expected %s reliable %v", channel, reliable)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package server
 
 import (
+	"crypto/hmac"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/screencloud/subhub/pubsub"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,39 +20,8 @@ func newAuthMiddleware(s *server) gin.HandlerFunc {
 		// Set example variable
 		c.Set("example", "12345")
 
-		q := c.Request.URL.Query()
-		// before request
-
-		//Authentication
-		//The following query parameters must be included with all requests, and are used to authenticate the request
-
-		//auth_key	Your application key
-		key := q["auth_key"][0]
-		//auth_timestamp	The number of seconds since January 1, 1970 00:00:00 GMT. The server will only accept requests where the timestamp is within 600s of the current time
-		timestamp := q["auth_timestamp"][0]
-		//auth_version	Authentication version, currently 1.0
-		version := q["auth_version"][0]
-		//body_md5	If the request body is nonempty (for example for POST requests to `/events`), this parameter must contain the hexadecimal MD5 hash of the body
-		bodyMD5 := q["body_md5"][0]
-		//Once all the above parameters have been added to the request, a signature is calculated
-
-		//auth_signature	Authentication signature, described below
-		signature := q["auth_signature"][0]
-
-		// POST\n/apps/3/events\nauth_key=278d425bdf160c739803&auth_timestamp=1353088179&auth_version=1.0&body_md5=ec365a775a4cd0599faeb73354201b6f
-
-		input := fmt.Sprintf("%s\n%s\nauth_key=%s&auth_timestamp=%s&auth_version=%s&body_md5=%s", c.Request.Method, c.Request.URL.Path, key, timestamp, version, bodyMD5)
-
-		secret, _ := s.lookupAuthSecret(key)
-
-		valid := signature == hmacSha256HexSignature([]byte(input), []byte(secret))
-
-		// todo: check md5 is actually correct
-
-		// validate the signature..
-		// valid := false
-
-		if !valid {
+		if !s.restAuthorized(c.Request, c.Params.ByName("app_id")) {
+			authFailuresCounter.Inc("rest")
 			// is this the right status?
 			c.Fail(401, errors.New("Invalid signature"))
 		} else {
@@ -66,12 +38,57 @@ func newAuthMiddleware(s *server) gin.HandlerFunc {
 	}
 }
 
+// the query parameters every request must be signed with, body_md5 is only
+// needed with a body
+var restAuthParams = []string{"auth_key", "auth_timestamp", "auth_version", "auth_signature"}
+
+// restAuthorized checks the requests signature. Under /apps/:app_id the key
+// must belong to the app, elsewhere, like /stats, any known key will do.
+func (s *server) restAuthorized(r *http.Request, appId string) bool {
+	//Authentication
+	//The following query parameters must be included with all requests, and are used to authenticate the request
+	q := r.URL.Query()
+	for _, param := range restAuthParams {
+		if q.Get(param) == "" {
+			log.Println("rest request missing", param)
+			return false
+		}
+	}
+	//auth_key	Your application key
+	key := q.Get("auth_key")
+	var secret string
+	if appId != "" {
+		appSecret, ok := s.appAuthSecret(appId, key)
+		if !ok {
+			return false
+		}
+		secret = appSecret
+	} else {
+		keySecret, err := s.lookupAuthSecret(key)
+		if err != nil || keySecret == "" {
+			log.Println("unknown auth key", key, err)
+			return false
+		}
+		secret = keySecret
+	}
+
+	// POST\n/apps/3/events\nauth_key=278d425bdf160c739803&auth_timestamp=1353088179&auth_version=1.0&body_md5=ec365a775a4cd0599faeb73354201b6f
+	input := fmt.Sprintf("%s\n%s\nauth_key=%s&auth_timestamp=%s&auth_version=%s&body_md5=%s", r.Method, r.URL.Path,
+		key, q.Get("auth_timestamp"), q.Get("auth_version"), q.Get("body_md5"))
+
+	// todo: check md5 is actually correct and the timestamp is within 600s
+	signature := hmacSha256HexSignature([]byte(input), []byte(secret))
+	return hmac.Equal([]byte(q.Get("auth_signature")), []byte(signature))
+}
+
 type EventJSON struct {
 	Name     string   `json:"name" binding:"required"`
 	Data     string   `json:"data" binding:"required"` // limited to 10KB
 	Channels []string `json:"channels"`                // limited to 10 channels
 	Channel  string   `json:"channel"`                 //  (can be used instead of channels)
 	SocketId string   `json:"socket_id"`               // excludes the event from being sent to a specific connection
+	// a retried request with the same key isnt published again, see rest_events.go
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 func (s *server) newRestApiHandler() http.Handler {
@@ -85,13 +102,41 @@ func (s *server) newRestApiHandler() http.Handler {
 		// The event data should not be larger than 10KB.
 		// If you attempt to POST an event with a larger data parameter you will receive a 413 error code.
 
+		appId := c.Params.ByName("app_id")
 		var json EventJSON
-		c.Bind(&json)
-
-		// TODO: process
+		if !c.Bind(&json) {
+			return
+		}
+		if status, err := json.validate(); err != nil {
+			c.Fail(status, err)
+			return
+		}
 
-		// Response is an empty JSON hash.
-		c.JSON(200, gin.H{})
+		key := c.Request.Header.Get(REST_IDEMPOTENCY_HEADER)
+		if key == "" {
+			key = json.IdempotencyKey
+		}
+		if key == "" {
+			body, err := s.publishEvent(appId, &json)
+			if err != nil {
+				c.Fail(500, err)
+				return
+			}
+			c.Data(eventStatus(body), "application/json", body)
+			return
+		}
+		body, replayed, err := s.publishIdempotentEvent(appId, key, &json)
+		if err == errIdempotencyInProgress {
+			c.Fail(409, err)
+			return
+		} else if err != nil {
+			c.Fail(500, err)
+			return
+		}
+		if replayed {
+			c.Writer.Header().Set(REST_REPLAYED_HEADER, "true")
+		}
+		c.Data(eventStatus(body), "application/json", body)
 	})
 
 	r.GET("/apps/:app_id/channels", func(c *gin.Context) {
@@ -157,6 +202,211 @@ func (s *server) newRestApiHandler() http.Handler {
 
 	})
 
+	r.GET("/apps/:app_id/webhooks", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		c.JSON(200, gin.H{"webhooks": s.listWebhooks(appId)})
+	})
+
+	r.POST("/apps/:app_id/webhooks", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+
+		var json WebhookJSON
+		if !c.Bind(&json) {
+			return
+		}
+		if json.Event != "" && !isWebhookEvent(json.Event) {
+			c.Fail(400, errors.New("Unknown webhook event"))
+			return
+		}
+
+		// payloads are signed with the key used to create the webhook
+		key := c.Request.URL.Query().Get("auth_key")
+		hook := s.createWebhook(appId, json.Url, json.Event, key)
+		if hook == nil {
+			c.Fail(500, errors.New("Unable to create webhook"))
+			return
+		}
+		c.JSON(201, hook)
+	})
+
+	r.PUT("/apps/:app_id/webhooks/:webhook_id/enable", func(c *gin.Context) {
+		if hook := s.appWebhook(c); hook != nil {
+			c.JSON(200, s.enableWebhook(hook.Id))
+		}
+	})
+
+	r.PUT("/apps/:app_id/webhooks/:webhook_id/disable", func(c *gin.Context) {
+		if hook := s.appWebhook(c); hook != nil {
+			c.JSON(200, s.disableWebhook(hook.Id))
+		}
+	})
+
+	r.DELETE("/apps/:app_id/webhooks/:webhook_id", func(c *gin.Context) {
+		if hook := s.appWebhook(c); hook != nil {
+			s.deleteWebhook(hook.Id)
+			c.JSON(200, gin.H{})
+		}
+	})
+
+	r.GET("/apps/:app_id/webhooks/deliveries", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		c.JSON(200, gin.H{"deliveries": s.listWebhookAttempts(appId)})
+	})
+
+	// the last WEBHOOK_FAILED_SIZE deliveries given up on, oldest first
+	r.GET("/apps/:app_id/webhooks/failed", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		c.JSON(200, gin.H{"failed": s.listFailedWebhooks(appId)})
+	})
+
+	r.POST("/apps/:app_id/webhooks/failed/redeliver", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+
+		// no ids means redeliver everything
+		var json RedeliverJSON
+		if c.Request.ContentLength > 0 && !c.Bind(&json) {
+			return
+		}
+		c.JSON(200, gin.H{"redelivered": s.redeliverWebhooks(appId, json.Ids)})
+	})
+
+	r.GET("/apps/:app_id/undelivered", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		c.JSON(200, gin.H{"undelivered": s.listUndelivered(appId)})
+	})
+
+	r.GET("/apps/:app_id/clients/:client_id/pending", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		clientId := c.Params.ByName("client_id")
+		c.JSON(200, gin.H{"pending": s.listPendingDeliveries(appId, clientId)})
+	})
+
+	r.GET("/apps/:app_id/users/:user_id/inbox", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		userId := c.Params.ByName("user_id")
+		c.JSON(200, gin.H{"inbox": s.listInbox(appId, userId)})
+	})
+
+	r.DELETE("/apps/:app_id/users/:user_id/inbox", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		userId := c.Params.ByName("user_id")
+		c.JSON(200, gin.H{"purged": s.purgeInbox(appId, userId)})
+	})
+
+	r.GET("/apps/:app_id/stats", func(c *gin.Context) {
+		appId := c.Params.ByName("app_id")
+		scope := fmt.Sprintf(STATS_SCOPE_APP, appId)
+		res, from, to, err := statsQuery(c)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		buckets, err := s.stats.buckets(scope, res, from, to)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		var connections int64 = 0
+		for _, n := range s.stats.nodeConnections(appId) {
+			connections += n
+		}
+		c.JSON(200, gin.H{"resolution": res.Name, "connections": connections, "stats": buckets})
+	})
+
+	// cluster wide rollup for operators
+	r.GET("/stats", func(c *gin.Context) {
+		res, from, to, err := statsQuery(c)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		buckets, err := s.stats.buckets(STATS_SCOPE_SYSTEM, res, from, to)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		nodes := s.stats.nodeConnections(STATS_CONNECTIONS_TOTAL_FIELD)
+		var connections int64 = 0
+		for _, n := range nodes {
+			connections += n
+		}
+		resp := gin.H{"resolution": res.Name, "connections": connections, "nodes": nodes, "stats": buckets,
+			"slow_channels": pubsub.SlowChannels()}
+		if s.redis != nil {
+			resp["redis_pools"] = s.redis.Stats()
+		}
+		c.JSON(200, resp)
+	})
+
+	// one nodes share of the rollup, its buckets go once they are too old
+	// so a node that has gone can still be looked at for a while
+	r.GET("/stats/nodes/:node_id", func(c *gin.Context) {
+		nodeId := c.Params.ByName("node_id")
+		res, from, to, err := statsQuery(c)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		buckets, err := s.stats.buckets(fmt.Sprintf(STATS_SCOPE_NODE, nodeId), res, from, to)
+		if err != nil {
+			c.Fail(400, err)
+			return
+		}
+		connections := s.stats.nodeConnections(STATS_CONNECTIONS_TOTAL_FIELD)[nodeId]
+		c.JSON(200, gin.H{"resolution": res.Name, "connections": connections, "stats": buckets})
+	})
+
 	return r
 
 }
+
+// statsQuery reads ?from=&to=&resolution= with from and to in unix seconds,
+// by default the last hour by minute
+func statsQuery(c *gin.Context) (*statsResolution, time.Time, time.Time, error) {
+	q := c.Request.URL.Query()
+	name := q.Get("resolution")
+	if name == "" {
+		name = "minute"
+	}
+	res := lookupStatsResolution(name)
+	if res == nil {
+		return nil, time.Time{}, time.Time{}, errors.New("Unknown resolution")
+	}
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, time.Time{}, time.Time{}, errors.New("Invalid to")
+		}
+		to = time.Unix(secs, 0)
+	}
+	from := to.Add(-time.Hour)
+	if v := q.Get("from"); v != "" {
+		secs, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, time.Time{}, time.Time{}, errors.New("Invalid from")
+		}
+		from = time.Unix(secs, 0)
+	}
+	return res, from, to, nil
+}
+
+type RedeliverJSON struct {
+	Ids []string `json:"ids"` // delivery ids to redeliver, empty for all
+}
+
+type WebhookJSON struct {
+	Url   string `json:"url" binding:"required"`
+	Event string `json:"event"` // one of the webhook events, or empty for all
+}
+
+// appWebhook loads the webhook named in the path, failing with a 404
+// if it doesnt exist or belongs to another app
+func (s *server) appWebhook(c *gin.Context) *Webhook {
+	hook := s.loadWebhook(c.Params.ByName("webhook_id"))
+	if hook == nil || hook.AppId != c.Params.ByName("app_id") {
+		c.Fail(404, errors.New("Webhook not found"))
+		return nil
+	}
+	return hook
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"log"
+	"time"
+)
+
+// Events published through the rest api can carry an idempotency key, in the
+// Idempotency-Key header or the idempotency_key field, so a retried request
+// isnt published twice. The first request claims the key with SET NX and
+// stores its result against it once published, repeats within the window get
+// that result back without publishing. Until then the key only lasts
+// REST_IDEMPOTENCY_PENDING_TTL, so a node that dies mid request doesnt hold it
+// for the whole window. The key is released if nothing was published so a
+// retry can go through. If only some channels failed the result lists them
+// and is kept like any other, so a retry gets it back rather than publishing
+// the channels that went out again.
+// Keys are per app and shared by every node.
+
+const REDIS_IDEMPOTENCY_KEY = "subhub://app/%s/idempotency/%s"
+
+const (
+	REST_IDEMPOTENCY_HEADER      = "Idempotency-Key"
+	REST_IDEMPOTENCY_WINDOW      = 24 * time.Hour
+	REST_IDEMPOTENCY_PENDING     = "pending" // claimed, no result yet
+	REST_IDEMPOTENCY_PENDING_TTL = 30 * time.Second
+	REST_REPLAYED_HEADER         = "Idempotent-Replayed"
+
+	REST_MAX_EVENT_DATA     = 10 * 1024
+	REST_MAX_EVENT_CHANNELS = 10
+)
+
+var (
+	errEventChannels         = errors.New("Between 1 and 10 channels are required")
+	errEventTooLarge         = errors.New("Event data is limited to 10KB")
+	errIdempotencyInProgress = errors.New("A request with this idempotency key is in progress")
+)
+
+func idempotencyKey(appId string, key string) string {
+	return fmt.Sprintf(REDIS_IDEMPOTENCY_KEY, appId, key)
+}
+
+// eventPublisher is the socket an event is excluded from, see socket_id
+type eventPublisher string
+
+func (p eventPublisher) ID() string { return string(p) }
+
+type EventResult struct {
+	EventIds map[string]string `json:"event_ids"`        // channel to message id
+	Failed   map[string]string `json:"failed,omitempty"` // channel to error
+}
+
+// eventStatus is 207 for a result where some channels failed
+func eventStatus(body []byte) int {
+	result := &EventResult{}
+	if err := json.Unmarshal(body, result); err == nil && len(result.Failed) > 0 {
+		return 207
+	}
+	return 200
+}
+
+func (event *EventJSON) channels() []string {
+	channels := event.Channels
+	if event.Channel != "" {
+		channels = append(channels, event.Channel)
+	}
+	return channels
+}
+
+func (event *EventJSON) validate() (int, error) {
+	if n := len(event.channels()); n == 0 || n > REST_MAX_EVENT_CHANNELS {
+		return 400, errEventChannels
+	}
+	if len(event.Data) > REST_MAX_EVENT_DATA {
+		return 413, errEventTooLarge
+	}
+	return 0, nil
+}
+
+// claimIdempotencyKey returns true if this request gets to publish, otherwise
+// the stored result of the request that did, or REST_IDEMPOTENCY_PENDING
+func (s *server) claimIdempotencyKey(appId string, key string) (bool, string, error) {
+	claimed, existing, err := s.store.ClaimIdempotencyKey(appId, key, REST_IDEMPOTENCY_PENDING, REST_IDEMPOTENCY_PENDING_TTL)
+	if err != nil {
+		log.Println("problem claiming idempotency key", err)
+		return false, "", err
+	}
+	if !claimed && existing == "" {
+		// it expired between the claim and the read, treat it as taken
+		existing = REST_IDEMPOTENCY_PENDING
+	}
+	return claimed, existing, nil
+}
+
+// publishEvent publishes to each channel and returns the response body, a
+// channel that fails is listed in it and the rest are still published. It only
+// errors when the event reached nobody.
+func (s *server) publishEvent(appId string, event *EventJSON) ([]byte, error) {
+	var pub pubsub.Publisher
+	if event.SocketId != "" {
+		pub = eventPublisher(event.SocketId)
+	}
+	result := &EventResult{EventIds: make(map[string]string), Failed: make(map[string]string)}
+	sent := false
+	var publishErr error
+	for _, channel := range event.channels() {
+		msg := &pubsub.Message{
+			Name:  event.Name,
+			Data:  event.Data,
+			AppId: appId,
+		}
+		var num int64
+		var err error
+		if isUserChannel(channel) {
+			num, err = s.pubsub.Publish(pub, userChannelTopic(appId, channel), msg)
+		} else {
+			num, err = s.publishSequenced(pub, channel, msg)
+		}
+		if err != nil {
+			log.Println("problem publishing event", channel, err)
+			result.Failed[channel] = err.Error()
+			publishErr = err
+			// with redis gone it still reached the sockets on this node
+			if err == pubsub.ErrDisconnected && num > 0 {
+				sent = true
+			}
+			continue
+		}
+		sent = true
+		if num == 0 && isUserChannel(channel) {
+			s.keepForOfflineUser(appId, channel, msg)
+		}
+		result.EventIds[channel] = msg.Id
+		s.stats.message(appId)
+		publishedCounter.Inc(s.metricsApp(appId))
+	}
+	if !sent {
+		return nil, publishErr
+	}
+	return json.Marshal(result)
+}
+
+// publishSequenced publishes msg with the next seq on channel, holding the
+// channels seq lock so this nodes events go out in seq order
+func (s *server) publishSequenced(pub pubsub.Publisher, channel string, msg *pubsub.Message) (int64, error) {
+	lock := s.seqLock(channel)
+	lock.Lock()
+	defer lock.Unlock()
+	s.sequence(channel, msg)
+	return s.pubsub.Publish(pub, channel, msg)
+}
+
+// publishIdempotentEvent publishes the event once per key, replayed is true
+// when the body is the result of an earlier request
+func (s *server) publishIdempotentEvent(appId string, key string, event *EventJSON) (body []byte, replayed bool, err error) {
+	claimed, existing, err := s.claimIdempotencyKey(appId, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !claimed {
+		if existing == REST_IDEMPOTENCY_PENDING {
+			return nil, false, errIdempotencyInProgress
+		}
+		return []byte(existing), true, nil
+	}
+	body, err = s.publishEvent(appId, event)
+	if err != nil {
+		// nothing went out so a retry is safe
+		if releaseErr := s.store.ReleaseIdempotencyKey(appId, key); releaseErr != nil {
+			log.Println("problem releasing idempotency key", releaseErr)
+		}
+		return nil, false, err
+	}
+	if err := s.store.SaveIdempotentResult(appId, key, string(body), REST_IDEMPOTENCY_WINDOW); err != nil {
+		// published, a retry is told its in progress until the pending key expires
+		// and can publish again after
+		log.Println("problem saving idempotent result", err)
+	}
+	return body, false, nil
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/screencloud/subhub/pubsub"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingPubSub fails publishes to the channels in fail, with redis gone they
+// still reach local subscribers
+type failingPubSub struct {
+	pubsub.PubSub
+	fail map[string]error
+}
+
+func (fp *failingPubSub) Publish(pub pubsub.Publisher, channel string, msg *pubsub.Message) (int64, error) {
+	err, ok := fp.fail[channel]
+	if !ok {
+		return fp.PubSub.Publish(pub, channel, msg)
+	}
+	if err == pubsub.ErrDisconnected {
+		num, _ := fp.PubSub.Publish(pub, channel, msg)
+		return num, err
+	}
+	return 0, err
+}
+
+func TestEventValidate(t *testing.T) {
+	many := make([]string, REST_MAX_EVENT_CHANNELS+1)
+	for _, test := range []struct {
+		event  EventJSON
+		status int
+	}{
+		{EventJSON{Name: "e", Data: "{}", Channel: "a"}, 0},
+		{EventJSON{Name: "e", Data: "{}", Channels: []string{"a", "b"}}, 0},
+		{EventJSON{Name: "e", Data: "{}"}, 400},
+		{EventJSON{Name: "e", Data: "{}", Channels: many}, 400},
+		{EventJSON{Name: "e", Data: strings.Repeat("a", REST_MAX_EVENT_DATA+1), Channel: "a"}, 413},
+	} {
+		if status, _ := test.event.validate(); status != test.status {
+			t.Errorf("expected %d got %d for %+v", test.status, status, test.event.Channels)
+		}
+	}
+}
+
+func TestPublishIdempotentEvent(t *testing.T) {
+	s := newTestServer()
+	sessions := subscribeSockets(s, "screens", 1)
+	event := &EventJSON{Name: "update", Data: `{"a":1}`, Channel: "screens"}
+
+	body, replayed, err := s.publishIdempotentEvent("app", "retry-1", event)
+	if err != nil || replayed {
+		t.Fatalf("unexpected first publish %v %v", replayed, err)
+	}
+	result := &EventResult{}
+	if err := json.Unmarshal(body, result); err != nil || result.EventIds["screens"] == "" {
+		t.Fatalf("expected an event id got %s", body)
+	}
+
+	// the retry gets the same answer and isnt published
+	again, replayed, err := s.publishIdempotentEvent("app", "retry-1", event)
+	if err != nil || !replayed || string(again) != string(body) {
+		t.Errorf("expected %s replayed got %s %v %v", body, again, replayed, err)
+	}
+	if sessions[0].sent != 1 {
+		t.Errorf("expected the event once got %d", sessions[0].sent)
+	}
+
+	// keys are per app
+	if _, replayed, _ := s.publishIdempotentEvent("other", "retry-1", event); replayed {
+		t.Errorf("expected another apps key not to clash")
+	}
+
+	// a request still publishing
+	s.store.ClaimIdempotencyKey("app", "busy", REST_IDEMPOTENCY_PENDING, REST_IDEMPOTENCY_WINDOW)
+	if _, _, err := s.publishIdempotentEvent("app", "busy", event); err != errIdempotencyInProgress {
+		t.Errorf("expected in progress got %v", err)
+	}
+}
+
+func TestPublishIdempotentEventPartial(t *testing.T) {
+	s := newTestServer()
+	fp := &failingPubSub{PubSub: s.pubsub, fail: map[string]error{"bad": errors.New("boom")}}
+	s.pubsub = fp
+	sessions := subscribeSockets(s, "screens", 1)
+	event := &EventJSON{Name: "update", Data: `{"a":1}`, Channels: []string{"screens", "bad"}}
+
+	body, _, err := s.publishIdempotentEvent("app", "partial", event)
+	if err != nil || eventStatus(body) != 207 {
+		t.Fatalf("expected a partial result got %s %v", body, err)
+	}
+	result := &EventResult{}
+	json.Unmarshal(body, result)
+	if result.EventIds["screens"] == "" || result.Failed["bad"] != "boom" {
+		t.Errorf("expected screens published and bad failed got %s", body)
+	}
+	// the key is kept so screens isnt published again
+	again, replayed, err := s.publishIdempotentEvent("app", "partial", event)
+	if err != nil || !replayed || string(again) != string(body) || sessions[0].sent != 1 {
+		t.Errorf("expected the partial result replayed got %s %v %v and %d sent", again, replayed, err, sessions[0].sent)
+	}
+
+	// with redis gone it still reached this node
+	fp.fail["screens"] = pubsub.ErrDisconnected
+	event = &EventJSON{Name: "update", Data: `{"a":2}`, Channel: "screens"}
+	if body, _, err := s.publishIdempotentEvent("app", "local", event); err != nil || eventStatus(body) != 207 {
+		t.Errorf("expected a partial result got %s %v", body, err)
+	}
+	if _, replayed, _ := s.publishIdempotentEvent("app", "local", event); !replayed || sessions[0].sent != 2 {
+		t.Errorf("expected the local delivery not to be repeated, %d sent", sessions[0].sent)
+	}
+
+	// nothing went out, so the key is released for a retry
+	event = &EventJSON{Name: "update", Data: `{}`, Channel: "bad"}
+	if _, _, err := s.publishIdempotentEvent("app", "failed", event); err == nil {
+		t.Fatalf("expected an error")
+	}
+	delete(fp.fail, "bad")
+	if body, replayed, err := s.publishIdempotentEvent("app", "failed", event); err != nil || replayed || eventStatus(body) != 200 {
+		t.Errorf("expected the retry published got %s %v %v", body, replayed, err)
+	}
+}
+
+func TestIdempotencyPendingExpires(t *testing.T) {
+	s := newTestServer()
+	ms := s.store.(*memoryStore)
+	// a node that claimed the key and died holds it briefly
+	if claimed, _, _ := s.claimIdempotencyKey("app", "crashed"); !claimed {
+		t.Fatal("expected the key claimed")
+	}
+	pending := ms.idempotencyKeys[idempotencyKey("app", "crashed")]
+	if pending.expires.After(time.Now().Add(REST_IDEMPOTENCY_PENDING_TTL)) {
+		t.Errorf("expected the claim to last %v got %v", REST_IDEMPOTENCY_PENDING_TTL, pending.expires)
+	}
+	pending.expires = time.Now().Add(-time.Second)
+	event := &EventJSON{Name: "update", Data: `{}`, Channel: "screens"}
+	if _, replayed, err := s.publishIdempotentEvent("app", "crashed", event); err != nil || replayed {
+		t.Errorf("expected the expired claim to be taken over got %v %v", replayed, err)
+	}
+	// the result is kept for the whole window
+	if saved := ms.idempotencyKeys[idempotencyKey("app", "crashed")]; saved.expires.Before(time.Now().Add(REST_IDEMPOTENCY_WINDOW - time.Minute)) {
+		t.Errorf("expected the result kept for %v got %v", REST_IDEMPOTENCY_WINDOW, saved.expires)
+	}
+}
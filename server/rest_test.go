@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// signedRequest signs a GET to path with key and secret
+func signedRequest(path string, key string, secret string) *http.Request {
+	input := fmt.Sprintf("GET\n%s\nauth_key=%s&auth_timestamp=1353088179&auth_version=1.0&body_md5=", path, key)
+	q := url.Values{}
+	q.Set("auth_key", key)
+	q.Set("auth_timestamp", "1353088179")
+	q.Set("auth_version", "1.0")
+	q.Set("auth_signature", hmacSha256HexSignature([]byte(input), []byte(secret)))
+	return httptest.NewRequest("GET", path+"?"+q.Encode(), nil)
+}
+
+func TestRestAuthorized(t *testing.T) {
+	s := newTestServer()
+	saveKey(s, "a", "key-a", "secret-a")
+	saveKey(s, "b", "key-b", "secret-b")
+
+	missing := httptest.NewRequest("GET", "/apps/a/channels?auth_key=key-a", nil)
+	tests := []struct {
+		name  string
+		req   *http.Request
+		appId string
+		valid bool
+	}{
+		{"signed", signedRequest("/apps/a/channels", "key-a", "secret-a"), "a", true},
+		{"missing params", missing, "a", false},
+		{"wrong secret", signedRequest("/apps/a/channels", "key-a", "secret-b"), "a", false},
+		{"unknown key", signedRequest("/apps/a/channels", "key-x", ""), "a", false},
+		{"other apps key", signedRequest("/apps/a/channels", "key-b", "secret-b"), "a", false},
+		{"stats", signedRequest("/stats", "key-b", "secret-b"), "", true},
+		{"stats unknown key", signedRequest("/stats", "key-x", ""), "", false},
+	}
+	for _, test := range tests {
+		if valid := s.restAuthorized(test.req, test.appId); valid != test.valid {
+			t.Errorf("%s: expected %v got %v", test.name, test.valid, valid)
+		}
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/igm/sockjs-go/sockjs"
+	"github.com/screencloud/subhub/metrics"
 	"github.com/screencloud/subhub/pubsub"
 	"github.com/screencloud/subhub/pusher"
 	"github.com/screencloud/subhub/uuid"
 	"github.com/screencloud/subhub/xredis"
-	"github.com/xuyu/goredis"
 	"log"
 	"net/http"
 	"strings"
@@ -23,11 +23,35 @@ type server struct {
 
 	pubsub pubsub.PubSub
 
+	// shared state, see Store
+	store Store
+	// nil with the memory store, object and keyspace channels need it
 	redis *xredis.Redis
 	//redisMaster *goredis.Redis // used for write
 	//redisSlave  *goredis.Redis // used for reads
+	// keyspace notification channel prefix for the database we use
+	keyspacePrefix string
 
-	// todo: maintain list / map of sockets
+	// connected sockets by id
+	sockets map[string]*socket
+
+	// webhook events waiting to be sent, per app
+	webhookLock  sync.Mutex
+	webhookBatch map[string][]*WebhookEvent
+
+	// pending delivery writes waiting to go to the store, see reliable.go
+	pendingLock      sync.Mutex
+	pendingFlushLock sync.Mutex
+	pendingWrites    []*PendingWrite
+
+	// apps known to be in the store, see metricsApp
+	metricsAppLock sync.Mutex
+	metricsApps    map[string]bool
+
+	// held from sequence to publish, see seqLock
+	seqLocks [CHANNEL_SEQ_LOCKS]sync.Mutex
+
+	stats *stats
 }
 
 type Event struct {
@@ -45,6 +69,16 @@ type Options struct {
 	RedisSlaveAddress  string         `json:"redis_slave"`
 	WebSocketAddress   string         `json:"websocket_address"`
 	Debug              bool           `json:"debug"`
+
+	// when set master and slave are found through sentinel instead
+	RedisSentinelAddresses []string `json:"redis_sentinels"`
+	RedisSentinelMaster    string   `json:"redis_sentinel_master"`
+
+	// pool size and timeouts for master and slave, the address is ignored
+	RedisPool xredis.PoolConfig `json:"redis_pool"`
+
+	// where shared state is kept, STORE_REDIS (default) or STORE_MEMORY
+	Store string `json:"store"`
 }
 
 var DefaultRedisAddress = "127.0.0.1:6379"
@@ -53,28 +87,46 @@ var DefaultOptions = Options{
 	RedisMasterAddress: DefaultRedisAddress,
 	RedisSlaveAddress:  DefaultRedisAddress,
 	WebSocketAddress:   "0.0.0.0:8080",
+	RedisPool:          xredis.DefaultPoolConfig,
+	Store:              STORE_REDIS,
 }
 
 func New(opts *Options) *server {
 	s := &server{
 		opts: opts,
 		// sockets: make(map[string]*socket),
-		pubsub: pubsub.New(&opts.PubSub),
+		pubsub:       pubsub.New(&opts.PubSub),
+		sockets:      make(map[string]*socket),
+		webhookBatch: make(map[string][]*WebhookEvent),
 	}
+	s.registerMetrics()
 	return s
 }
 
 func (s *server) Start() error {
 	var err error = nil
-	err = s.connectRedis()
-	if err != nil {
-		return err
+	if s.opts.Store == STORE_MEMORY {
+		log.Println("server using memory store, state stays on this node")
+		s.store = newMemoryStore()
+	} else {
+		err = s.connectRedis()
+		if err != nil {
+			return err
+		}
+		s.store = newRedisStore(s.redis)
 	}
+	s.stats = newStats(s.store, s.opts.PubSub.PubSubNodeId)
+	go s.stats.flushLoop()
+	s.pubsub.HandleOccupancy(s.handleOccupancy)
+	s.pubsub.SetFrameEncoder(s.encodeFrame)
+	s.pubsub.HandleDrops(s.handleDrop)
 	err = s.pubsub.Start()
 	if err != nil {
 		return err
 	}
 	s.testApp()
+	go s.webhookLoop()
+	go s.reliableLoop()
 	err = s.bind()
 
 	return err
@@ -84,30 +136,62 @@ func (s *server) connectRedis() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	log.Println("server connect redis")
-	redis, err := xredis.Connect(&goredis.DialConfig{
-		Address: s.opts.RedisMasterAddress}, &goredis.DialConfig{
-		Address: s.opts.RedisSlaveAddress})
+	// addresses can be urls with a password, database and tls
+	masterConfig, slaveConfig := s.opts.RedisPool, s.opts.RedisPool
+	if err := masterConfig.ApplyURL(s.opts.RedisMasterAddress); err != nil {
+		log.Println("Invalid redis master address", err)
+		return err
+	}
+	if err := slaveConfig.ApplyURL(s.opts.RedisSlaveAddress); err != nil {
+		log.Println("Invalid redis slave address", err)
+		return err
+	}
+	var redis *xredis.Redis
+	var err error
+	if len(s.opts.RedisSentinelAddresses) > 0 {
+		// with sentinel the master address only supplies the password, database and tls
+		sentinel := xredis.NewSentinel(s.opts.RedisSentinelAddresses, s.opts.RedisSentinelMaster)
+		redis, err = xredis.ConnectSentinel(sentinel, &masterConfig)
+	} else {
+		redis, err = xredis.Connect(&masterConfig, &slaveConfig)
+	}
 	if err != nil {
-		log.Fatal("Unable to connect to redis master", err)
+		log.Println("Unable to connect to redis", err)
 		return err
 	}
 	s.redis = redis
+	s.keyspacePrefix = xredis.KeyspacePrefix(masterConfig.Database)
+	// not fatal, the scripts are sent with EVAL if they are missing
+	if err := redis.ScriptLoad(presenseJoinScript, presenseLeaveScript); err != nil {
+		log.Println("Unable to load presence scripts", err)
+	}
 	return nil
 }
 
 func (s *server) bind() error {
+	return http.ListenAndServe(s.opts.WebSocketAddress, s.newMux())
+}
+
+func (s *server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
 	// primary transport is websockets, pusher uses its own websocket endpoint
 	// what ive done is hack the sock js code a little so it has similar interface
 	// this can certainly be improved, but for now it works ok
-	http.Handle("/app/", pusher.NewHandler("/app", sockjs.DefaultOptions, s.newPusherWSHandlerFunc()))
+	mux.Handle("/app/", pusher.NewHandler("/app", sockjs.DefaultOptions, s.newPusherWSHandlerFunc()))
 	// fallback transports to sockjs, this does xhr-streaming, polling, iframes, etc
-	http.Handle("/pusher/", sockjs.NewHandler("/pusher", sockjs.DefaultOptions, s.newSockJSHandlerFunc()))
+	mux.Handle("/pusher/", sockjs.NewHandler("/pusher", sockjs.DefaultOptions, s.newSockJSHandlerFunc()))
 	// add an auth endpoint for generating the signatures used in private and presence channels
-	http.HandleFunc("/auth", s.newAuthHandlerFunc())
+	mux.HandleFunc("/auth", s.newAuthHandlerFunc())
+	// rest api for publishing, channel info, stats and managing webhooks
+	rest := s.newRestApiHandler()
+	mux.Handle("/apps/", rest)
+	mux.Handle("/stats", rest)
+	mux.Handle("/stats/", rest)
+	// prometheus metrics
+	mux.Handle("/metrics", metrics.Handler())
 	// lastly bind web folder for static files
-	http.Handle("/", http.FileServer(http.Dir("web/")))
-
-	return http.ListenAndServe(s.opts.WebSocketAddress, nil)
+	mux.Handle("/", http.FileServer(http.Dir("web/")))
+	return mux
 }
 
 type Session interface {
@@ -128,8 +212,22 @@ type socket struct {
 	session Session
 	// Path which contains the app id / client token
 	path string
+	// app id taken from the path, what to label its metrics with and what to
+	// count its stats under, "" if the app isnt in the store
+	appId      string
+	metricsApp string
+	statsApp   string
+	// websocket or sockjs
+	transport string
 	// map of subscribed presence-channels to user_ids
 	presense map[string]string
+	// the user signed in as, see user.go
+	userId string
+	// at least once deliveries waiting for an ack by message id, and the
+	// client id given for each reliable channel, see reliable.go
+	reliableLock sync.Mutex
+	pending      map[string]*reliableDelivery
+	clientIds    map[string]string
 	// hack for now to access server
 	server *server
 }
@@ -141,36 +239,89 @@ func (sock *socket) Receive(channel string, msg *pubsub.Message) {
 	// perhaps we pass in a callback function when subscribing..
 
 	// for now, this fugly hack is used to handle keyspace / object notifications
-	if strings.HasPrefix(channel, KEYSPACE_NOTIFICATION_PREFIX) {
-		channel = strings.TrimPrefix(channel, KEYSPACE_NOTIFICATION_PREFIX)
+	if sock.server.isKeyspaceChannel(channel) {
+		channel = strings.TrimPrefix(channel, sock.server.keyspacePrefix)
 		sock.server.handleNotifyObjectChange(sock, channel, msg.Name)
 		return
 	}
 
-	data, _ := json.Marshal(msg.Data)
-	packet := fmt.Sprintf(RAW_CHANNEL_EVENT, msg.Name, channel, data, msg.Timestamp)
-	log.Println("packet", packet)
+	if msg.Id != "" && isReliableChannel(channel) {
+		sock.track(channel, msg)
+	}
+	packet := msg.Frame
+	if packet == "" {
+		packet = channelEventFrame(clientChannel(channel), msg)
+	}
 	sock.session.Send(packet)
 }
 
-func (s *server) newSocket(session Session, path string) *socket {
-	log.Println("new socket %s with path: %s", session.ID(), path)
+func channelEventFrame(channel string, msg *pubsub.Message) string {
+	data, _ := json.Marshal(msg.Data)
+	return fmt.Sprintf(RAW_CHANNEL_EVENT, msg.Name, channel, data, msg.Timestamp, msg.Id, msg.Seq)
+}
+
+// encodeFrame builds the channel event once for every socket on the channel,
+// keyspace notifications are handled per socket in Receive
+func (s *server) encodeFrame(channel string, msg *pubsub.Message) string {
+	if s.isKeyspaceChannel(channel) {
+		return ""
+	}
+	return channelEventFrame(clientChannel(channel), msg)
+}
+
+// handleDrop counts messages the pubsub shed because their app was too busy
+// or their channel couldnt keep up
+func (s *server) handleDrop(appId string, channel string) {
+	s.stats.dropped(s.statsApp(appId))
+}
+
+// isKeyspaceChannel is false for everything with the memory store, which has
+// no keyspace prefix
+func (s *server) isKeyspaceChannel(channel string) bool {
+	return s.keyspacePrefix != "" && strings.HasPrefix(channel, s.keyspacePrefix)
+}
+
+func (s *server) newSocket(session Session, path string, transport string) *socket {
+	log.Printf("new socket %s with path: %s", session.ID(), path)
 	id := uuid.NewRandom().String()
+	appId := appIdFromPath(path)
+	metricsApp := s.metricsApp(appId)
+	statsApp := ""
+	if metricsApp == appId {
+		statsApp = appId
+	}
 	sock := &socket{
-		id:       id,
-		session:  session,
-		path:     path,
-		presense: make(map[string]string),
-		server:   s,
+		id:         id,
+		session:    session,
+		path:       path,
+		appId:      appId,
+		metricsApp: metricsApp,
+		statsApp:   statsApp,
+		transport:  transport,
+		presense:   make(map[string]string),
+		pending:    make(map[string]*reliableDelivery),
+		clientIds:  make(map[string]string),
+		server:     s,
 	}
 	return sock
 }
 
+// appIdFromPath pulls the app id out of a path like /app/<app_id>?protocol=7
+func appIdFromPath(path string) string {
+	path = strings.SplitN(path, "?", 2)[0]
+	path = strings.TrimPrefix(path, "/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] != "app" {
+		return ""
+	}
+	return parts[1]
+}
+
 type pusherWSHandlerFunc func(session pusher.Session)
 
 func (s *server) newPusherWSHandlerFunc() pusherWSHandlerFunc {
 	handler := func(session pusher.Session) {
-		socket := s.newSocket(session, session.Path())
+		socket := s.newSocket(session, session.Path(), TRANSPORT_WEBSOCKET)
 		s.handleSocket(socket)
 	}
 	return handler
@@ -197,7 +348,7 @@ func (s *server) newSockJSHandlerFunc() sockJSHandlerFunc {
 					break
 				}
 				// connect session / socket
-				socket := s.newSocket(session, path.(string))
+				socket := s.newSocket(session, path.(string), TRANSPORT_SOCKJS)
 				s.handleSocket(socket)
 			} else {
 				log.Println("unable to read packet")
@@ -214,6 +365,9 @@ func (s *server) handleSocket(sock *socket) {
 
 	// check the path is a valid app id
 
+	s.addSocket(sock)
+	defer s.removeSocket(sock)
+
 	// send connection established
 	sock.session.Send(fmt.Sprintf(RAW_CONNECTION_ESTABLISHED, sock.id))
 	// recv loop
@@ -239,6 +393,23 @@ func (s *server) handleSocket(sock *socket) {
 	for presenseChannel, userId := range sock.presense {
 		s.presenseMemberRemoved(sock, presenseChannel, userId)
 	}
+	s.closeReliable(sock)
+}
+
+func (s *server) addSocket(sock *socket) {
+	s.lock.Lock()
+	s.sockets[sock.id] = sock
+	s.lock.Unlock()
+	s.stats.connectionOpened(sock.statsApp)
+	connectionsGauge.Inc(sock.transport, sock.metricsApp)
+}
+
+func (s *server) removeSocket(sock *socket) {
+	s.lock.Lock()
+	delete(s.sockets, sock.id)
+	s.lock.Unlock()
+	s.stats.connectionClosed(sock.statsApp)
+	connectionsGauge.Dec(sock.transport, sock.metricsApp)
 }
 
 func (s *server) handleEvent(sock *socket, event *Event) {
@@ -260,14 +431,19 @@ func (s *server) handleEvent(sock *socket, event *Event) {
 		//	return
 		//}
 		channel := event.Data["channel"].(string)
+		if strings.HasPrefix(channel, CHANNEL_PREFIX_SERVER) {
+			log.Println("clients cant subscribe to server channels", channel)
+			return
+		}
 
 		switch {
 		// private-
 		case strings.HasPrefix(channel, CHANNEL_PREFIX_PRIVATE):
 			auth := event.Data["auth"].(string)
 			message := fmt.Sprintf("%s:%s", sock.ID(), channel)
-			if ok := s.verifyAuth(auth, message); !ok {
+			if ok := s.verifyAuth(sock.appId, auth, message); !ok {
 				log.Println("auth not ok, return some error")
+				authFailuresCounter.Inc("channel")
 				return
 			}
 
@@ -280,8 +456,9 @@ func (s *server) handleEvent(sock *socket, event *Event) {
 			auth := event.Data["auth"].(string)
 			channelData := event.Data["channel_data"].(string)
 			message := fmt.Sprintf("%s:%s:%s", sock.ID(), channel, channelData)
-			if ok := s.verifyAuth(auth, message); !ok {
+			if ok := s.verifyAuth(sock.appId, auth, message); !ok {
 				log.Println("auth not ok, return some error")
+				authFailuresCounter.Inc("channel")
 				return
 			}
 
@@ -290,6 +467,17 @@ func (s *server) handleEvent(sock *socket, event *Event) {
 		default:
 			s.handleSubscribe(sock, channel)
 		}
+		if !s.pubsub.IsSubscribed(sock, channel) {
+			return
+		}
+		if isReliableChannel(channel) {
+			clientId, _ := event.Data["client_id"].(string)
+			s.subscribeReliable(sock, channel, clientId)
+		}
+		// a client coming back says where it got to, see history.go
+		if lastSeq, ok := event.Data["last_seq"].(float64); ok {
+			s.resume(sock, channel, int64(lastSeq))
+		}
 
 		// auth := event.Data["auth"].(string)
 		// channel_data := event.Data["channel_data"].(string)
@@ -306,7 +494,18 @@ func (s *server) handleEvent(sock *socket, event *Event) {
 		//}
 		log.Println("unsubscribe event")
 		channel, _ := event.Data["channel"].(string)
+		if strings.HasPrefix(channel, CHANNEL_PREFIX_SERVER) {
+			return
+		}
 		s.handleUnsubscribe(sock, channel)
+	case EVENT_SIGNIN:
+		auth, _ := event.Data["auth"].(string)
+		userData, _ := event.Data["user_data"].(string)
+		s.handleSignin(sock, auth, userData)
+	case EVENT_ACK:
+		// the client got an event on a reliable channel
+		id, _ := event.Data["id"].(string)
+		s.handleAck(sock, id)
 	case EVENT_ERROR:
 		// client sent us an error, print it out
 		log.Println("got an error from client", event)
@@ -327,6 +526,8 @@ const (
 	CHANNEL_PREFIX_KEYSPACE = "keyspace-"
 	CHANNEL_PREFIX_OBJECT   = "object-"
 	CHANNEL_PREFIX_TOKEN    = "token-"
+	CHANNEL_PREFIX_SERVER   = "#" // only the server puts sockets on these
+	CHANNEL_PREFIX_USER     = "#server-to-user-"
 )
 
 func (s *server) handleSubscribe(sock *socket, channel string) {
@@ -347,13 +548,13 @@ func (s *server) handleUnsubscribe(sock *socket, channel string) {
 	// if object channel change the prefix
 	if strings.HasPrefix(channel, CHANNEL_PREFIX_OBJECT) {
 		channel = strings.TrimPrefix(channel, CHANNEL_PREFIX_OBJECT)
-		channel = KEYSPACE_NOTIFICATION_PREFIX + channel
+		channel = s.keyspacePrefix + channel
 	}
 
 	// if keyspace channel change the prefix
 	if strings.HasPrefix(channel, CHANNEL_PREFIX_KEYSPACE) {
 		channel = strings.TrimPrefix(channel, CHANNEL_PREFIX_KEYSPACE)
-		channel = KEYSPACE_NOTIFICATION_PREFIX + channel
+		channel = s.keyspacePrefix + channel
 	}
 
 	if strings.HasPrefix(channel, CHANNEL_PREFIX_PRESENSE) {
@@ -367,6 +568,11 @@ func (s *server) handleUnsubscribe(sock *socket, channel string) {
 }
 
 func (s *server) handleClientEvent(sock *socket, event *Event) {
+	if strings.HasPrefix(event.Channel, CHANNEL_PREFIX_SERVER) {
+		log.Println("not publishing to a server channel", event.Channel)
+		clientEventsRejectedCounter.Inc(sock.metricsApp, "server_channel")
+		return
+	}
 	// check we are actually subscribed to the channel in question
 	if s.pubsub.IsSubscribed(sock, event.Channel) {
 		// hmm this feels wrong having to marshal it again
@@ -374,14 +580,31 @@ func (s *server) handleClientEvent(sock *socket, event *Event) {
 		// need to re-read the pusher spec
 		if data, err := json.Marshal(event.Data); err == nil {
 			msg := &pubsub.Message{
-				Name: event.Event,
-				Data: string(data),
+				Name:  event.Event,
+				Data:  string(data),
+				AppId: sock.appId,
 			}
-			s.pubsub.Publish(sock, event.Channel, msg)
+			lock := s.seqLock(event.Channel)
+			lock.Lock()
+			s.sequence(event.Channel, msg)
+			s.pubsub.PublishAsync(sock, event.Channel, msg, nil)
+			lock.Unlock()
+			s.stats.message(sock.statsApp)
+			publishedCounter.Inc(sock.metricsApp)
+			s.callWebhooks(sock.appId, &WebhookEvent{
+				Name:     WEBHOOK_CLIENT_EVENT,
+				Channel:  event.Channel,
+				Event:    event.Event,
+				Data:     string(data),
+				SocketId: sock.ID(),
+				UserId:   sock.presense[event.Channel],
+			})
 		} else {
 			log.Println("unable to marshal data into string", err)
+			clientEventsRejectedCounter.Inc(sock.metricsApp, "invalid_data")
 		}
 	} else {
 		log.Println("not publishing to channel, sock isnt subscribed")
+		clientEventsRejectedCounter.Inc(sock.metricsApp, "not_subscribed")
 	}
 }
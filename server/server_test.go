@@ -0,0 +1,107 @@
+package server
+
+import (
+	"github.com/screencloud/subhub/pubsub"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// discardSession drops what is sent, keeping the last frame
+type discardSession struct {
+	id   string
+	sent int
+	last string
+}
+
+func (ds *discardSession) ID() string                               { return ds.id }
+func (ds *discardSession) Recv() (string, error)                    { return "", io.EOF }
+func (ds *discardSession) Close(status uint32, reason string) error { return nil }
+func (ds *discardSession) Send(frame string) error {
+	ds.sent++
+	ds.last = frame
+	return nil
+}
+
+func newTestServer() *server {
+	store := newMemoryStore()
+	return &server{
+		opts:    &Options{},
+		pubsub:  pubsub.New(&pubsub.Options{PubSubMode: pubsub.PubSubModeMemory, PubSubNodeId: "test"}),
+		store:   store,
+		stats:   newStats(store, "test"),
+		sockets: make(map[string]*socket),
+	}
+}
+
+// subscribeSockets puts n sockets on channel
+func subscribeSockets(s *server, channel string, n int) []*discardSession {
+	sessions := make([]*discardSession, n)
+	for idx := range sessions {
+		sessions[idx] = &discardSession{id: strconv.Itoa(idx)}
+		sock := s.newSocket(sessions[idx], "/app/test", TRANSPORT_WEBSOCKET)
+		s.pubsub.Subscribe(sock, channel)
+	}
+	return sessions
+}
+
+func TestSocketReceiveSharedFrame(t *testing.T) {
+	s := newTestServer()
+	s.pubsub.SetFrameEncoder(s.encodeFrame)
+	sessions := subscribeSockets(s, "screens", 2)
+	msg := &pubsub.Message{Name: "update", Data: `{"a":1}`}
+	if num, _ := s.pubsub.Publish(nil, "screens", msg); num != 2 {
+		t.Fatalf("expected 2 deliveries got %d", num)
+	}
+	if msg.Frame != "" {
+		t.Errorf("expected the published message to be left alone")
+	}
+	expected := channelEventFrame("screens", msg)
+	for _, session := range sessions {
+		if session.sent != 1 || session.last != expected {
+			t.Errorf("expected %s got %d %s", expected, session.sent, session.last)
+		}
+	}
+}
+
+func benchmarkPublish(b *testing.B, encode bool) {
+	s := newTestServer()
+	if encode {
+		s.pubsub.SetFrameEncoder(s.encodeFrame)
+	}
+	subscribeSockets(s, "screens", 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.pubsub.Publish(nil, "screens", &pubsub.Message{
+			Name: "update",
+			Data: `{"playlist":"7f0c2a","items":["intro","menu","specials"]}`,
+		})
+	}
+}
+
+// a frame per socket, what happens without an encoder
+func BenchmarkPublishFramePerSocket(b *testing.B) {
+	benchmarkPublish(b, false)
+}
+
+func BenchmarkPublishFrameOnce(b *testing.B) {
+	benchmarkPublish(b, true)
+}
+
+func TestMetricsApp(t *testing.T) {
+	s := newTestServer()
+	if label := s.metricsApp("nope"); label != METRICS_UNKNOWN_APP {
+		t.Errorf("expected an app not in the store labelled unknown got %s", label)
+	}
+	s.saveApp("app", &AppSettings{})
+	sock := s.newSocket(&discardSession{}, "/app/app", TRANSPORT_WEBSOCKET)
+	if sock.metricsApp != "app" {
+		t.Errorf("expected a known app labelled by id got %s", sock.metricsApp)
+	}
+
+	// making another server doesnt register the metrics again
+	opts := &Options{PubSub: pubsub.Options{PubSubMode: pubsub.PubSubModeMemory, PubSubNodeId: "test"}}
+	New(opts)
+	New(opts)
+}
@@ -1,5 +1,12 @@
 package server
 
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
 // whole system
 // per node
 // per app
@@ -7,3 +14,242 @@ package server
 // open connections
 // messages per day
 // message per minute
+
+// Counters are kept in the store in time buckets, one key per scope, metric,
+// resolution and bucket, each expiring once it is too old to be asked for.
+// Nodes add up their counts locally and flush them every few seconds so a
+// busy channel doesnt turn into a busy redis.
+// Open connections are a gauge rather than a counter, each node keeps a hash
+// of its connections per app which expires if the node stops flushing. Apps
+// not in the store are only counted in the system and node scopes, see
+// statsApp, so clients cant make up keys.
+// Reading back a range of buckets is one read for the counters and one
+// pipeline for the users, however many buckets there are.
+
+const REDIS_STATS_BUCKET = "subhub://stats/%s/%s/%s/%d"
+const REDIS_STATS_CONNECTIONS_HASH = "subhub://stats/connections/%s"
+
+const STATS_FLUSH_INTERVAL = 5 * time.Second
+const STATS_MAX_BUCKETS = 1440
+
+const (
+	STATS_SCOPE_SYSTEM = "system"
+	STATS_SCOPE_NODE   = "node/%s"
+	STATS_SCOPE_APP    = "app/%s"
+)
+
+const (
+	STATS_CONNECTS = "connects" // connections opened
+	STATS_MESSAGES = "messages" // messages published
+	STATS_USERS    = "users"    // unique users, a hyperloglog
+	STATS_DROPPED  = "dropped"  // messages from redis shed by the fair scheduler
+)
+
+const STATS_CONNECTIONS_TOTAL_FIELD = "total"
+
+type statsResolution struct {
+	Name string
+	Size time.Duration // width of a bucket
+	TTL  time.Duration // how long buckets are kept
+}
+
+var statsResolutions = []*statsResolution{
+	{"minute", time.Minute, 48 * time.Hour},
+	{"hour", time.Hour, 30 * 24 * time.Hour},
+	{"day", 24 * time.Hour, 365 * 24 * time.Hour},
+}
+
+func lookupStatsResolution(name string) *statsResolution {
+	for _, res := range statsResolutions {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+func (res *statsResolution) bucket(t time.Time) int64 {
+	size := int64(res.Size / time.Second)
+	return t.Unix() / size * size
+}
+
+func statsKey(scope string, metric string, res *statsResolution, bucket int64) string {
+	return fmt.Sprintf(REDIS_STATS_BUCKET, scope, metric, res.Name, bucket)
+}
+
+type stats struct {
+	lock   sync.Mutex
+	store  Store
+	nodeId string
+
+	counts      map[string]int64         // bucket key to increment
+	users       map[string][]string      // hyperloglog key to user ids seen
+	ttls        map[string]time.Duration // bucket key to expiry
+	connections map[string]int64         // app id to open connections on this node
+}
+
+func newStats(store Store, nodeId string) *stats {
+	st := &stats{
+		store:       store,
+		nodeId:      nodeId,
+		counts:      make(map[string]int64),
+		users:       make(map[string][]string),
+		ttls:        make(map[string]time.Duration),
+		connections: make(map[string]int64),
+	}
+	return st
+}
+
+func (st *stats) scopes(appId string) []string {
+	scopes := []string{STATS_SCOPE_SYSTEM, fmt.Sprintf(STATS_SCOPE_NODE, st.nodeId)}
+	if appId != "" {
+		scopes = append(scopes, fmt.Sprintf(STATS_SCOPE_APP, appId))
+	}
+	return scopes
+}
+
+func (st *stats) incr(appId string, metric string, n int64) {
+	st.incrAt(time.Now(), appId, metric, n)
+}
+
+func (st *stats) incrAt(now time.Time, appId string, metric string, n int64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for _, scope := range st.scopes(appId) {
+		for _, res := range statsResolutions {
+			key := statsKey(scope, metric, res, res.bucket(now))
+			st.counts[key] += n
+			st.ttls[key] = res.TTL
+		}
+	}
+}
+
+func (st *stats) connectionOpened(appId string) {
+	st.lock.Lock()
+	st.connections[appId]++
+	st.lock.Unlock()
+	st.incr(appId, STATS_CONNECTS, 1)
+}
+
+func (st *stats) connectionClosed(appId string) {
+	st.lock.Lock()
+	st.connections[appId]--
+	if st.connections[appId] <= 0 {
+		delete(st.connections, appId)
+	}
+	st.lock.Unlock()
+}
+
+func (st *stats) message(appId string) {
+	st.incr(appId, STATS_MESSAGES, 1)
+}
+
+func (st *stats) dropped(appId string) {
+	st.incr(appId, STATS_DROPPED, 1)
+}
+
+func (st *stats) user(appId string, userId string) {
+	now := time.Now()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for _, scope := range st.scopes(appId) {
+		for _, res := range statsResolutions {
+			key := statsKey(scope, STATS_USERS, res, res.bucket(now))
+			st.users[key] = append(st.users[key], userId)
+			st.ttls[key] = res.TTL
+		}
+	}
+}
+
+func (st *stats) flushLoop() {
+	ticker := time.NewTicker(STATS_FLUSH_INTERVAL)
+	for range ticker.C {
+		st.flush()
+	}
+}
+
+func (st *stats) flush() {
+	st.lock.Lock()
+	counts, users, ttls := st.counts, st.users, st.ttls
+	st.counts = make(map[string]int64)
+	st.users = make(map[string][]string)
+	st.ttls = make(map[string]time.Duration)
+	connections := make(map[string]int64)
+	var total int64 = 0
+	for appId, n := range st.connections {
+		if appId != "" {
+			connections[appId] = n
+		}
+		total += n
+	}
+	connections[STATS_CONNECTIONS_TOTAL_FIELD] = total
+	st.lock.Unlock()
+
+	for key, n := range counts {
+		if err := st.store.IncrStat(key, n, ttls[key]); err != nil {
+			log.Println("problem flushing stats", err)
+		}
+	}
+	for key, ids := range users {
+		if err := st.store.AddStatUsers(key, ids, ttls[key]); err != nil {
+			log.Println("problem flushing stats", err)
+		}
+	}
+
+	if err := st.store.SaveNodeConnections(st.nodeId, connections, 3*STATS_FLUSH_INTERVAL); err != nil {
+		log.Println("problem flushing connection stats", err)
+	}
+}
+
+// nodeConnections returns the open connections on each live node for the
+// given field, an app id or the total
+func (st *stats) nodeConnections(field string) map[string]int64 {
+	nodes, err := st.store.NodeConnections(field)
+	if err != nil {
+		log.Println("problem reading connection stats", err)
+	}
+	return nodes
+}
+
+type StatsBucket struct {
+	Time     int64 `json:"time"`
+	Connects int64 `json:"connects"`
+	Messages int64 `json:"messages"`
+	Users    int64 `json:"users"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// buckets reads back the counters for a scope between from and to
+func (st *stats) buckets(scope string, res *statsResolution, from time.Time, to time.Time) ([]*StatsBucket, error) {
+	buckets := make([]*StatsBucket, 0)
+	size := int64(res.Size / time.Second)
+	first, last := res.bucket(from), res.bucket(to)
+	if last < first {
+		return buckets, nil
+	}
+	if (last-first)/size >= STATS_MAX_BUCKETS {
+		return nil, fmt.Errorf("too many buckets, at most %d can be requested", STATS_MAX_BUCKETS)
+	}
+	metrics := []string{STATS_CONNECTS, STATS_MESSAGES, STATS_DROPPED}
+	keys := make([]string, 0, len(metrics)*int((last-first)/size+1))
+	userKeys := make([]string, 0, (last-first)/size+1)
+	for t := first; t <= last; t += size {
+		for _, metric := range metrics {
+			keys = append(keys, statsKey(scope, metric, res, t))
+		}
+		userKeys = append(userKeys, statsKey(scope, STATS_USERS, res, t))
+	}
+	counts, err := st.store.StatCounts(keys...)
+	if err != nil {
+		return nil, err
+	}
+	users, err := st.store.StatUsers(userKeys...)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range userKeys {
+		c := counts[idx*len(metrics):]
+		buckets = append(buckets, &StatsBucket{Time: first + int64(idx)*size, Connects: c[0], Messages: c[1], Users: users[idx], Dropped: c[2]})
+	}
+	return buckets, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// statsCallStore counts the reads buckets makes
+type statsCallStore struct {
+	Store
+	reads int
+}
+
+func (sc *statsCallStore) StatCounts(keys ...string) ([]int64, error) {
+	sc.reads++
+	return sc.Store.StatCounts(keys...)
+}
+
+func (sc *statsCallStore) StatUsers(keys ...string) ([]int64, error) {
+	sc.reads++
+	return sc.Store.StatUsers(keys...)
+}
+
+func TestStatsBucket(t *testing.T) {
+	at := time.Date(2024, 3, 5, 13, 47, 29, 0, time.UTC)
+	for name, expected := range map[string]time.Time{
+		"minute": time.Date(2024, 3, 5, 13, 47, 0, 0, time.UTC),
+		"hour":   time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC),
+		"day":    time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+	} {
+		if bucket := lookupStatsResolution(name).bucket(at); bucket != expected.Unix() {
+			t.Errorf("expected the %s bucket to start at %v got %v", name, expected, time.Unix(bucket, 0).UTC())
+		}
+	}
+}
+
+// counts either side of a minute go in their own minute buckets but the
+// same hour bucket
+func TestStatsRollover(t *testing.T) {
+	store := &statsCallStore{Store: newMemoryStore()}
+	st := newStats(store, "node")
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	st.incrAt(start.Add(59*time.Second), "app", STATS_MESSAGES, 1)
+	st.incrAt(start.Add(61*time.Second), "app", STATS_MESSAGES, 2)
+	st.incrAt(start.Add(5*time.Minute), "app", STATS_MESSAGES, 4)
+	st.flush()
+
+	minutes, err := st.buckets("app/app", lookupStatsResolution("minute"), start, start.Add(5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(minutes) != 6 {
+		t.Fatalf("expected 6 minute buckets got %d", len(minutes))
+	}
+	for idx, expected := range []int64{1, 2, 0, 0, 0, 4} {
+		if minutes[idx].Messages != expected || minutes[idx].Time != start.Unix()+int64(idx)*60 {
+			t.Errorf("expected %d messages in minute %d got %+v", expected, idx, minutes[idx])
+		}
+	}
+	if store.reads != 2 {
+		t.Errorf("expected one read for the counts and one for the users got %d", store.reads)
+	}
+
+	hours, _ := st.buckets("app/app", lookupStatsResolution("hour"), start, start)
+	if len(hours) != 1 || hours[0].Messages != 7 {
+		t.Errorf("expected the hour to have them all got %+v", hours)
+	}
+	// the node scope gets them too
+	node, _ := st.buckets(fmt.Sprintf(STATS_SCOPE_NODE, "node"), lookupStatsResolution("hour"), start, start)
+	if len(node) != 1 || node[0].Messages != 7 {
+		t.Errorf("expected the node to have them all got %+v", node)
+	}
+
+	if _, err := st.buckets("app/app", lookupStatsResolution("minute"), start, start.Add(STATS_MAX_BUCKETS*time.Minute)); err == nil {
+		t.Errorf("expected too many buckets to fail")
+	}
+}
+
+func TestStatsRoutes(t *testing.T) {
+	s := newTestServer()
+	mux := s.newMux()
+	for path, expected := range map[string]string{"/stats": "/stats", "/stats/nodes/test": "/stats/"} {
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", path, nil)); pattern != expected {
+			t.Errorf("expected %s served by %s got %s", path, expected, pattern)
+		}
+	}
+
+	// not the static files, which would 404
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stats/nodes/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		t.Errorf("expected the node stats endpoint to be found")
+	}
+}
+
+// only apps in the store get counted on their own, and apps that have no
+// connections left are dropped
+func TestStatsConnections(t *testing.T) {
+	s := newTestServer()
+	s.saveApp("app", &AppSettings{})
+	known := s.newSocket(&discardSession{}, "/app/app", TRANSPORT_WEBSOCKET)
+	madeUp := s.newSocket(&discardSession{}, "/app/made-up", TRANSPORT_WEBSOCKET)
+	s.addSocket(known)
+	s.addSocket(madeUp)
+	s.stats.flush()
+	if nodes := s.stats.nodeConnections("made-up"); len(nodes) != 0 {
+		t.Errorf("expected no count for an app not in the store got %v", nodes)
+	}
+	if nodes := s.stats.nodeConnections(STATS_CONNECTIONS_TOTAL_FIELD); nodes["test"] != 2 {
+		t.Errorf("expected both in the total got %v", nodes)
+	}
+
+	s.removeSocket(known)
+	s.stats.flush()
+	if _, ok := s.stats.connections["app"]; ok {
+		t.Errorf("expected the app dropped once it has no connections")
+	}
+	if nodes := s.stats.nodeConnections("app"); nodes["test"] != 0 {
+		t.Errorf("expected no connections for the app got %v", nodes)
+	}
+}
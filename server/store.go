@@ -0,0 +1,93 @@
+package server
+
+import (
+	"time"
+)
+
+// Store holds the state nodes share, everything but object and keyspace
+// channels, which read redis keys directly and only work with the redis store.
+// The redis store is what a cluster uses, the memory store keeps it all in the
+// process for a single node or tests.
+
+const (
+	STORE_REDIS  = "redis"
+	STORE_MEMORY = "memory"
+)
+
+type Store interface {
+	// apps, LoadApp returns empty settings for an unknown app
+	LoadApp(appId string) (*AppSettings, error)
+	SaveApp(appId string, settings *AppSettings) error
+	DeleteApp(appId string) error
+	AppExists(appId string) (bool, error)
+
+	// keys used to sign channel auth and tokens, and the app each belongs to,
+	// both return "" for an unknown key
+	SaveAuthSecret(key string, secret string) error
+	AuthSecret(key string) (string, error)
+	SaveAuthKeyApp(key string, appId string) error
+	AuthKeyApp(key string) (string, error)
+
+	// webhooks, LoadWebhook returns nil for an unknown webhook
+	SaveWebhook(hook *Webhook) error
+	LoadWebhook(webhookId string) (*Webhook, error)
+	DeleteWebhook(hook *Webhook) error
+	AppWebhookIds(appId string) ([]string, error)
+	// the app a channel belongs to, for when nobody is left on it to ask
+	SetChannelApp(channel string, appId string) error
+	ChannelApp(channel string) (string, error)
+	// deliveries waiting to be retried, a delivery is only claimed by one node
+	QueueWebhookRetry(data string, due time.Time) error
+	ClaimWebhookRetries(now time.Time) ([]string, error)
+
+	// history, the webhook attempt log is newest first and kept to size
+	LogWebhookAttempt(appId string, data string, size int) error
+	WebhookAttempts(appId string) ([]string, error)
+	// dead lettered deliveries, oldest first and kept to size dropping the
+	// oldest, removing reports whether this caller was the one that removed it
+	DeadLetterWebhook(appId string, data string, size int) error
+	DeadLetteredWebhooks(appId string) ([]string, error)
+	RemoveDeadLetteredWebhook(appId string, data string) (bool, error)
+
+	// presence, both return the sockets the user has left on the channel and
+	// every member with their user data
+	PresenceJoin(channel string, userId string, userData string) (int64, map[string]string, error)
+	PresenceLeave(channel string, userId string) (int64, map[string]string, error)
+
+	// channel history, see history.go, appending returns the messages seq, the
+	// seq is kept for seqTTL and the history for ttl, and
+	// History returns what came after a seq, oldest first, and the latest seq
+	AppendHistory(channel string, data string, size int, ttl time.Duration, seqTTL time.Duration) (int64, error)
+	History(channel string, after int64) ([]HistoryEntry, int64, error)
+
+	// at least once deliveries, see reliable.go, pending ones by message id
+	// per client, written in batches, and those given up on newest first kept
+	// to size. A client with nothing written for ttl is expired, its pending
+	// deliveries are returned to one caller and removed.
+	WritePendingDeliveries(writes []*PendingWrite, ttl time.Duration) error
+	PendingDeliveries(appId string, clientId string) (map[string]string, error)
+	ExpirePendingDeliveries(now time.Time) ([]string, error)
+	LogUndelivered(appId string, data string, size int) error
+	Undelivered(appId string) ([]string, error)
+
+	// user inboxes, see inbox.go, oldest first, pushing drops the oldest past
+	// size, taking empties it
+	PushInbox(appId string, userId string, data string, size int, ttl time.Duration) error
+	Inbox(appId string, userId string) ([]string, error)
+	TakeInbox(appId string, userId string) ([]string, error)
+
+	// rest idempotency keys, see rest_events.go, claiming sets the key to value
+	// only if it isnt set, otherwise it returns what it is set to
+	ClaimIdempotencyKey(appId string, key string, value string, ttl time.Duration) (bool, string, error)
+	SaveIdempotentResult(appId string, key string, result string, ttl time.Duration) error
+	ReleaseIdempotencyKey(appId string, key string) error
+
+	// stats buckets, see stats.go
+	IncrStat(key string, n int64, ttl time.Duration) error
+	AddStatUsers(key string, userIds []string, ttl time.Duration) error
+	StatCounts(keys ...string) ([]int64, error)
+	StatUsers(keys ...string) ([]int64, error)
+	// open connections per app on a node, and read back across live nodes
+	SaveNodeConnections(nodeId string, connections map[string]int64, ttl time.Duration) error
+	NodeConnections(field string) (map[string]int64, error)
+}
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the shared state in the process, for a single node or
+// tests. Stats buckets expire like they do in redis, swept every so often.
+
+const MEMORY_STORE_SWEEP_INTERVAL = time.Minute
+
+type memoryRetry struct {
+	data string
+	due  time.Time
+}
+
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+type memoryHistory struct {
+	seq        int64
+	seqExpires time.Time
+	entries    []HistoryEntry
+	expires    time.Time
+}
+
+type memoryPending struct {
+	deliveries map[string]string // message id to delivery
+	expires    time.Time
+}
+
+type memoryInbox struct {
+	messages []string // oldest first
+	expires  time.Time
+}
+
+type memoryNode struct {
+	connections map[string]int64
+	expires     time.Time
+}
+
+type memoryStore struct {
+	lock sync.Mutex
+
+	apps        map[string]AppSettings
+	authSecrets map[string]string
+	authKeyApps map[string]string
+
+	webhooks    map[string]Webhook
+	appWebhooks map[string]map[string]bool // app id to webhook ids
+	channelApps map[string]string
+	retries     []*memoryRetry
+
+	webhookAttempts map[string][]string // newest first
+	deadLetters     map[string][]string // oldest first
+
+	idempotencyKeys      map[string]*memoryValue // app id and key to value
+	lastIdempotencySweep time.Time
+
+	histories        map[string]*memoryHistory // channel to history
+	lastHistorySweep time.Time
+
+	pending     map[string]*memoryPending // app id and client id to deliveries
+	undelivered map[string][]string       // newest first
+
+	inboxes        map[string]*memoryInbox // app id and user id to inbox
+	lastInboxSweep time.Time
+
+	members      map[string]map[string]string // channel to user id to user data
+	memberCounts map[string]map[string]int64  // channel to user id to sockets
+
+	statCounts map[string]int64
+	statUsers  map[string]map[string]bool
+	expires    map[string]time.Time // stat key to when it goes
+	lastSweep  time.Time
+	nodes      map[string]*memoryNode
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		apps:            make(map[string]AppSettings),
+		authSecrets:     make(map[string]string),
+		authKeyApps:     make(map[string]string),
+		webhooks:        make(map[string]Webhook),
+		appWebhooks:     make(map[string]map[string]bool),
+		channelApps:     make(map[string]string),
+		webhookAttempts: make(map[string][]string),
+		deadLetters:     make(map[string][]string),
+		idempotencyKeys: make(map[string]*memoryValue),
+		histories:       make(map[string]*memoryHistory),
+		pending:         make(map[string]*memoryPending),
+		undelivered:     make(map[string][]string),
+		inboxes:         make(map[string]*memoryInbox),
+		members:         make(map[string]map[string]string),
+		memberCounts:    make(map[string]map[string]int64),
+		statCounts:      make(map[string]int64),
+		statUsers:       make(map[string]map[string]bool),
+		expires:         make(map[string]time.Time),
+		lastSweep:       time.Now(),
+		nodes:           make(map[string]*memoryNode),
+	}
+}
+
+func (ms *memoryStore) LoadApp(appId string) (*AppSettings, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	settings := ms.apps[appId]
+	return &settings, nil
+}
+
+func (ms *memoryStore) SaveApp(appId string, settings *AppSettings) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.apps[appId] = *settings
+	return nil
+}
+
+func (ms *memoryStore) DeleteApp(appId string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.apps, appId)
+	return nil
+}
+
+func (ms *memoryStore) AppExists(appId string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, ok := ms.apps[appId]
+	return ok, nil
+}
+
+func (ms *memoryStore) SaveAuthSecret(key string, secret string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.authSecrets[key] = secret
+	return nil
+}
+
+func (ms *memoryStore) AuthSecret(key string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.authSecrets[key], nil
+}
+
+func (ms *memoryStore) SaveAuthKeyApp(key string, appId string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.authKeyApps[key] = appId
+	return nil
+}
+
+func (ms *memoryStore) AuthKeyApp(key string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.authKeyApps[key], nil
+}
+
+func (ms *memoryStore) SaveWebhook(hook *Webhook) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.webhooks[hook.Id] = *hook
+	if ms.appWebhooks[hook.AppId] == nil {
+		ms.appWebhooks[hook.AppId] = make(map[string]bool)
+	}
+	ms.appWebhooks[hook.AppId][hook.Id] = true
+	return nil
+}
+
+func (ms *memoryStore) LoadWebhook(webhookId string) (*Webhook, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	hook, ok := ms.webhooks[webhookId]
+	if !ok {
+		return nil, nil
+	}
+	return &hook, nil
+}
+
+func (ms *memoryStore) DeleteWebhook(hook *Webhook) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.appWebhooks[hook.AppId], hook.Id)
+	delete(ms.webhooks, hook.Id)
+	return nil
+}
+
+func (ms *memoryStore) AppWebhookIds(appId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ids := make([]string, 0, len(ms.appWebhooks[appId]))
+	for id := range ms.appWebhooks[appId] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (ms *memoryStore) SetChannelApp(channel string, appId string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.channelApps[channel] = appId
+	return nil
+}
+
+func (ms *memoryStore) ChannelApp(channel string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.channelApps[channel], nil
+}
+
+func (ms *memoryStore) QueueWebhookRetry(data string, due time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.retries = append(ms.retries, &memoryRetry{data: data, due: due})
+	return nil
+}
+
+func (ms *memoryStore) ClaimWebhookRetries(now time.Time) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	claimed := make([]string, 0)
+	waiting := ms.retries[:0]
+	for _, retry := range ms.retries {
+		if retry.due.After(now) {
+			waiting = append(waiting, retry)
+		} else {
+			claimed = append(claimed, retry.data)
+		}
+	}
+	ms.retries = waiting
+	return claimed, nil
+}
+
+func (ms *memoryStore) LogWebhookAttempt(appId string, data string, size int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	attempts := append([]string{data}, ms.webhookAttempts[appId]...)
+	if len(attempts) > size {
+		attempts = attempts[:size]
+	}
+	ms.webhookAttempts[appId] = attempts
+	return nil
+}
+
+func (ms *memoryStore) WebhookAttempts(appId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]string{}, ms.webhookAttempts[appId]...), nil
+}
+
+func (ms *memoryStore) DeadLetterWebhook(appId string, data string, size int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	list := append(ms.deadLetters[appId], data)
+	if len(list) > size {
+		list = append([]string{}, list[len(list)-size:]...)
+	}
+	ms.deadLetters[appId] = list
+	return nil
+}
+
+func (ms *memoryStore) DeadLetteredWebhooks(appId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]string{}, ms.deadLetters[appId]...), nil
+}
+
+func (ms *memoryStore) RemoveDeadLetteredWebhook(appId string, data string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	list := ms.deadLetters[appId]
+	for idx, item := range list {
+		if item == data {
+			ms.deadLetters[appId] = append(list[:idx:idx], list[idx+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (ms *memoryStore) WritePendingDeliveries(writes []*PendingWrite, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	expires := time.Now().Add(ttl)
+	for _, write := range writes {
+		key := clientPendingKey(write.AppId, write.ClientId)
+		p, ok := ms.pending[key]
+		if write.Data == "" {
+			if ok {
+				delete(p.deliveries, write.Id)
+			}
+			continue
+		}
+		if !ok {
+			p = &memoryPending{deliveries: make(map[string]string)}
+			ms.pending[key] = p
+		}
+		p.deliveries[write.Id] = write.Data
+		p.expires = expires
+	}
+	return nil
+}
+
+func (ms *memoryStore) PendingDeliveries(appId string, clientId string) (map[string]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	deliveries := make(map[string]string)
+	if p, ok := ms.pending[clientPendingKey(appId, clientId)]; ok {
+		for id, data := range p.deliveries {
+			deliveries[id] = data
+		}
+	}
+	return deliveries, nil
+}
+
+func (ms *memoryStore) ExpirePendingDeliveries(now time.Time) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	expired := make([]string, 0)
+	for key, p := range ms.pending {
+		if p.expires.After(now) {
+			continue
+		}
+		for _, data := range p.deliveries {
+			expired = append(expired, data)
+		}
+		delete(ms.pending, key)
+	}
+	return expired, nil
+}
+
+func (ms *memoryStore) LogUndelivered(appId string, data string, size int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	undelivered := append([]string{data}, ms.undelivered[appId]...)
+	if len(undelivered) > size {
+		undelivered = undelivered[:size]
+	}
+	ms.undelivered[appId] = undelivered
+	return nil
+}
+
+func (ms *memoryStore) Undelivered(appId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return append([]string{}, ms.undelivered[appId]...), nil
+}
+
+// inbox returns the users inbox if it hasnt expired, it expects the lock to
+// be held
+func (ms *memoryStore) inbox(key string, now time.Time) *memoryInbox {
+	if now.Sub(ms.lastInboxSweep) > MEMORY_STORE_SWEEP_INTERVAL {
+		ms.lastInboxSweep = now
+		for k, inbox := range ms.inboxes {
+			if inbox.expires.Before(now) {
+				delete(ms.inboxes, k)
+			}
+		}
+	}
+	if inbox, ok := ms.inboxes[key]; ok && inbox.expires.After(now) {
+		return inbox
+	}
+	return nil
+}
+
+func (ms *memoryStore) PushInbox(appId string, userId string, data string, size int, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	key := userInboxKey(appId, userId)
+	inbox := ms.inbox(key, now)
+	if inbox == nil {
+		inbox = &memoryInbox{}
+		ms.inboxes[key] = inbox
+	}
+	inbox.messages = append(inbox.messages, data)
+	if len(inbox.messages) > size {
+		inbox.messages = append([]string{}, inbox.messages[len(inbox.messages)-size:]...)
+	}
+	inbox.expires = now.Add(ttl)
+	return nil
+}
+
+func (ms *memoryStore) Inbox(appId string, userId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if inbox := ms.inbox(userInboxKey(appId, userId), time.Now()); inbox != nil {
+		return append([]string{}, inbox.messages...), nil
+	}
+	return []string{}, nil
+}
+
+func (ms *memoryStore) TakeInbox(appId string, userId string) ([]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	key := userInboxKey(appId, userId)
+	inbox := ms.inbox(key, time.Now())
+	delete(ms.inboxes, key)
+	if inbox == nil {
+		return []string{}, nil
+	}
+	return inbox.messages, nil
+}
+
+// history returns the channels history with the expired entries dropped, or
+// nil once its seq has expired too, it expects the lock to be held
+func (ms *memoryStore) history(channel string, now time.Time) *memoryHistory {
+	if now.Sub(ms.lastHistorySweep) > MEMORY_STORE_SWEEP_INTERVAL {
+		ms.lastHistorySweep = now
+		for c, h := range ms.histories {
+			if h.seqExpires.Before(now) {
+				delete(ms.histories, c)
+			}
+		}
+	}
+	h, ok := ms.histories[channel]
+	if !ok || h.seqExpires.Before(now) {
+		return nil
+	}
+	if h.expires.Before(now) {
+		h.entries = nil
+	}
+	return h
+}
+
+func (ms *memoryStore) AppendHistory(channel string, data string, size int, ttl time.Duration, seqTTL time.Duration) (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	h := ms.history(channel, now)
+	if h == nil {
+		h = &memoryHistory{}
+		ms.histories[channel] = h
+	}
+	h.seq++
+	h.entries = append(h.entries, HistoryEntry{Seq: h.seq, Data: data})
+	if len(h.entries) > size {
+		h.entries = append([]HistoryEntry{}, h.entries[len(h.entries)-size:]...)
+	}
+	h.expires = now.Add(ttl)
+	h.seqExpires = now.Add(seqTTL)
+	return h.seq, nil
+}
+
+func (ms *memoryStore) History(channel string, after int64) ([]HistoryEntry, int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	h := ms.history(channel, time.Now())
+	if h == nil {
+		return nil, 0, nil
+	}
+	var entries []HistoryEntry
+	for _, entry := range h.entries {
+		if entry.Seq > after {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, h.seq, nil
+}
+
+func (ms *memoryStore) ClaimIdempotencyKey(appId string, key string, value string, ttl time.Duration) (bool, string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	if now.Sub(ms.lastIdempotencySweep) > MEMORY_STORE_SWEEP_INTERVAL {
+		ms.lastIdempotencySweep = now
+		for k, v := range ms.idempotencyKeys {
+			if v.expires.Before(now) {
+				delete(ms.idempotencyKeys, k)
+			}
+		}
+	}
+	k := idempotencyKey(appId, key)
+	if existing, ok := ms.idempotencyKeys[k]; ok && existing.expires.After(now) {
+		return false, existing.value, nil
+	}
+	ms.idempotencyKeys[k] = &memoryValue{value: value, expires: now.Add(ttl)}
+	return true, "", nil
+}
+
+func (ms *memoryStore) SaveIdempotentResult(appId string, key string, result string, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.idempotencyKeys[idempotencyKey(appId, key)] = &memoryValue{value: result, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (ms *memoryStore) ReleaseIdempotencyKey(appId string, key string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	delete(ms.idempotencyKeys, idempotencyKey(appId, key))
+	return nil
+}
+
+// presenseSnapshot copies the channels members, it expects the lock to be held
+func (ms *memoryStore) presenseSnapshot(channel string) map[string]string {
+	members := make(map[string]string, len(ms.members[channel]))
+	for userId, userData := range ms.members[channel] {
+		members[userId] = userData
+	}
+	return members
+}
+
+func (ms *memoryStore) PresenceJoin(channel string, userId string, userData string) (int64, map[string]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.members[channel] == nil {
+		ms.members[channel] = make(map[string]string)
+		ms.memberCounts[channel] = make(map[string]int64)
+	}
+	ms.members[channel][userId] = userData
+	ms.memberCounts[channel][userId]++
+	return ms.memberCounts[channel][userId], ms.presenseSnapshot(channel), nil
+}
+
+func (ms *memoryStore) PresenceLeave(channel string, userId string) (int64, map[string]string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	count := ms.memberCounts[channel][userId] - 1
+	if count <= 0 {
+		count = 0
+		delete(ms.members[channel], userId)
+		delete(ms.memberCounts[channel], userId)
+		if len(ms.members[channel]) == 0 {
+			delete(ms.members, channel)
+			delete(ms.memberCounts, channel)
+		}
+	} else {
+		ms.memberCounts[channel][userId] = count
+	}
+	return count, ms.presenseSnapshot(channel), nil
+}
+
+// expire sets when a key goes and sweeps gone keys now and then, it
+// expects the lock to be held
+func (ms *memoryStore) expire(key string, ttl time.Duration) {
+	now := time.Now()
+	ms.expires[key] = now.Add(ttl)
+	if now.Sub(ms.lastSweep) < MEMORY_STORE_SWEEP_INTERVAL {
+		return
+	}
+	ms.lastSweep = now
+	for key, at := range ms.expires {
+		if at.Before(now) {
+			ms.removeExpired(key)
+		}
+	}
+}
+
+// expired removes the key if it has gone, it expects the lock to be held
+func (ms *memoryStore) expired(key string) bool {
+	if at, ok := ms.expires[key]; ok && at.Before(time.Now()) {
+		ms.removeExpired(key)
+		return true
+	}
+	return false
+}
+
+func (ms *memoryStore) removeExpired(key string) {
+	delete(ms.expires, key)
+	delete(ms.statCounts, key)
+	delete(ms.statUsers, key)
+}
+
+func (ms *memoryStore) IncrStat(key string, n int64, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.expired(key)
+	ms.statCounts[key] += n
+	ms.expire(key, ttl)
+	return nil
+}
+
+func (ms *memoryStore) AddStatUsers(key string, userIds []string, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if ms.expired(key) || ms.statUsers[key] == nil {
+		ms.statUsers[key] = make(map[string]bool)
+	}
+	for _, userId := range userIds {
+		ms.statUsers[key][userId] = true
+	}
+	ms.expire(key, ttl)
+	return nil
+}
+
+func (ms *memoryStore) StatCounts(keys ...string) ([]int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	counts := make([]int64, len(keys))
+	for idx, key := range keys {
+		if !ms.expired(key) {
+			counts[idx] = ms.statCounts[key]
+		}
+	}
+	return counts, nil
+}
+
+func (ms *memoryStore) StatUsers(keys ...string) ([]int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	counts := make([]int64, len(keys))
+	for idx, key := range keys {
+		if !ms.expired(key) {
+			counts[idx] = int64(len(ms.statUsers[key]))
+		}
+	}
+	return counts, nil
+}
+
+func (ms *memoryStore) SaveNodeConnections(nodeId string, connections map[string]int64, ttl time.Duration) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	node := &memoryNode{connections: make(map[string]int64, len(connections)), expires: time.Now().Add(ttl)}
+	for field, n := range connections {
+		node.connections[field] = n
+	}
+	ms.nodes[nodeId] = node
+	return nil
+}
+
+func (ms *memoryStore) NodeConnections(field string) (map[string]int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	now := time.Now()
+	nodes := make(map[string]int64)
+	for nodeId, node := range ms.nodes {
+		if node.expires.Before(now) {
+			delete(ms.nodes, nodeId)
+			continue
+		}
+		if n, ok := node.connections[field]; ok {
+			nodes[nodeId] = n
+		}
+	}
+	return nodes, nil
+}
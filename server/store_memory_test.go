@@ -0,0 +1,156 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePresence(t *testing.T) {
+	ms := newMemoryStore()
+	count, members, _ := ms.PresenceJoin("presence-room", "1", `{"name":"a"}`)
+	if count != 1 || len(members) != 1 || members["1"] != `{"name":"a"}` {
+		t.Fatalf("unexpected join %d %v", count, members)
+	}
+	// a second socket for the same user
+	if count, _, _ = ms.PresenceJoin("presence-room", "1", `{"name":"a"}`); count != 2 {
+		t.Errorf("expected 2 sockets got %d", count)
+	}
+	if count, members, _ = ms.PresenceJoin("presence-room", "2", `{}`); count != 1 || len(members) != 2 {
+		t.Errorf("expected two members got %d %v", count, members)
+	}
+	if count, members, _ = ms.PresenceLeave("presence-room", "1"); count != 1 || len(members) != 2 {
+		t.Errorf("expected user 1 to stay with a socket left, got %d %v", count, members)
+	}
+	if count, members, _ = ms.PresenceLeave("presence-room", "1"); count != 0 || len(members) != 1 {
+		t.Errorf("expected user 1 to leave, got %d %v", count, members)
+	}
+	// leaving again is harmless
+	if count, members, _ = ms.PresenceLeave("presence-room", "1"); count != 0 || len(members) != 1 {
+		t.Errorf("expected nothing to change, got %d %v", count, members)
+	}
+}
+
+func TestMemoryStoreWebhookRetries(t *testing.T) {
+	ms := newMemoryStore()
+	now := time.Now()
+	ms.QueueWebhookRetry("soon", now.Add(-time.Second))
+	ms.QueueWebhookRetry("later", now.Add(time.Minute))
+	claimed, _ := ms.ClaimWebhookRetries(now)
+	if len(claimed) != 1 || claimed[0] != "soon" {
+		t.Fatalf("expected only soon to be due got %v", claimed)
+	}
+	if claimed, _ = ms.ClaimWebhookRetries(now); len(claimed) != 0 {
+		t.Errorf("expected a delivery to be claimed once, got %v", claimed)
+	}
+	if claimed, _ = ms.ClaimWebhookRetries(now.Add(2 * time.Minute)); len(claimed) != 1 || claimed[0] != "later" {
+		t.Errorf("expected later to be due got %v", claimed)
+	}
+}
+
+func TestMemoryStoreWebhookHistory(t *testing.T) {
+	ms := newMemoryStore()
+	for _, data := range []string{"1", "2", "3"} {
+		ms.LogWebhookAttempt("app", data, 2)
+	}
+	if attempts, _ := ms.WebhookAttempts("app"); len(attempts) != 2 || attempts[0] != "3" || attempts[1] != "2" {
+		t.Errorf("expected the newest two attempts got %v", attempts)
+	}
+
+	ms.DeadLetterWebhook("app", "a", 2)
+	ms.DeadLetterWebhook("app", "b", 2)
+	if removed, _ := ms.RemoveDeadLetteredWebhook("app", "a"); !removed {
+		t.Error("expected a to be removed")
+	}
+	if removed, _ := ms.RemoveDeadLetteredWebhook("app", "a"); removed {
+		t.Error("expected a to be removed only once")
+	}
+	if list, _ := ms.DeadLetteredWebhooks("app"); len(list) != 1 || list[0] != "b" {
+		t.Errorf("expected only b left got %v", list)
+	}
+	// kept to size, dropping the oldest
+	ms.DeadLetterWebhook("app", "c", 2)
+	ms.DeadLetterWebhook("app", "d", 2)
+	if list, _ := ms.DeadLetteredWebhooks("app"); len(list) != 2 || list[0] != "c" || list[1] != "d" {
+		t.Errorf("expected c and d left got %v", list)
+	}
+}
+
+func TestMemoryStoreStats(t *testing.T) {
+	ms := newMemoryStore()
+	st := newStats(ms, "node")
+	st.connectionOpened("app")
+	st.message("app")
+	st.message("app")
+	st.user("app", "1")
+	st.user("app", "1")
+	st.user("app", "2")
+	st.dropped("app")
+	st.flush()
+
+	res := lookupStatsResolution("minute")
+	now := time.Now()
+	buckets, err := st.buckets("app/app", res, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Connects != 1 || buckets[0].Messages != 2 || buckets[0].Users != 2 || buckets[0].Dropped != 1 {
+		t.Errorf("unexpected buckets %+v", buckets[0])
+	}
+	if nodes := st.nodeConnections("app"); nodes["node"] != 1 {
+		t.Errorf("expected one connection on node got %v", nodes)
+	}
+
+	// expired stats and nodes are gone
+	ms.IncrStat("gone", 1, -time.Second)
+	if counts, _ := ms.StatCounts("gone"); counts[0] != 0 {
+		t.Errorf("expected the stat to have expired got %d", counts[0])
+	}
+	ms.SaveNodeConnections("dead", map[string]int64{"app": 5}, -time.Second)
+	if nodes := st.nodeConnections("app"); len(nodes) != 1 {
+		t.Errorf("expected the dead node to be skipped got %v", nodes)
+	}
+}
+
+func TestMemoryStoreApps(t *testing.T) {
+	ms := newMemoryStore()
+	ms.SaveApp("app", &AppSettings{Name: "test", EnableClientEvents: true})
+	if settings, _ := ms.LoadApp("app"); settings.Name != "test" || !settings.EnableClientEvents {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	ms.DeleteApp("app")
+	if settings, _ := ms.LoadApp("app"); settings.Name != "" {
+		t.Errorf("expected empty settings for a deleted app got %+v", settings)
+	}
+
+	hook := &Webhook{Id: "hook", AppId: "app", Url: "http://localhost"}
+	ms.SaveWebhook(hook)
+	if ids, _ := ms.AppWebhookIds("app"); len(ids) != 1 || ids[0] != "hook" {
+		t.Errorf("expected the webhook to be listed got %v", ids)
+	}
+	ms.DeleteWebhook(hook)
+	if loaded, _ := ms.LoadWebhook("hook"); loaded != nil {
+		t.Errorf("expected the webhook to be gone got %+v", loaded)
+	}
+}
+
+func TestMemoryStoreIdempotencyKeys(t *testing.T) {
+	ms := newMemoryStore()
+	if claimed, _, _ := ms.ClaimIdempotencyKey("app", "k", "pending", time.Minute); !claimed {
+		t.Fatalf("expected to claim a new key")
+	}
+	if claimed, existing, _ := ms.ClaimIdempotencyKey("app", "k", "pending", time.Minute); claimed || existing != "pending" {
+		t.Errorf("expected the key to be taken got %v %s", claimed, existing)
+	}
+	ms.SaveIdempotentResult("app", "k", "{}", time.Minute)
+	if _, existing, _ := ms.ClaimIdempotencyKey("app", "k", "pending", time.Minute); existing != "{}" {
+		t.Errorf("expected the result got %s", existing)
+	}
+	ms.ReleaseIdempotencyKey("app", "k")
+	if claimed, _, _ := ms.ClaimIdempotencyKey("app", "k", "pending", -time.Second); !claimed {
+		t.Errorf("expected a released key to be claimed again")
+	}
+	// that one expired straight away
+	if claimed, _, _ := ms.ClaimIdempotencyKey("app", "k", "pending", time.Minute); !claimed {
+		t.Errorf("expected an expired key to be claimed again")
+	}
+}
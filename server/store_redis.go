@@ -0,0 +1,476 @@
+package server
+
+import (
+	"fmt"
+	"github.com/screencloud/subhub/xredis"
+	"strconv"
+	"time"
+)
+
+// redisStore keeps the shared state in redis, see the REDIS_ key formats
+type redisStore struct {
+	redis *xredis.Redis
+}
+
+func newRedisStore(redis *xredis.Redis) *redisStore {
+	return &redisStore{redis: redis}
+}
+
+func (rs *redisStore) LoadApp(appId string) (*AppSettings, error) {
+	settings := &AppSettings{}
+	err := rs.redis.HGetAllJSON(appKey(appId), settings)
+	return settings, err
+}
+
+func (rs *redisStore) SaveApp(appId string, settings *AppSettings) error {
+	return rs.redis.HMSetJSON(appKey(appId), settings)
+}
+
+func (rs *redisStore) DeleteApp(appId string) error {
+	_, err := rs.redis.Del(appKey(appId))
+	return err
+}
+
+func (rs *redisStore) AppExists(appId string) (bool, error) {
+	return rs.redis.Exists(appKey(appId))
+}
+
+func (rs *redisStore) SaveAuthSecret(key string, secret string) error {
+	_, err := rs.redis.HSet(REDIS_AUTH_KEYS, key, secret)
+	return err
+}
+
+func (rs *redisStore) AuthSecret(key string) (string, error) {
+	secret, err := rs.redis.HGet(REDIS_AUTH_KEYS, key)
+	return string(secret), err
+}
+
+func (rs *redisStore) SaveAuthKeyApp(key string, appId string) error {
+	_, err := rs.redis.HSet(REDIS_AUTH_KEY_APPS, key, appId)
+	return err
+}
+
+func (rs *redisStore) AuthKeyApp(key string) (string, error) {
+	appId, err := rs.redis.HGet(REDIS_AUTH_KEY_APPS, key)
+	return string(appId), err
+}
+
+func (rs *redisStore) SaveWebhook(hook *Webhook) error {
+	if err := rs.redis.HMSetJSON(webhookKey(hook.Id), hook); err != nil {
+		return err
+	}
+	_, err := rs.redis.SAdd(appWebhooksKey(hook.AppId), hook.Id)
+	return err
+}
+
+func (rs *redisStore) LoadWebhook(webhookId string) (*Webhook, error) {
+	hook := &Webhook{}
+	if err := rs.redis.HGetAllJSON(webhookKey(webhookId), hook); err != nil {
+		return nil, err
+	}
+	if hook.Id == "" {
+		return nil, nil // doesnt exist
+	}
+	return hook, nil
+}
+
+func (rs *redisStore) DeleteWebhook(hook *Webhook) error {
+	if _, err := rs.redis.SRem(appWebhooksKey(hook.AppId), hook.Id); err != nil {
+		return err
+	}
+	_, err := rs.redis.Del(webhookKey(hook.Id))
+	return err
+}
+
+func (rs *redisStore) AppWebhookIds(appId string) ([]string, error) {
+	return rs.redis.SMembers(appWebhooksKey(appId))
+}
+
+func (rs *redisStore) SetChannelApp(channel string, appId string) error {
+	return rs.redis.SimpleSet(fmt.Sprintf(REDIS_CHANNEL_APP, channel), appId)
+}
+
+func (rs *redisStore) ChannelApp(channel string) (string, error) {
+	data, err := rs.redis.Get(fmt.Sprintf(REDIS_CHANNEL_APP, channel))
+	return string(data), err
+}
+
+// the retry queue is a sorted set scored by when each delivery is next due,
+// so that any node can pick it up
+func (rs *redisStore) QueueWebhookRetry(data string, due time.Time) error {
+	_, err := rs.redis.ZAdd(REDIS_WEBHOOK_RETRY_ZSET, map[string]float64{
+		data: float64(due.UnixNano() / int64(time.Millisecond)),
+	})
+	return err
+}
+
+func (rs *redisStore) ClaimWebhookRetries(now time.Time) ([]string, error) {
+	max := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	due, err := rs.redis.ZRangeByScore(REDIS_WEBHOOK_RETRY_ZSET, "-inf", max, false, false, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make([]string, 0, len(due))
+	for _, data := range due {
+		// only the node that manages to remove it gets to send it
+		if n, err := rs.redis.ZRem(REDIS_WEBHOOK_RETRY_ZSET, data); err != nil || n == 0 {
+			continue
+		}
+		claimed = append(claimed, data)
+	}
+	return claimed, nil
+}
+
+func (rs *redisStore) LogWebhookAttempt(appId string, data string, size int) error {
+	key := webhookLogKey(appId)
+	if _, err := rs.redis.LPush(key, data); err != nil {
+		return err
+	}
+	return rs.redis.LTrim(key, 0, size-1)
+}
+
+func (rs *redisStore) WebhookAttempts(appId string) ([]string, error) {
+	return rs.redis.LRange(webhookLogKey(appId), 0, -1)
+}
+
+func (rs *redisStore) DeadLetterWebhook(appId string, data string, size int) error {
+	key := webhookFailedKey(appId)
+	if _, err := rs.redis.RPush(key, data); err != nil {
+		return err
+	}
+	return rs.redis.LTrim(key, -size, -1)
+}
+
+func (rs *redisStore) DeadLetteredWebhooks(appId string) ([]string, error) {
+	return rs.redis.LRange(webhookFailedKey(appId), 0, -1)
+}
+
+func (rs *redisStore) RemoveDeadLetteredWebhook(appId string, data string) (bool, error) {
+	n, err := rs.redis.LRem(webhookFailedKey(appId), 1, data)
+	return n > 0, err
+}
+
+// the presence scripts run atomically on the master, so concurrent joins and
+// leaves on a channel each see a consistent member list and refcount
+// KEYS[1] members hash, KEYS[2] member counts hash, ARGV[1] user id, ARGV[2] user data
+// both return {sockets the user has left on the channel, all the members}
+var (
+	presenseJoinScript = xredis.NewScript(2, `
+local count = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return {count, redis.call('HGETALL', KEYS[1])}
+`)
+	presenseLeaveScript = xredis.NewScript(2, `
+local count = redis.call('HINCRBY', KEYS[2], ARGV[1], -1)
+if count <= 0 then
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	count = 0
+end
+return {count, redis.call('HGETALL', KEYS[1])}
+`)
+)
+
+func presenseReply(reply interface{}, err error) (int64, map[string]string, error) {
+	values, err := xredis.ValuesReply(reply)
+	if err == nil && len(values) != 2 {
+		err = fmt.Errorf("unexpected presence script reply %v", values)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	count, err := xredis.IntegerReply(values[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	members, err := xredis.MapReply(values[1])
+	return count, members, err
+}
+
+func (rs *redisStore) PresenceJoin(channel string, userId string, userData string) (int64, map[string]string, error) {
+	membersKey, countsKey := presenseKeys(channel)
+	return presenseReply(rs.redis.Eval(presenseJoinScript, membersKey, countsKey, userId, userData))
+}
+
+func (rs *redisStore) PresenceLeave(channel string, userId string) (int64, map[string]string, error) {
+	membersKey, countsKey := presenseKeys(channel)
+	return presenseReply(rs.redis.Eval(presenseLeaveScript, membersKey, countsKey, userId))
+}
+
+// KEYS[1] seq, KEYS[2] history zset, ARGV[1] message, ARGV[2] size, ARGV[3]
+// history ttl and ARGV[4] seq ttl in seconds, returns the messages seq
+var historyAppendScript = xredis.NewScript(2, `
+local seq = redis.call('INCR', KEYS[1])
+redis.call('ZADD', KEYS[2], seq, ARGV[1])
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+return seq
+`)
+
+// KEYS[1] seq, KEYS[2] history zset, ARGV[1] seq to read after
+// returns {latest seq, messages and their seqs}
+var historyReadScript = xredis.NewScript(2, `
+local seq = tonumber(redis.call('GET', KEYS[1]) or '0')
+return {seq, redis.call('ZRANGEBYSCORE', KEYS[2], '(' .. ARGV[1], '+inf', 'WITHSCORES')}
+`)
+
+func (rs *redisStore) AppendHistory(channel string, data string, size int, ttl time.Duration, seqTTL time.Duration) (int64, error) {
+	seqKey, historyKey := historyKeys(channel)
+	reply, err := rs.redis.Eval(historyAppendScript, seqKey, historyKey, data,
+		strconv.Itoa(size), strconv.Itoa(int(ttl/time.Second)), strconv.Itoa(int(seqTTL/time.Second)))
+	if err != nil {
+		return 0, err
+	}
+	return xredis.IntegerReply(reply)
+}
+
+func (rs *redisStore) History(channel string, after int64) ([]HistoryEntry, int64, error) {
+	seqKey, historyKey := historyKeys(channel)
+	reply, err := rs.redis.Eval(historyReadScript, seqKey, historyKey, strconv.FormatInt(after, 10))
+	if err != nil {
+		return nil, 0, err
+	}
+	values, err := xredis.ValuesReply(reply)
+	if err == nil && len(values) != 2 {
+		err = fmt.Errorf("unexpected history script reply %v", values)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	latest, err := xredis.IntegerReply(values[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	scored, err := xredis.StringsReply(values[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]HistoryEntry, 0, len(scored)/2)
+	for idx := 0; idx+1 < len(scored); idx += 2 {
+		seq, _ := strconv.ParseInt(scored[idx+1], 10, 64)
+		entries = append(entries, HistoryEntry{Seq: seq, Data: scored[idx]})
+	}
+	return entries, latest, nil
+}
+
+// each client written to is scored in the expiry set by when it goes, the
+// hash itself is kept for twice as long so the expiry can still read it
+func (rs *redisStore) WritePendingDeliveries(writes []*PendingWrite, ttl time.Duration) error {
+	expires := strconv.FormatInt(time.Now().Add(ttl).UnixNano()/int64(time.Millisecond), 10)
+	keepFor := strconv.Itoa(int(2 * ttl / time.Second))
+	pl := rs.redis.Pipeline()
+	for _, write := range writes {
+		key := clientPendingKey(write.AppId, write.ClientId)
+		if write.Data == "" {
+			pl.Command("HDEL", key, write.Id)
+			continue
+		}
+		pl.Command("HSET", key, write.Id, write.Data)
+		pl.Command("EXPIRE", key, keepFor)
+		pl.Command("ZADD", REDIS_PENDING_EXPIRY_ZSET, expires, key)
+	}
+	replies, err := pl.Exec()
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisStore) PendingDeliveries(appId string, clientId string) (map[string]string, error) {
+	return rs.redis.HGetAll(clientPendingKey(appId, clientId))
+}
+
+// KEYS[1] pending hash, KEYS[2] expiry zset, returns the deliveries if this
+// caller removed the hash from the expiry set
+var pendingExpireScript = xredis.NewScript(2, `
+if redis.call('ZREM', KEYS[2], KEYS[1]) == 0 then
+	return {}
+end
+local deliveries = redis.call('HVALS', KEYS[1])
+redis.call('DEL', KEYS[1])
+return deliveries
+`)
+
+func (rs *redisStore) ExpirePendingDeliveries(now time.Time) ([]string, error) {
+	max := strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	keys, err := rs.redis.ZRangeByScore(REDIS_PENDING_EXPIRY_ZSET, "-inf", max, false, false, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]string, 0)
+	for _, key := range keys {
+		reply, err := rs.redis.Eval(pendingExpireScript, key, REDIS_PENDING_EXPIRY_ZSET)
+		if err != nil {
+			return expired, err
+		}
+		deliveries, err := xredis.StringsReply(reply)
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, deliveries...)
+	}
+	return expired, nil
+}
+
+func (rs *redisStore) LogUndelivered(appId string, data string, size int) error {
+	key := undeliveredKey(appId)
+	if _, err := rs.redis.LPush(key, data); err != nil {
+		return err
+	}
+	return rs.redis.LTrim(key, 0, size-1)
+}
+
+func (rs *redisStore) Undelivered(appId string) ([]string, error) {
+	return rs.redis.LRange(undeliveredKey(appId), 0, -1)
+}
+
+// KEYS[1] inbox list, ARGV[1] message, ARGV[2] size, ARGV[3] ttl in seconds
+var inboxPushScript = xredis.NewScript(1, `
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[2]), -1)
+return redis.call('EXPIRE', KEYS[1], ARGV[3])
+`)
+
+// KEYS[1] inbox list, returns what was in it, so only one sign in gets it
+var inboxTakeScript = xredis.NewScript(1, `
+local messages = redis.call('LRANGE', KEYS[1], 0, -1)
+redis.call('DEL', KEYS[1])
+return messages
+`)
+
+func (rs *redisStore) PushInbox(appId string, userId string, data string, size int, ttl time.Duration) error {
+	_, err := rs.redis.Eval(inboxPushScript, userInboxKey(appId, userId), data,
+		strconv.Itoa(size), strconv.Itoa(int(ttl/time.Second)))
+	return err
+}
+
+func (rs *redisStore) Inbox(appId string, userId string) ([]string, error) {
+	return rs.redis.LRange(userInboxKey(appId, userId), 0, -1)
+}
+
+func (rs *redisStore) TakeInbox(appId string, userId string) ([]string, error) {
+	reply, err := rs.redis.Eval(inboxTakeScript, userInboxKey(appId, userId))
+	if err != nil {
+		return nil, err
+	}
+	return xredis.StringsReply(reply)
+}
+
+func (rs *redisStore) ClaimIdempotencyKey(appId string, key string, value string, ttl time.Duration) (bool, string, error) {
+	err := rs.redis.Set(idempotencyKey(appId, key), value, int(ttl/time.Second), 0, false, true)
+	if err == nil {
+		return true, "", nil
+	}
+	if err != xredis.ErrNotSet {
+		return false, "", err
+	}
+	existing, err := rs.redis.Get(idempotencyKey(appId, key))
+	return false, string(existing), err
+}
+
+func (rs *redisStore) SaveIdempotentResult(appId string, key string, result string, ttl time.Duration) error {
+	return rs.redis.Setex(idempotencyKey(appId, key), int(ttl/time.Second), result)
+}
+
+func (rs *redisStore) ReleaseIdempotencyKey(appId string, key string) error {
+	_, err := rs.redis.Del(idempotencyKey(appId, key))
+	return err
+}
+
+func (rs *redisStore) IncrStat(key string, n int64, ttl time.Duration) error {
+	if _, err := rs.redis.IncrBy(key, int(n)); err != nil {
+		return err
+	}
+	_, err := rs.redis.Expire(key, int(ttl/time.Second))
+	return err
+}
+
+func (rs *redisStore) AddStatUsers(key string, userIds []string, ttl time.Duration) error {
+	if _, err := rs.redis.PFAdd(key, userIds...); err != nil {
+		return err
+	}
+	_, err := rs.redis.Expire(key, int(ttl/time.Second))
+	return err
+}
+
+func (rs *redisStore) StatCounts(keys ...string) ([]int64, error) {
+	vals, err := rs.redis.MGet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int64, len(keys))
+	for idx := range vals {
+		counts[idx], _ = strconv.ParseInt(string(vals[idx]), 10, 64)
+	}
+	return counts, nil
+}
+
+// StatUsers counts each hyperloglog on its own, PFCOUNT of several keys
+// would count their union
+func (rs *redisStore) StatUsers(keys ...string) ([]int64, error) {
+	pl := rs.redis.Pipeline()
+	for _, key := range keys {
+		pl.Command("PFCOUNT", key)
+	}
+	replies, err := pl.Exec()
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]int64, len(keys))
+	for idx, reply := range replies {
+		if counts[idx], err = xredis.IntegerReply(reply); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// KEYS[1] node connections hash, ARGV[1] ttl in seconds then field, value
+// pairs, the hash is replaced so apps the node no longer has go
+var nodeConnectionsScript = xredis.NewScript(1, `
+redis.call('DEL', KEYS[1])
+redis.call('HMSET', KEYS[1], unpack(ARGV, 2))
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+func (rs *redisStore) SaveNodeConnections(nodeId string, connections map[string]int64, ttl time.Duration) error {
+	args := []string{fmt.Sprintf(REDIS_STATS_CONNECTIONS_HASH, nodeId), strconv.Itoa(int(ttl / time.Second))}
+	for field, n := range connections {
+		args = append(args, field, strconv.FormatInt(n, 10))
+	}
+	_, err := rs.redis.Eval(nodeConnectionsScript, args...)
+	return err
+}
+
+func (rs *redisStore) NodeConnections(field string) (map[string]int64, error) {
+	nodes := make(map[string]int64)
+	pattern := fmt.Sprintf(REDIS_STATS_CONNECTIONS_HASH, "*")
+	prefix := fmt.Sprintf(REDIS_STATS_CONNECTIONS_HASH, "")
+	var cursor uint64 = 0
+	for {
+		next, keys, err := rs.redis.Scan(cursor, pattern, 100)
+		if err != nil {
+			return nodes, err
+		}
+		for _, key := range keys {
+			val, err := rs.redis.HGet(key, field)
+			if err != nil || val == nil {
+				continue
+			}
+			n, _ := strconv.ParseInt(string(val), 10, 64)
+			nodes[key[len(prefix):]] = n
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	return nodes, nil
+}
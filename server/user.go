@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A socket signs in as a user with pusher:signin, the user data is signed like
+// a channel subscription but over "<socket_id>::user::<user_data>" with a key
+// of the sockets app. Signed in sockets are put on the users own channel,
+// #server-to-user-<user id>, so the rest api can send to every socket a user
+// has by publishing to it. Clients cant subscribe to # channels themselves.
+// Users are per app, so the pubsub topic behind the channel has the app id in
+// it too, see userTopic.
+
+const SIGNIN_MESSAGE_FORMAT = "%s::user::%s"
+
+type SigninData struct {
+	Auth     string `json:"auth"`
+	UserData string `json:"user_data"`
+}
+
+type SigninSucceededData struct {
+	UserData string `json:"user_data"`
+}
+
+func userChannel(userId string) string {
+	return CHANNEL_PREFIX_USER + userId
+}
+
+func isUserChannel(channel string) bool {
+	return strings.HasPrefix(channel, CHANNEL_PREFIX_USER)
+}
+
+// userTopic is what a users sockets are subscribed to, app ids come from a url
+// path segment so cant have a / in them
+func userTopic(appId string, userId string) string {
+	return CHANNEL_PREFIX_USER + appId + "/" + userId
+}
+
+// userChannelTopic is the topic for a user channel the rest api publishes to
+func userChannelTopic(appId string, channel string) string {
+	return userTopic(appId, channel[len(CHANNEL_PREFIX_USER):])
+}
+
+// clientChannel is the channel name clients know a topic by, the app id is
+// taken back out of user topics
+func clientChannel(topic string) string {
+	if !isUserChannel(topic) {
+		return topic
+	}
+	rest := topic[len(CHANNEL_PREFIX_USER):]
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		return userChannel(rest[idx+1:])
+	}
+	return topic
+}
+
+func (s *server) handleSignin(sock *socket, auth string, userData string) {
+	if ok := s.verifyAuth(sock.appId, auth, fmt.Sprintf(SIGNIN_MESSAGE_FORMAT, sock.ID(), userData)); !ok {
+		log.Println("signin auth not ok")
+		authFailuresCounter.Inc("signin")
+		return
+	}
+	user := struct {
+		Id string `json:"id"`
+	}{}
+	if err := json.Unmarshal([]byte(userData), &user); err != nil || user.Id == "" {
+		log.Println("signin user data has no id", err)
+		return
+	}
+	if sock.userId != "" && sock.userId != user.Id {
+		s.pubsub.Unsubscribe(sock, userTopic(sock.appId, sock.userId))
+	}
+	sock.userId = user.Id
+	s.pubsub.Subscribe(sock, userTopic(sock.appId, user.Id))
+	data, _ := json.Marshal(&SigninSucceededData{UserData: userData})
+	quoted, _ := json.Marshal(string(data))
+	sock.session.Send(fmt.Sprintf(RAW_SIGNIN_SUCCEEDED, quoted))
+	s.stats.user(sock.statsApp, user.Id)
+	// only now that it is on the channel, so nothing falls in between
+	s.flushInbox(sock, user.Id)
+}
@@ -1,35 +1,58 @@
 package server
 
-func (s *server) createWebhook(appId string, url string, eventId string) {
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/screencloud/subhub/pubsub"
+	"log"
+	"net/http"
+	"time"
+)
 
-}
-
-func (s *server) disableWebhook(webhookId string) {
-
-}
-
-func (s *server) enableWebhook(webhookId string) {
-
-}
-
-func (s *server) deleteWebhook(webhookId string) {
+// channel_occupied
+// channel_vacated
+// member_added
+// member_removed
+// client_event
+const (
+	WEBHOOK_CHANNEL_OCCUPIED = "channel_occupied"
+	WEBHOOK_CHANNEL_VACATED  = "channel_vacated"
+	WEBHOOK_MEMBER_ADDED     = "member_added"
+	WEBHOOK_MEMBER_REMOVED   = "member_removed"
+	WEBHOOK_CLIENT_EVENT     = "client_event"
+)
 
+var webhookEvents = []string{
+	WEBHOOK_CHANNEL_OCCUPIED,
+	WEBHOOK_CHANNEL_VACATED,
+	WEBHOOK_MEMBER_ADDED,
+	WEBHOOK_MEMBER_REMOVED,
+	WEBHOOK_CLIENT_EVENT,
 }
 
-func (s *server) listWebhooks(appId string) {
-
-}
+const REDIS_WEBHOOK_HASH = "subhub://webhook/%s"
+const REDIS_APP_WEBHOOKS_SET = "subhub://app/%s/webhooks"
+const REDIS_WEBHOOK_RETRY_ZSET = "subhub://webhooks/retry"
+const REDIS_CHANNEL_APP = "subhub://channel/%s/app"
 
-func (s *server) callWebhooks(appId string, eventId string) {
+const (
+	WEBHOOK_BATCH_INTERVAL    = time.Second      // events are batched up for this long before sending
+	WEBHOOK_TIMEOUT           = 5 * time.Second  // how long we wait for the endpoint to respond
+	WEBHOOK_RETRY_BACKOFF     = 2 * time.Second  // first retry delay, doubled on each attempt
+	WEBHOOK_RETRY_MAX_BACKOFF = 10 * time.Minute // cap on the retry delay
+	WEBHOOK_MAX_ATTEMPTS      = 10               // give up after this many attempts
+)
 
+type Webhook struct {
+	Id      string `json:"id"`
+	AppId   string `json:"app_id"`
+	Url     string `json:"url"`
+	Event   string `json:"event"` // empty means all events
+	Key     string `json:"key"`   // auth key used to sign the payload
+	Enabled bool   `json:"enabled"`
 }
 
-// channel_occupied
-// channel_vacated
-// member_added
-// member_removed
-// client_event
-
 //{
 //  "name": "client_event",
 //  "channel": "name of the channel the event was published on",
@@ -39,6 +62,15 @@ func (s *server) callWebhooks(appId string, eventId string) {
 //  "user_id": "user_id associated with the sending socket" # Only for presence channels
 //}
 
+type WebhookEvent struct {
+	Name     string `json:"name"`
+	Channel  string `json:"channel"`
+	Event    string `json:"event,omitempty"`
+	Data     string `json:"data,omitempty"`
+	SocketId string `json:"socket_id,omitempty"`
+	UserId   string `json:"user_id,omitempty"`
+}
+
 //{
 //  "time_ms": 1327078148132
 //  "events": [
@@ -46,5 +78,285 @@ func (s *server) callWebhooks(appId string, eventId string) {
 //  ]
 //}
 
-//X-Pusher-Key: A Pusher app may have multiple tokens. The oldest active token will be used, identified by this key.
-//X-Pusher-Signature: A HMAC SHA256 hex digest formed by signing the POST payload (body) with the token’s secret.
+type WebhookPayload struct {
+	TimeMs int64           `json:"time_ms"`
+	Events []*WebhookEvent `json:"events"`
+}
+
+// a single signed POST of a payload to a webhook, kept in redis while it is being retried
+type webhookDelivery struct {
+	Id        string `json:"id"`
+	WebhookId string `json:"webhook_id"`
+	AppId     string `json:"app_id"`
+	Attempt   int    `json:"attempt"`
+	Body      string `json:"body"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+var webhookClient = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+func webhookKey(webhookId string) string {
+	return fmt.Sprintf(REDIS_WEBHOOK_HASH, webhookId)
+}
+
+func appWebhooksKey(appId string) string {
+	return fmt.Sprintf(REDIS_APP_WEBHOOKS_SET, appId)
+}
+
+func isWebhookEvent(eventId string) bool {
+	for _, e := range webhookEvents {
+		if e == eventId {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) createWebhook(appId string, url string, eventId string, key string) *Webhook {
+	hook := &Webhook{
+		Id:      newId(),
+		AppId:   appId,
+		Url:     url,
+		Event:   eventId,
+		Key:     key,
+		Enabled: true,
+	}
+	log.Println("create webhook", hook.Id, appId, url, eventId)
+	err := s.store.SaveWebhook(hook)
+	if err != nil {
+		log.Println("problem saving webhook", err)
+		return nil
+	}
+	return hook
+}
+
+func (s *server) loadWebhook(webhookId string) *Webhook {
+	hook, err := s.store.LoadWebhook(webhookId)
+	if err != nil {
+		log.Println("error fetching webhook", err)
+		return nil
+	}
+	return hook
+}
+
+func (s *server) setWebhookEnabled(webhookId string, enabled bool) *Webhook {
+	hook := s.loadWebhook(webhookId)
+	if hook == nil {
+		return nil
+	}
+	hook.Enabled = enabled
+	err := s.store.SaveWebhook(hook)
+	if err != nil {
+		log.Println("problem saving webhook", err)
+	}
+	return hook
+}
+
+func (s *server) disableWebhook(webhookId string) *Webhook {
+	return s.setWebhookEnabled(webhookId, false)
+}
+
+func (s *server) enableWebhook(webhookId string) *Webhook {
+	return s.setWebhookEnabled(webhookId, true)
+}
+
+func (s *server) deleteWebhook(webhookId string) {
+	hook := s.loadWebhook(webhookId)
+	if hook == nil {
+		return
+	}
+	err := s.store.DeleteWebhook(hook)
+	if err != nil {
+		log.Println("error deleting webhook", err)
+	}
+}
+
+func (s *server) listWebhooks(appId string) []*Webhook {
+	hooks := make([]*Webhook, 0)
+	ids, err := s.store.AppWebhookIds(appId)
+	if err != nil {
+		log.Println("error listing webhooks", err)
+		return hooks
+	}
+	for _, id := range ids {
+		if hook := s.loadWebhook(id); hook != nil {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// callWebhooks queues the event, it is sent with the rest of the apps batch
+func (s *server) callWebhooks(appId string, event *WebhookEvent) {
+	if appId == "" {
+		return
+	}
+	s.webhookLock.Lock()
+	s.webhookBatch[appId] = append(s.webhookBatch[appId], event)
+	s.webhookLock.Unlock()
+}
+
+// handleOccupancy sends channel_occupied and channel_vacated as pubsub sees
+// channels change across the cluster. The app is remembered against the
+// channel for when the vacating subscriber is no longer around to ask.
+func (s *server) handleOccupancy(sub pubsub.Subscriber, channel string, occupied bool) {
+	appId := ""
+	if sock, ok := sub.(*socket); ok {
+		appId = sock.appId
+	} else if channelAppId, err := s.store.ChannelApp(channel); err == nil {
+		appId = channelAppId
+	}
+	if occupied {
+		s.store.SetChannelApp(channel, appId)
+		s.callWebhooks(appId, &WebhookEvent{Name: WEBHOOK_CHANNEL_OCCUPIED, Channel: clientChannel(channel)})
+	} else {
+		s.callWebhooks(appId, &WebhookEvent{Name: WEBHOOK_CHANNEL_VACATED, Channel: clientChannel(channel)})
+	}
+}
+
+func (s *server) webhookLoop() {
+	ticker := time.NewTicker(WEBHOOK_BATCH_INTERVAL)
+	for range ticker.C {
+		s.flushWebhooks()
+		s.retryWebhooks()
+	}
+}
+
+func (s *server) flushWebhooks() {
+	s.webhookLock.Lock()
+	batch := s.webhookBatch
+	s.webhookBatch = make(map[string][]*WebhookEvent)
+	s.webhookLock.Unlock()
+
+	for appId, events := range batch {
+		for _, hook := range s.listWebhooks(appId) {
+			if !hook.Enabled {
+				continue
+			}
+			payload := &WebhookPayload{
+				TimeMs: time.Now().UnixNano() / int64(time.Millisecond),
+				Events: make([]*WebhookEvent, 0, len(events)),
+			}
+			for _, event := range events {
+				if hook.Event == "" || hook.Event == event.Name {
+					payload.Events = append(payload.Events, event)
+				}
+			}
+			if len(payload.Events) == 0 {
+				continue
+			}
+			body, err := json.Marshal(payload)
+			if err != nil {
+				log.Println("unable to marshal webhook payload", err)
+				continue
+			}
+			delivery := &webhookDelivery{
+				Id:        newId(),
+				WebhookId: hook.Id,
+				AppId:     appId,
+				Body:      string(body),
+			}
+			go s.deliverWebhook(delivery)
+		}
+	}
+}
+
+// X-Pusher-Key: A Pusher app may have multiple tokens. The oldest active token will be used, identified by this key.
+// X-Pusher-Signature: A HMAC SHA256 hex digest formed by signing the POST payload (body) with the token’s secret.
+func (s *server) deliverWebhook(delivery *webhookDelivery) {
+	hook := s.loadWebhook(delivery.WebhookId)
+	if hook == nil {
+		log.Println("webhook gone, dropping delivery", delivery.Id)
+		return
+	}
+	if !hook.Enabled {
+		// keep it around so it can be replayed once the webhook is enabled again
+		delivery.LastError = "webhook disabled"
+		s.deadLetterWebhook(delivery)
+		return
+	}
+	// never sign with an empty secret, anyone could forge that
+	secret, err := s.lookupAuthSecret(hook.Key)
+	if err != nil || secret == "" {
+		log.Println("unable to lookup webhook secret", hook.Id, err)
+		delivery.LastError = "unknown webhook key"
+		s.deadLetterWebhook(delivery)
+		return
+	}
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewBufferString(delivery.Body))
+	if err != nil {
+		log.Println("invalid webhook request", err)
+		delivery.LastError = err.Error()
+		s.deadLetterWebhook(delivery)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pusher-Key", hook.Key)
+	req.Header.Set("X-Pusher-Signature", hmacSha256HexSignature([]byte(delivery.Body), []byte(secret)))
+
+	t := time.Now()
+	statusCode := 0
+	resp, err := webhookClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		statusCode = resp.StatusCode
+		if statusCode < 200 || statusCode >= 300 {
+			err = fmt.Errorf("webhook responded with %d", statusCode)
+		}
+	}
+	s.logWebhookAttempt(hook, delivery, statusCode, time.Since(t), err)
+	if err == nil {
+		return
+	}
+	log.Println("webhook delivery failed", delivery.Id, err)
+	delivery.LastError = err.Error()
+	s.scheduleWebhookRetry(delivery)
+}
+
+func webhookBackoff(attempt int) time.Duration {
+	backoff := WEBHOOK_RETRY_BACKOFF
+	for i := 1; i < attempt && backoff < WEBHOOK_RETRY_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_RETRY_MAX_BACKOFF {
+		backoff = WEBHOOK_RETRY_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// scheduleWebhookRetry puts the delivery in the retry queue, any node can pick
+// it up once it is due
+func (s *server) scheduleWebhookRetry(delivery *webhookDelivery) {
+	delivery.Attempt++
+	if delivery.Attempt >= WEBHOOK_MAX_ATTEMPTS {
+		log.Println("webhook delivery out of attempts", delivery.Id)
+		s.deadLetterWebhook(delivery)
+		return
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println("unable to marshal webhook delivery", err)
+		return
+	}
+	due := time.Now().Add(webhookBackoff(delivery.Attempt))
+	err = s.store.QueueWebhookRetry(string(data), due)
+	if err != nil {
+		log.Println("problem queueing webhook retry", err)
+	}
+}
+
+func (s *server) retryWebhooks() {
+	due, err := s.store.ClaimWebhookRetries(time.Now())
+	if err != nil {
+		log.Println("problem reading webhook retries", err)
+		return
+	}
+	for _, data := range due {
+		delivery := &webhookDelivery{}
+		if err := json.Unmarshal([]byte(data), delivery); err != nil {
+			log.Println("error decoding webhook retry", err)
+			continue
+		}
+		go s.deliverWebhook(delivery)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const REDIS_APP_WEBHOOK_LOG_LIST = "subhub://app/%s/webhooks/log"
+const REDIS_APP_WEBHOOK_FAILED_LIST = "subhub://app/%s/webhooks/failed"
+
+const (
+	WEBHOOK_LOG_SIZE    = 1000 // attempts kept per app, newest first
+	WEBHOOK_FAILED_SIZE = 1000 // dead lettered deliveries kept per app, the oldest go first
+)
+
+type WebhookAttempt struct {
+	DeliveryId string `json:"delivery_id"`
+	WebhookId  string `json:"webhook_id"`
+	Url        string `json:"url"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"` // zero when no response was received
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+	TimeMs     int64  `json:"time_ms"`
+}
+
+func webhookLogKey(appId string) string {
+	return fmt.Sprintf(REDIS_APP_WEBHOOK_LOG_LIST, appId)
+}
+
+func webhookFailedKey(appId string) string {
+	return fmt.Sprintf(REDIS_APP_WEBHOOK_FAILED_LIST, appId)
+}
+
+func (s *server) logWebhookAttempt(hook *Webhook, delivery *webhookDelivery, statusCode int, latency time.Duration, err error) {
+	attempt := &WebhookAttempt{
+		DeliveryId: delivery.Id,
+		WebhookId:  hook.Id,
+		Url:        hook.Url,
+		Attempt:    delivery.Attempt + 1,
+		StatusCode: statusCode,
+		LatencyMs:  int64(latency / time.Millisecond),
+		TimeMs:     time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	data, err := json.Marshal(attempt)
+	if err != nil {
+		log.Println("unable to marshal webhook attempt", err)
+		return
+	}
+	if err = s.store.LogWebhookAttempt(delivery.AppId, string(data), WEBHOOK_LOG_SIZE); err != nil {
+		log.Println("problem logging webhook attempt", err)
+	}
+}
+
+func (s *server) listWebhookAttempts(appId string) []*WebhookAttempt {
+	attempts := make([]*WebhookAttempt, 0)
+	list, err := s.store.WebhookAttempts(appId)
+	if err != nil {
+		log.Println("error reading webhook log", err)
+		return attempts
+	}
+	for _, data := range list {
+		attempt := &WebhookAttempt{}
+		if err := json.Unmarshal([]byte(data), attempt); err != nil {
+			log.Println("error decoding webhook attempt", err)
+			continue
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
+
+// deadLetterWebhook parks a delivery that wont be retried any more, it stays
+// there until it is redelivered by hand or WEBHOOK_FAILED_SIZE newer ones push
+// it out
+func (s *server) deadLetterWebhook(delivery *webhookDelivery) {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Println("unable to marshal webhook delivery", err)
+		return
+	}
+	if err = s.store.DeadLetterWebhook(delivery.AppId, string(data), WEBHOOK_FAILED_SIZE); err != nil {
+		log.Println("problem dead lettering webhook delivery", err)
+	}
+}
+
+// failedWebhooks returns the dead lettered deliveries along with their raw
+// list entries, which are needed to remove them again
+func (s *server) failedWebhooks(appId string) ([]*webhookDelivery, []string) {
+	deliveries := make([]*webhookDelivery, 0)
+	raw := make([]string, 0)
+	list, err := s.store.DeadLetteredWebhooks(appId)
+	if err != nil {
+		log.Println("error reading failed webhooks", err)
+		return deliveries, raw
+	}
+	for _, data := range list {
+		delivery := &webhookDelivery{}
+		if err := json.Unmarshal([]byte(data), delivery); err != nil {
+			log.Println("error decoding failed webhook", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+		raw = append(raw, data)
+	}
+	return deliveries, raw
+}
+
+func (s *server) listFailedWebhooks(appId string) []*webhookDelivery {
+	deliveries, _ := s.failedWebhooks(appId)
+	return deliveries
+}
+
+// redeliverWebhooks takes the given deliveries off the dead letter list and sends
+// them again with a fresh set of attempts, an empty list of ids means all of them.
+// Returns the ids that were redelivered.
+func (s *server) redeliverWebhooks(appId string, deliveryIds []string) []string {
+	wanted := make(map[string]bool)
+	for _, id := range deliveryIds {
+		wanted[id] = true
+	}
+	redelivered := make([]string, 0)
+	deliveries, raw := s.failedWebhooks(appId)
+	for idx, delivery := range deliveries {
+		if len(wanted) > 0 && !wanted[delivery.Id] {
+			continue
+		}
+		// another node may be redelivering the same one
+		if removed, err := s.store.RemoveDeadLetteredWebhook(appId, raw[idx]); err != nil || !removed {
+			continue
+		}
+		delivery.Attempt = 0
+		delivery.LastError = ""
+		go s.deliverWebhook(delivery)
+		redelivered = append(redelivered, delivery.Id)
+	}
+	return redelivered
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookUnknownKey(t *testing.T) {
+	s := newTestServer()
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+	hook := s.createWebhook("app", ts.URL, "", "unknown")
+	s.deliverWebhook(&webhookDelivery{Id: "1", WebhookId: hook.Id, AppId: "app", Body: "{}"})
+	if called {
+		t.Errorf("expected no delivery signed with an empty secret")
+	}
+	if failed, _ := s.failedWebhooks("app"); len(failed) != 1 || failed[0].LastError != "unknown webhook key" {
+		t.Errorf("expected the delivery dead lettered got %+v", failed)
+	}
+}
@@ -270,6 +270,38 @@ func TestVersion1(t *testing.T) {
 	}
 }
 
+func TestVersion7(t *testing.T) {
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	last := NewV7()
+	for i := 0; i < 10000; i++ {
+		uuid := NewV7()
+		if v, _ := uuid.Version(); v != 7 {
+			t.Fatalf("%s: version %s expected 7\n", uuid, v)
+		}
+		if uuid.Variant() != RFC4122 {
+			t.Fatalf("%s: variant %s expected RFC4122\n", uuid, uuid.Variant())
+		}
+		if uuid.String() <= last.String() {
+			t.Fatalf("%s: not after %s\n", uuid, last)
+		}
+		last = uuid
+	}
+	ms, ok := last.UnixMillis()
+	if !ok || ms < before || ms > before+10000 {
+		t.Errorf("%s: unexpected time %d, started at %d\n", last, ms, before)
+	}
+	if _, ok := NewRandom().UnixMillis(); ok {
+		t.Errorf("expected no time from a version 4 uuid\n")
+	}
+
+	// the clock going backwards doesnt break the order
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	timeNow = func() time.Time { return time.Unix(0, 0) }
+	if uuid := NewV7(); uuid.String() <= last.String() {
+		t.Errorf("%s: not after %s when the clock went back\n", uuid, last)
+	}
+}
+
 func TestNodeAndTime(t *testing.T) {
 	// Time is February 5, 1998 12:30:23.136364800 AM GMT
 
@@ -0,0 +1,56 @@
+package uuid
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+var (
+	v7mu   sync.Mutex
+	v7last int64  // Unix milliseconds of the last version 7 UUID
+	v7seq  uint16 // counter within v7last
+)
+
+// NewV7 returns a Version 7 UUID, a 48 bit Unix millisecond timestamp
+// followed by random bits, so UUIDs sort by when they were made.  UUIDs made
+// in the same millisecond use the 12 bits after the timestamp as a counter,
+// started at a random value, so they sort in the order they were made too.
+// If the counter runs out, or the clock goes backwards, the timestamp is
+// moved on rather than going back.
+func NewV7() UUID {
+	uuid := make([]byte, 16)
+	randomBits([]byte(uuid[6:]))
+
+	v7mu.Lock()
+	ms := timeNow().UnixNano() / int64(time.Millisecond)
+	if ms > v7last {
+		v7last = ms
+		// the top bit is left clear so there is room to count
+		v7seq = binary.BigEndian.Uint16(uuid[6:8]) & 0x7ff
+	} else {
+		v7seq++
+		if v7seq > 0xfff {
+			v7last++
+			v7seq = 0
+		}
+	}
+	ms, seq := v7last, v7seq
+	v7mu.Unlock()
+
+	binary.BigEndian.PutUint16(uuid[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(uuid[2:], uint32(ms))
+	binary.BigEndian.PutUint16(uuid[6:], 0x7000|seq) // Version 7
+	uuid[8] = (uuid[8] & 0x3f) | 0x80                // Variant is 10
+	return uuid
+}
+
+// UnixMillis returns the Unix millisecond timestamp encoded in uuid.  It
+// returns false if uuid is not a valid version 7 UUID.
+func (uuid UUID) UnixMillis() (int64, bool) {
+	if v, ok := uuid.Version(); !ok || v != 7 {
+		return 0, false
+	}
+	ms := int64(binary.BigEndian.Uint16(uuid[0:2]))<<32 | int64(binary.BigEndian.Uint32(uuid[2:6]))
+	return ms, true
+}
@@ -0,0 +1,126 @@
+package xredis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// conn is a single connection to redis, it is not safe for concurrent use,
+// the pool hands each one to a single goroutine at a time
+type conn struct {
+	netConn      net.Conn
+	br           *bufio.Reader
+	bw           *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	usedAt       time.Time
+	broken       bool // an io or protocol error, the connection cant be reused
+}
+
+func dialConn(config *PoolConfig) (*conn, error) {
+	var netConn net.Conn
+	var err error
+	if config.TLS != nil {
+		tlsConfig := config.TLS
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(config.Address)
+		}
+		dialer := &net.Dialer{Timeout: config.DialTimeout}
+		netConn, err = tls.DialWithDialer(dialer, "tcp", config.Address, tlsConfig)
+	} else {
+		netConn, err = net.DialTimeout("tcp", config.Address, config.DialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{
+		netConn:      netConn,
+		br:           bufio.NewReader(netConn),
+		bw:           bufio.NewWriter(netConn),
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		usedAt:       time.Now(),
+	}
+	if config.Password != "" {
+		auth := []string{"AUTH", config.Password}
+		if config.Username != "" {
+			auth = []string{"AUTH", config.Username, config.Password}
+		}
+		if _, err := c.do(auth...); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if config.Database != 0 {
+		if _, err := c.do("SELECT", itoa(config.Database)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// send buffers a command, flush sends everything buffered
+func (c *conn) send(args ...string) error {
+	err := writeCommand(c.bw, args...)
+	if err != nil {
+		c.broken = true
+	}
+	return err
+}
+
+func (c *conn) flush() error {
+	if c.writeTimeout > 0 {
+		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	err := c.bw.Flush()
+	if err != nil {
+		c.broken = true
+	}
+	return err
+}
+
+// receive reads one reply, waiting at most timeout plus the read timeout,
+// a negative timeout waits forever
+func (c *conn) receive(timeout time.Duration) (interface{}, error) {
+	if timeout < 0 || c.readTimeout == 0 {
+		c.netConn.SetReadDeadline(time.Time{})
+	} else {
+		c.netConn.SetReadDeadline(time.Now().Add(c.readTimeout + timeout))
+	}
+	reply, err := readReply(c.br)
+	if err != nil {
+		c.broken = true
+	}
+	c.usedAt = time.Now()
+	return reply, err
+}
+
+// do sends a command and reads its reply, an error reply is returned as the error
+func (c *conn) do(args ...string) (interface{}, error) {
+	return c.doTimeout(0, args...)
+}
+
+func (c *conn) doTimeout(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.receive(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(RedisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
@@ -5,13 +5,13 @@ package xredis
 // Specified fields that do not exist within this hash are ignored.
 // If key does not exist, it is treated as an empty hash and this command returns 0.
 func (r *Redis) HDel(key string, fields ...string) (int64, error) {
-	return r.redisMaster.HDel(key, fields...)
+	return integerReply(r.master().Do("HDEL", packArgs(key, fields)...))
 }
 
 // HExists command:
 // Returns if field is an existing field in the hash stored at key.
 func (r *Redis) HExists(key, field string) (bool, error) {
-	return r.redisSlave.HExists(key, field)
+	return boolReply(r.slave().Do("HEXISTS", key, field))
 }
 
 // HGet command:
@@ -19,7 +19,7 @@ func (r *Redis) HExists(key, field string) (bool, error) {
 // Bulk reply: the value associated with field,
 // or nil when field is not present in the hash or key does not exist.
 func (r *Redis) HGet(key, field string) ([]byte, error) {
-	return r.redisSlave.HGet(key, field)
+	return bytesReply(r.slave().Do("HGET", key, field))
 }
 
 // HGetAll command:
@@ -27,7 +27,7 @@ func (r *Redis) HGet(key, field string) ([]byte, error) {
 // In the returned value, every field name is followed by its value,
 // so the length of the reply is twice the size of the hash.
 func (r *Redis) HGetAll(key string) (map[string]string, error) {
-	return r.redisSlave.HGetAll(key)
+	return mapReply(r.slave().Do("HGETALL", key))
 }
 
 // HIncrBy command:
@@ -36,7 +36,7 @@ func (r *Redis) HGetAll(key string) (map[string]string, error) {
 // If field does not exist the value is set to 0 before the operation is performed.
 // Integer reply: the value at field after the increment operation.
 func (r *Redis) HIncrBy(key, field string, increment int) (int64, error) {
-	return r.redisMaster.HIncrBy(key, field, increment)
+	return integerReply(r.master().Do("HINCRBY", packArgs(key, field, increment)...))
 }
 
 // HIncrByFloat command:
@@ -48,21 +48,21 @@ func (r *Redis) HIncrBy(key, field string, increment int) (int64, error) {
 // The current field content or the specified increment are not parsable as a double precision floating point number.
 // Bulk reply: the value of field after the increment.
 func (r *Redis) HIncrByFloat(key, field string, increment float64) (float64, error) {
-	return r.redisMaster.HIncrByFloat(key, field, increment)
+	return floatReply(r.master().Do("HINCRBYFLOAT", packArgs(key, field, increment)...))
 }
 
 // HKeys command:
 // Returns all field names in the hash stored at key.
 // Multi-bulk reply: list of fields in the hash, or an empty list when key does not exist.
 func (r *Redis) HKeys(key string) ([]string, error) {
-	return r.redisSlave.HKeys(key)
+	return stringsReply(r.slave().Do("HKEYS", key))
 }
 
 // HLen command:
 // Returns the number of fields contained in the hash stored at key.
 // Integer reply: number of fields in the hash, or 0 when key does not exist.
 func (r *Redis) HLen(key string) (int64, error) {
-	return r.redisSlave.HLen(key)
+	return integerReply(r.slave().Do("HLEN", key))
 }
 
 // HMGet command:
@@ -72,7 +72,7 @@ func (r *Redis) HLen(key string) (int64, error) {
 // running HMGET against a non-existing key will return a list of nil values.
 // Multi-bulk reply: list of values associated with the given fields, in the same order as they are requested.
 func (r *Redis) HMGet(key string, fields ...string) ([][]byte, error) {
-	return r.redisSlave.HMGet(key, fields...)
+	return bytesSliceReply(r.slave().Do("HMGET", packArgs(key, fields)...))
 }
 
 // HMSet command:
@@ -80,7 +80,7 @@ func (r *Redis) HMGet(key string, fields ...string) ([][]byte, error) {
 // This command overwrites any existing fields in the hash.
 // If key does not exist, a new key holding a hash is created.
 func (r *Redis) HMSet(key string, pairs map[string]string) error {
-	return r.redisMaster.HMSet(key, pairs)
+	return okReply(r.master().Do("HMSET", packArgs(key, pairArgs(pairs))...))
 }
 
 // HSet command:
@@ -88,7 +88,7 @@ func (r *Redis) HMSet(key string, pairs map[string]string) error {
 // If key does not exist, a new key holding a hash is created.
 // If field already exists in the hash, it is overwritten.
 func (r *Redis) HSet(key, field, value string) (bool, error) {
-	return r.redisMaster.HSet(key, field, value)
+	return boolReply(r.master().Do("HSET", key, field, value))
 }
 
 // HSetnx command:
@@ -96,18 +96,26 @@ func (r *Redis) HSet(key, field, value string) (bool, error) {
 // If key does not exist, a new key holding a hash is created.
 // If field already exists, this operation has no effect.
 func (r *Redis) HSetnx(key, field, value string) (bool, error) {
-	return r.redisMaster.HSetnx(key, field, value)
+	return boolReply(r.master().Do("HSETNX", key, field, value))
 }
 
 // HVals command:
 // Returns all values in the hash stored at key.
 // Multi-bulk reply: list of values in the hash, or an empty list when key does not exist.
 func (r *Redis) HVals(key string) ([]string, error) {
-	return r.redisSlave.HVals(key)
+	return stringsReply(r.slave().Do("HVALS", key))
 }
 
 // HScan command:
 // HSCAN key cursor [MATCH pattern] [COUNT count]
 func (r *Redis) HScan(key string, cursor uint64, pattern string, count int) (uint64, map[string]string, error) {
-	return r.redisSlave.HScan(key, cursor, pattern, count)
+	next, items, err := scanReply(r.slave().Do("HSCAN", packArgs(key, scanArgs(cursor, pattern, count))...))
+	if err != nil {
+		return 0, nil, err
+	}
+	hash := make(map[string]string, len(items)/2)
+	for idx := 0; idx+1 < len(items); idx += 2 {
+		hash[items[idx]] = items[idx+1]
+	}
+	return next, hash, nil
 }
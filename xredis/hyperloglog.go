@@ -3,7 +3,7 @@ package xredis
 // PFAdd adds all the element arguments to the HyperLogLog data structure
 // stored at the variable name specified as first argument.
 func (r *Redis) PFAdd(key string, elements ...string) (int64, error) {
-	return r.redisMaster.PFAdd(key, elements...)
+	return integerReply(r.master().Do("PFADD", packArgs(key, elements)...))
 }
 
 // PFCount returns the approximated cardinality computed by the HyperLogLog
@@ -13,7 +13,7 @@ func (r *Redis) PFAdd(key string, elements ...string) (int64, error) {
 // the union of the HyperLogLogs passed, by internally merging the HyperLogLogs
 // stored at the provided keys into a temporary hyperLogLog.
 func (r *Redis) PFCount(keys ...string) (int64, error) {
-	return r.redisSlave.PFCount(keys...)
+	return integerReply(r.slave().Do("PFCOUNT", keys...))
 }
 
 // PFMerge merges multiple HyperLogLog values into an unique value
@@ -22,5 +22,5 @@ func (r *Redis) PFCount(keys ...string) (int64, error) {
 // The computed merged HyperLogLog is set to the destination variable,
 // which is created if does not exist (defauling to an empty HyperLogLog).
 func (r *Redis) PFMerge(destkey string, sourcekeys ...string) error {
-	return r.redisMaster.PFMerge(destkey, sourcekeys...)
+	return okReply(r.master().Do("PFMERGE", packArgs(destkey, sourcekeys)...))
 }
@@ -1,45 +1,41 @@
 package xredis
 
-import (
-	"github.com/xuyu/goredis"
-)
-
 // Del removes the specified keys.
 // A key is ignored if it does not exist.
 // Integer reply: The number of keys that were removed.
 func (r *Redis) Del(keys ...string) (int64, error) {
-	return r.redisMaster.Del(keys...)
+	return integerReply(r.master().Do("DEL", keys...))
 }
 
 // Dump serialize the value stored at key in a Redis-specific format and return it to the user.
 // The returned value can be synthesized back into a Redis key using the RESTORE command.
 // Return []byte for maybe big data
 func (r *Redis) Dump(key string) ([]byte, error) {
-	return r.redisSlave.Dump(key)
+	return bytesReply(r.slave().Do("DUMP", key))
 }
 
 // Exists returns true if key exists.
 func (r *Redis) Exists(key string) (bool, error) {
-	return r.redisSlave.Exists(key)
+	return boolReply(r.slave().Do("EXISTS", key))
 }
 
 // Expire set a second timeout on key.
 // After the timeout has expired, the key will automatically be deleted.
 // A key with an associated timeout is often said to be volatile in Redis terminology.
 func (r *Redis) Expire(key string, seconds int) (bool, error) {
-	return r.redisMaster.Expire(key, seconds)
+	return boolReply(r.master().Do("EXPIRE", packArgs(key, seconds)...))
 }
 
 // ExpireAt has the same effect and semantic as expire,
 // but instead of specifying the number of seconds representing the TTL (time to live),
 // it takes an absolute Unix timestamp (seconds since January 1, 1970).
 func (r *Redis) ExpireAt(key string, timestamp int64) (bool, error) {
-	return r.redisMaster.ExpireAt(key, timestamp)
+	return boolReply(r.master().Do("EXPIREAT", packArgs(key, timestamp)...))
 }
 
 // Keys returns all keys matching pattern.
 func (r *Redis) Keys(pattern string) ([]string, error) {
-	return r.redisSlave.Keys(pattern)
+	return stringsReply(r.slave().Do("KEYS", pattern))
 }
 
 // Atomically transfer a key from a source Redis instance to a destination Redis instance.
@@ -78,7 +74,7 @@ func (r *Redis) Keys(pattern string) ([]string, error) {
 // When key already exists in the destination database,
 // or it does not exist in the source database, it does nothing.
 func (r *Redis) Move(key string, db int) (bool, error) {
-	return r.redisMaster.Move(key, db)
+	return boolReply(r.master().Do("MOVE", packArgs(key, db)...))
 }
 
 // Object inspects the internals of Redis Objects associated with keys.
@@ -86,8 +82,8 @@ func (r *Redis) Move(key string, db int) (bool, error) {
 // Your application may also use the information reported by the OBJECT command
 // to implement application level key eviction policies
 // when using Redis as a Cache.
-func (r *Redis) Object(subcommand string, arguments ...string) (*goredis.Reply, error) {
-	return r.redisSlave.Object(subcommand, arguments...)
+func (r *Redis) Object(subcommand string, arguments ...string) (interface{}, error) {
+	return r.slave().Do("OBJECT", packArgs(subcommand, arguments)...)
 }
 
 // Persist removes the existing timeout on key,
@@ -96,32 +92,32 @@ func (r *Redis) Object(subcommand string, arguments ...string) (*goredis.Reply,
 // True if the timeout was removed.
 // False if key does not exist or does not have an associated timeout.
 func (r *Redis) Persist(key string) (bool, error) {
-	return r.redisMaster.Persist(key)
+	return boolReply(r.master().Do("PERSIST", key))
 }
 
 // PExpire works exactly like EXPIRE
 // but the time to live of the key is specified in milliseconds instead of seconds.
 func (r *Redis) PExpire(key string, milliseconds int) (bool, error) {
-	return r.redisMaster.PExpire(key, milliseconds)
+	return boolReply(r.master().Do("PEXPIRE", packArgs(key, milliseconds)...))
 }
 
 // PExpireAt has the same effect and semantic as EXPIREAT,
 // but the Unix time at which the key will expire is specified in milliseconds instead of seconds.
 func (r *Redis) PExpireAt(key string, timestamp int64) (bool, error) {
-	return r.redisMaster.PExpireAt(key, timestamp)
+	return boolReply(r.master().Do("PEXPIREAT", packArgs(key, timestamp)...))
 }
 
 // PTTL returns the remaining time to live of a key that has an expire set,
 // with the sole difference that TTL returns the amount of remaining time in seconds
 // while PTTL returns it in milliseconds.
 func (r *Redis) PTTL(key string) (int64, error) {
-	return r.redisSlave.PTTL(key)
+	return integerReply(r.slave().Do("PTTL", key))
 }
 
 // RandomKey returns a random key from the currently selected database.
 // Bulk reply: the random key, or nil when the database is empty.
 func (r *Redis) RandomKey() ([]byte, error) {
-	return r.redisSlave.RandomKey()
+	return bytesReply(r.slave().Do("RANDOMKEY"))
 }
 
 // Rename renames key to newkey.
@@ -130,13 +126,13 @@ func (r *Redis) RandomKey() ([]byte, error) {
 // so if the deleted key contains a very big value it may cause high latency
 // even if RENAME itself is usually a constant-time operation.
 func (r *Redis) Rename(key, newkey string) error {
-	return r.redisMaster.Rename(key, newkey)
+	return okReply(r.master().Do("RENAME", key, newkey))
 }
 
 // Renamenx renames key to newkey if newkey does not yet exist.
 // It returns an error under the same conditions as RENAME.
 func (r *Redis) Renamenx(key, newkey string) (bool, error) {
-	return r.redisMaster.Renamenx(key, newkey)
+	return boolReply(r.master().Do("RENAMENX", key, newkey))
 }
 
 // Restore creates a key associated with a value that is obtained by deserializing
@@ -144,24 +140,37 @@ func (r *Redis) Renamenx(key, newkey string) (bool, error) {
 // If ttl is 0 the key is created without any expire, otherwise the specified expire time (in milliseconds) is set.
 // RESTORE checks the RDB version and data checksum. If they don't match an error is returned.
 func (r *Redis) Restore(key string, ttl int, serialized string) error {
-	return r.redisMaster.Restore(key, ttl, serialized)
+	return okReply(r.master().Do("RESTORE", packArgs(key, ttl, serialized)...))
 }
 
 // TTL returns the remaining time to live of a key that has a timeout.
 // Integer reply: TTL in seconds, or a negative value in order to signal an error (see the description above).
 func (r *Redis) TTL(key string) (int64, error) {
-	return r.redisSlave.TTL(key)
+	return integerReply(r.slave().Do("TTL", key))
 }
 
 // Type returns the string representation of the type of the value stored at key.
 // The different types that can be returned are: string, list, set, zset and hash.
 // Status code reply: type of key, or none when key does not exist.
 func (r *Redis) Type(key string) (string, error) {
-	return r.redisSlave.Type(key)
+	return stringReply(r.slave().Do("TYPE", key))
 }
 
 // Scan command:
 // SCAN cursor [MATCH pattern] [COUNT count]
 func (r *Redis) Scan(cursor uint64, pattern string, count int) (uint64, []string, error) {
-	return r.redisSlave.Scan(cursor, pattern, count)
+	return scanReply(r.slave().Do("SCAN", scanArgs(cursor, pattern, count)...))
+}
+
+// scanArgs builds the cursor [MATCH pattern] [COUNT count] arguments shared
+// by the SCAN family
+func scanArgs(cursor uint64, pattern string, count int) []string {
+	args := packArgs(cursor)
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", itoa(count))
+	}
+	return args
 }
@@ -1,5 +1,9 @@
 package xredis
 
+import (
+	"time"
+)
+
 // BLPop is a blocking list pop primitive.
 // It is the blocking version of LPOP
 // because it blocks the connection when there are no elements to pop from any of the given lists.
@@ -9,12 +13,12 @@ package xredis
 // A two-element multi-bulk with the first element being the name of the key where an element was popped
 // and the second element being the value of the popped element.
 func (r *Redis) BLPop(keys []string, timeout int) ([]string, error) {
-	return r.redisMaster.BLPop(keys, timeout)
+	return stringsReply(r.master().DoBlocking(time.Duration(timeout)*time.Second, "BLPOP", packArgs(keys, timeout)...))
 }
 
 // BRPop pops elements from the tail of a list instead of popping from the head.
 func (r *Redis) BRPop(keys []string, timeout int) ([]string, error) {
-	return r.redisMaster.BRPop(keys, timeout)
+	return stringsReply(r.master().DoBlocking(time.Duration(timeout)*time.Second, "BRPOP", packArgs(keys, timeout)...))
 }
 
 // BRPopLPush is the blocking variant of RPOPLPUSH.
@@ -26,7 +30,7 @@ func (r *Redis) BRPop(keys []string, timeout int) ([]string, error) {
 // Bulk reply: the element being popped from source and pushed to destination.
 // If timeout is reached, a Null multi-bulk reply is returned.
 func (r *Redis) BRPopLPush(source, destination string, timeout int) ([]byte, error) {
-	return r.redisMaster.BRPopLPush(source, destination, timeout)
+	return bytesReply(r.master().DoBlocking(time.Duration(timeout)*time.Second, "BRPOPLPUSH", packArgs(source, destination, timeout)...))
 }
 
 // LIndex returns the element at index index in the list stored at key.
@@ -37,7 +41,7 @@ func (r *Redis) BRPopLPush(source, destination string, timeout int) ([]byte, err
 // When the value at key is not a list, an error is returned.
 // Bulk reply: the requested element, or nil when index is out of range.
 func (r *Redis) LIndex(key string, index int) ([]byte, error) {
-	return r.redisSlave.LIndex(key, index)
+	return bytesReply(r.slave().Do("LINDEX", packArgs(key, index)...))
 }
 
 // LInsert inserts value in the list stored at key either before or after the reference value pivot.
@@ -45,20 +49,20 @@ func (r *Redis) LIndex(key string, index int) ([]byte, error) {
 // An error is returned when key exists but does not hold a list value.
 // Integer reply: the length of the list after the insert operation, or -1 when the value pivot was not found.
 func (r *Redis) LInsert(key, position, pivot, value string) (int64, error) {
-	return r.redisMaster.LInsert(key, position, pivot, value)
+	return integerReply(r.master().Do("LINSERT", key, position, pivot, value))
 }
 
 // LLen returns the length of the list stored at key.
 // If key does not exist, it is interpreted as an empty list and 0 is returned.
 // An error is returned when the value stored at key is not a list.
 func (r *Redis) LLen(key string) (int64, error) {
-	return r.redisSlave.LLen(key)
+	return integerReply(r.slave().Do("LLEN", key))
 }
 
 // LPop removes and returns the first element of the list stored at key.
 // Bulk reply: the value of the first element, or nil when key does not exist.
 func (r *Redis) LPop(key string) ([]byte, error) {
-	return r.redisMaster.LPop(key)
+	return bytesReply(r.master().Do("LPOP", key))
 }
 
 // LPush insert all the specified values at the head of the list stored at key.
@@ -66,7 +70,7 @@ func (r *Redis) LPop(key string) ([]byte, error) {
 // When key holds a value that is not a list, an error is returned.
 // Integer reply: the length of the list after the push operations.
 func (r *Redis) LPush(key string, values ...string) (int64, error) {
-	return r.redisMaster.LPush(key, values...)
+	return integerReply(r.master().Do("LPUSH", packArgs(key, values)...))
 }
 
 // LPushx inserts value at the head of the list stored at key,
@@ -74,7 +78,7 @@ func (r *Redis) LPush(key string, values ...string) (int64, error) {
 // In contrary to LPUSH, no operation will be performed when key does not yet exist.
 // Integer reply: the length of the list after the push operation.
 func (r *Redis) LPushx(key, value string) (int64, error) {
-	return r.redisMaster.LPushx(key, value)
+	return integerReply(r.master().Do("LPUSHX", key, value))
 }
 
 // LRange returns the specified elements of the list stored at key.
@@ -90,7 +94,7 @@ func (r *Redis) LPushx(key, value string) (int64, error) {
 // If stop is larger than the actual end of the list, Redis will treat it like the last element of the list.
 // Multi-bulk reply: list of elements in the specified range.
 func (r *Redis) LRange(key string, start, end int) ([]string, error) {
-	return r.redisSlave.LRange(key, start, end)
+	return stringsReply(r.slave().Do("LRANGE", packArgs(key, start, end)...))
 }
 
 // LRem removes the first count occurrences of elements equal to value from the list stored at key.
@@ -100,26 +104,26 @@ func (r *Redis) LRange(key string, start, end int) ([]string, error) {
 // count = 0: Remove all elements equal to value.
 // Integer reply: the number of removed elements.
 func (r *Redis) LRem(key string, count int, value string) (int64, error) {
-	return r.redisMaster.LRem(key, count, value)
+	return integerReply(r.master().Do("LREM", packArgs(key, count, value)...))
 }
 
 // LSet sets the list element at index to value. For more information on the index argument, see LINDEX.
 // An error is returned for out of range indexes.
 func (r *Redis) LSet(key string, index int, value string) error {
-	return r.redisMaster.LSet(key, index, value)
+	return okReply(r.master().Do("LSET", packArgs(key, index, value)...))
 }
 
 // LTrim trim an existing list so that it will contain only the specified range of elements specified.
 // Both start and stop are zero-based indexes, where 0 is the first element of the list (the head),
 // 1 the next element and so on.
 func (r *Redis) LTrim(key string, start, stop int) error {
-	return r.redisMaster.LTrim(key, start, stop)
+	return okReply(r.master().Do("LTRIM", packArgs(key, start, stop)...))
 }
 
 // RPop removes and returns the last element of the list stored at key.
 // Bulk reply: the value of the last element, or nil when key does not exist.
 func (r *Redis) RPop(key string) ([]byte, error) {
-	return r.redisMaster.RPop(key)
+	return bytesReply(r.master().Do("RPOP", key))
 }
 
 // RPopLPush atomically returns and removes the last element (tail) of the list stored at source,
@@ -130,19 +134,19 @@ func (r *Redis) RPop(key string) ([]byte, error) {
 // the operation is equivalent to removing the last element from the list and pushing it as first element of the list,
 // so it can be considered as a list rotation command.
 func (r *Redis) RPopLPush(source, destination string) ([]byte, error) {
-	return r.redisMaster.RPopLPush(source, destination)
+	return bytesReply(r.master().Do("RPOPLPUSH", source, destination))
 }
 
 // RPush insert all the specified values at the tail of the list stored at key.
 // If key does not exist, it is created as empty list before performing the push operation.
 // When key holds a value that is not a list, an error is returned.
 func (r *Redis) RPush(key string, values ...string) (int64, error) {
-	return r.redisMaster.RPush(key, values...)
+	return integerReply(r.master().Do("RPUSH", packArgs(key, values)...))
 }
 
 // RPushx inserts value at the tail of the list stored at key,
 // only if key already exists and holds a list.
 // In contrary to RPUSH, no operation will be performed when key does not yet exist.
 func (r *Redis) RPushx(key, value string) (int64, error) {
-	return r.redisMaster.RPushx(key, value)
+	return integerReply(r.master().Do("RPUSHX", key, value))
 }
@@ -0,0 +1,80 @@
+package xredis
+
+// Pipeline queues commands and sends them to redis in one round trip, handy
+// for flows like a presence join that write then read straight back.
+// Pipelines always run on the master so reads see the writes before them.
+type Pipeline struct {
+	pool *Pool
+	cmds [][]string
+}
+
+func (p *Pool) Pipeline() *Pipeline {
+	return &Pipeline{pool: p}
+}
+
+func (r *Redis) Pipeline() *Pipeline {
+	return r.master().Pipeline()
+}
+
+// Command queues a command, its reply is at the same index in Exec's result
+func (pl *Pipeline) Command(cmd string, args ...string) {
+	pl.cmds = append(pl.cmds, append([]string{cmd}, args...))
+}
+
+// Exec sends the queued commands and reads back a reply for each, an error
+// reply from one command is returned as a RedisError in its place rather than
+// failing the rest. The pipeline is empty again afterwards.
+func (pl *Pipeline) Exec() ([]interface{}, error) {
+	cmds := pl.cmds
+	pl.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	defer timeCommand("PIPELINE")()
+	c, err := pl.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	defer pl.pool.put(c)
+	for _, args := range cmds {
+		if err := c.send(args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for idx := range replies {
+		if replies[idx], err = c.receive(0); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// Helpers for reading the replies returned by Exec or by a Script
+
+func IntegerReply(reply interface{}) (int64, error) {
+	return integerReply(reply, nil)
+}
+
+func BoolReply(reply interface{}) (bool, error) {
+	return boolReply(reply, nil)
+}
+
+func BytesReply(reply interface{}) ([]byte, error) {
+	return bytesReply(reply, nil)
+}
+
+func StringsReply(reply interface{}) ([]string, error) {
+	return stringsReply(reply, nil)
+}
+
+func MapReply(reply interface{}) (map[string]string, error) {
+	return mapReply(reply, nil)
+}
+
+func ValuesReply(reply interface{}) ([]interface{}, error) {
+	return valuesReply(reply, nil)
+}
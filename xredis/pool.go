@@ -0,0 +1,268 @@
+package xredis
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/screencloud/subhub/metrics"
+	"sync"
+	"time"
+)
+
+// PoolConfig describes how to reach a redis server and how many connections
+// to keep to it
+type PoolConfig struct {
+	Address  string      `json:"address"`
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Database int         `json:"database"`
+	TLS      *tls.Config `json:"-"` // set to connect over TLS, see ApplyURL
+
+	MaxActive   int           `json:"max_active"`   // most connections in use at once, 0 for no limit
+	MaxIdle     int           `json:"max_idle"`     // most idle connections kept for reuse
+	IdleTimeout time.Duration `json:"idle_timeout"` // idle connections unused for longer are closed
+	WaitTimeout time.Duration `json:"wait_timeout"` // how long to wait for a connection when MaxActive are in use, 0 waits forever
+
+	DialTimeout  time.Duration `json:"dial_timeout"`
+	ReadTimeout  time.Duration `json:"read_timeout"`
+	WriteTimeout time.Duration `json:"write_timeout"`
+
+	// idle connections unused for longer are checked with a PING before use
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+}
+
+var DefaultPoolConfig = PoolConfig{
+	Address:             "127.0.0.1:6379",
+	MaxActive:           64,
+	MaxIdle:             16,
+	IdleTimeout:         5 * time.Minute,
+	WaitTimeout:         5 * time.Second,
+	DialTimeout:         5 * time.Second,
+	ReadTimeout:         5 * time.Second,
+	WriteTimeout:        5 * time.Second,
+	HealthCheckInterval: 30 * time.Second,
+}
+
+var (
+	ErrPoolExhausted = errors.New("xredis: connection pool exhausted")
+	ErrPoolClosed    = errors.New("xredis: connection pool closed")
+)
+
+var (
+	poolConnectionsGauge = metrics.NewGauge("subhub_redis_pool_connections",
+		"Open redis connections by pool and state.", "pool", "state")
+	poolDialsCounter = metrics.NewCounter("subhub_redis_pool_dials_total",
+		"Redis connections dialed by pool and result.", "pool", "result")
+	poolWaitsCounter = metrics.NewCounter("subhub_redis_pool_waits_total",
+		"Times a caller waited for a redis connection because the pool was at its limit.", "pool")
+	poolTimeoutsCounter = metrics.NewCounter("subhub_redis_pool_timeouts_total",
+		"Times a caller gave up waiting for a redis connection.", "pool")
+	poolHealthCheckFailuresCounter = metrics.NewCounter("subhub_redis_pool_health_check_failures_total",
+		"Idle redis connections that failed their health check.", "pool")
+)
+
+type PoolStats struct {
+	Active              int    `json:"active"` // open connections, in use or idle
+	Idle                int    `json:"idle"`
+	Dials               uint64 `json:"dials"`
+	DialErrors          uint64 `json:"dial_errors"`
+	Hits                uint64 `json:"hits"` // gets served by an idle connection
+	Waits               uint64 `json:"waits"`
+	Timeouts            uint64 `json:"timeouts"`
+	HealthCheckFailures uint64 `json:"health_check_failures"`
+}
+
+type Pool struct {
+	name   string // labels the metrics, like master or slave
+	config PoolConfig
+
+	lock   sync.Mutex
+	idle   []*conn // most recently used last
+	closed bool
+	stats  PoolStats
+	slots  chan struct{} // one per connection in use, nil when there is no limit
+}
+
+func NewPool(name string, config *PoolConfig) *Pool {
+	p := &Pool{
+		name:   name,
+		config: *config,
+	}
+	if config.MaxActive > 0 {
+		p.slots = make(chan struct{}, config.MaxActive)
+	}
+	return p
+}
+
+func (p *Pool) Address() string {
+	return p.config.Address
+}
+
+func (p *Pool) Stats() PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	return stats
+}
+
+// updateGauges expects the lock to be held
+func (p *Pool) updateGauges() {
+	poolConnectionsGauge.Set(float64(p.stats.Active-len(p.idle)), p.name, "in_use")
+	poolConnectionsGauge.Set(float64(len(p.idle)), p.name, "idle")
+}
+
+func (p *Pool) acquire() error {
+	if p.slots == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	p.lock.Lock()
+	p.stats.Waits++
+	p.lock.Unlock()
+	poolWaitsCounter.Inc(p.name)
+	if p.config.WaitTimeout == 0 {
+		p.slots <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(p.config.WaitTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		p.lock.Lock()
+		p.stats.Timeouts++
+		p.lock.Unlock()
+		poolTimeoutsCounter.Inc(p.name)
+		return ErrPoolExhausted
+	}
+}
+
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// get hands out an idle connection that is still healthy or dials a new one
+func (p *Pool) get() (*conn, error) {
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			p.release()
+			return nil, ErrPoolClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.lock.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.updateGauges()
+		p.lock.Unlock()
+
+		idleFor := time.Since(c.usedAt)
+		if p.config.IdleTimeout > 0 && idleFor > p.config.IdleTimeout {
+			p.discard(c)
+			continue
+		}
+		if p.config.HealthCheckInterval > 0 && idleFor > p.config.HealthCheckInterval {
+			if _, err := c.do("PING"); err != nil {
+				p.lock.Lock()
+				p.stats.HealthCheckFailures++
+				p.lock.Unlock()
+				poolHealthCheckFailuresCounter.Inc(p.name)
+				p.discard(c)
+				continue
+			}
+		}
+		p.lock.Lock()
+		p.stats.Hits++
+		p.lock.Unlock()
+		return c, nil
+	}
+
+	c, err := dialConn(&p.config)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stats.Dials++
+	if err != nil {
+		p.stats.DialErrors++
+		poolDialsCounter.Inc(p.name, "error")
+		p.release()
+		return nil, err
+	}
+	poolDialsCounter.Inc(p.name, "ok")
+	p.stats.Active++
+	p.updateGauges()
+	return c, nil
+}
+
+// put returns a connection to the pool, broken ones are closed
+func (p *Pool) put(c *conn) {
+	defer p.release()
+	p.lock.Lock()
+	if c.broken || p.closed || len(p.idle) >= p.config.MaxIdle {
+		p.lock.Unlock()
+		p.discard(c)
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.updateGauges()
+	p.lock.Unlock()
+}
+
+func (p *Pool) discard(c *conn) {
+	c.close()
+	p.lock.Lock()
+	p.stats.Active--
+	p.updateGauges()
+	p.lock.Unlock()
+}
+
+// Close closes the idle connections, connections in use are closed as they
+// are returned
+func (p *Pool) Close() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.lock.Unlock()
+	for _, c := range idle {
+		p.discard(c)
+	}
+}
+
+// Do runs a command on a pooled connection, an error reply is returned as
+// a RedisError
+func (p *Pool) Do(cmd string, args ...string) (interface{}, error) {
+	return p.do(0, cmd, args...)
+}
+
+// DoBlocking is Do for blocking commands like BLPOP, the read timeout is
+// extended by the commands own timeout, 0 waits forever
+func (p *Pool) DoBlocking(timeout time.Duration, cmd string, args ...string) (interface{}, error) {
+	if timeout == 0 {
+		timeout = -1
+	}
+	return p.do(timeout, cmd, args...)
+}
+
+func (p *Pool) do(timeout time.Duration, cmd string, args ...string) (interface{}, error) {
+	defer timeCommand(cmd)()
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(c)
+	return c.doTimeout(timeout, append([]string{cmd}, args...)...)
+}
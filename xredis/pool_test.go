@@ -0,0 +1,244 @@
+package xredis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis keeps string keys in a map and answers PING, GET, SET, BLPOP
+// (which never returns) and EVAL/EVALSHA (counting runs of a script), it can
+// drop every connection to test health checks
+type fakeRedis struct {
+	t       *testing.T
+	ln      net.Listener
+	lock    sync.Mutex
+	data    map[string]string
+	conns   []net.Conn
+	scripts map[string]int // sha1 to times run
+	evals   int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{t: t, ln: ln, data: make(map[string]string), scripts: make(map[string]int)}
+	go fr.serve()
+	return fr
+}
+
+func (fr *fakeRedis) config() *PoolConfig {
+	config := DefaultPoolConfig
+	config.Address = fr.ln.Addr().String()
+	return &config
+}
+
+func (fr *fakeRedis) close() {
+	fr.ln.Close()
+	fr.dropAll()
+}
+
+func (fr *fakeRedis) dropAll() {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	for _, conn := range fr.conns {
+		conn.Close()
+	}
+	fr.conns = nil
+}
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		fr.lock.Lock()
+		fr.conns = append(fr.conns, conn)
+		fr.lock.Unlock()
+		go fr.handle(conn)
+	}
+}
+
+func (fr *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, err := replyStrings(req)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		fr.lock.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			w.WriteString("+PONG\r\n")
+		case "SET":
+			fr.data[args[1]] = args[2]
+			w.WriteString("+OK\r\n")
+		case "GET":
+			if val, ok := fr.data[args[1]]; ok {
+				fmt.Fprintf(w, "$%d\r\n%s\r\n", len(val), val)
+			} else {
+				w.WriteString("$-1\r\n")
+			}
+		case "BLPOP":
+			// block forever
+		case "EVAL":
+			fr.evals++
+			fr.scripts[NewScript(0, args[1]).Hash()]++
+			w.WriteString(":1\r\n")
+		case "EVALSHA":
+			if _, ok := fr.scripts[args[1]]; ok {
+				fr.scripts[args[1]]++
+				w.WriteString(":1\r\n")
+			} else {
+				w.WriteString("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+			}
+		default:
+			w.WriteString("-ERR unknown command\r\n")
+		}
+		fr.lock.Unlock()
+		w.Flush()
+	}
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	pool := NewPool("test", fr.config())
+	defer pool.Close()
+
+	for i := 0; i < 5; i++ {
+		reply, err := pool.Do("PING")
+		if err != nil || reply != "PONG" {
+			t.Fatalf("expected PONG got %v %v", reply, err)
+		}
+	}
+	stats := pool.Stats()
+	if stats.Dials != 1 || stats.Hits != 4 || stats.Active != 1 || stats.Idle != 1 {
+		t.Errorf("expected one connection reused, got %+v", stats)
+	}
+}
+
+func TestPoolErrorReply(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	pool := NewPool("test", fr.config())
+	defer pool.Close()
+
+	_, err := pool.Do("NOPE")
+	if _, ok := err.(RedisError); !ok {
+		t.Fatalf("expected a RedisError got %v", err)
+	}
+	// an error reply doesnt break the connection
+	if _, err := pool.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Dials != 1 {
+		t.Errorf("expected the connection to be reused, got %+v", stats)
+	}
+}
+
+func TestPoolExhausted(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	config := fr.config()
+	config.MaxActive = 1
+	config.WaitTimeout = 50 * time.Millisecond
+	pool := NewPool("test", config)
+	defer pool.Close()
+
+	// hold the only connection with a blocking command
+	go pool.DoBlocking(0, "BLPOP", "list", "0")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := pool.Do("PING"); err != ErrPoolExhausted {
+		t.Fatalf("expected ErrPoolExhausted got %v", err)
+	}
+	if stats := pool.Stats(); stats.Waits != 1 || stats.Timeouts != 1 {
+		t.Errorf("expected a wait and a timeout, got %+v", stats)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	config := fr.config()
+	config.HealthCheckInterval = 10 * time.Millisecond
+	pool := NewPool("test", config)
+	defer pool.Close()
+
+	if _, err := pool.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	// the server goes away and comes back while the connection is idle
+	fr.dropAll()
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := pool.Do("PING"); err != nil {
+		t.Fatalf("expected the dead connection to be replaced, got %v", err)
+	}
+	stats := pool.Stats()
+	if stats.HealthCheckFailures != 1 || stats.Dials != 2 || stats.Active != 1 {
+		t.Errorf("expected a failed health check and a redial, got %+v", stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	config := fr.config()
+	config.IdleTimeout = 10 * time.Millisecond
+	pool := NewPool("test", config)
+	defer pool.Close()
+
+	pool.Do("PING")
+	time.Sleep(20 * time.Millisecond)
+	pool.Do("PING")
+	if stats := pool.Stats(); stats.Dials != 2 || stats.Hits != 0 {
+		t.Errorf("expected the idle connection to be closed, got %+v", stats)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	pool := NewPool("test", fr.config())
+	defer pool.Close()
+
+	pl := pool.Pipeline()
+	pl.Command("SET", "foo", "bar")
+	pl.Command("NOPE")
+	pl.Command("GET", "missing")
+	pl.Command("PING")
+	replies, err := pl.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("expected 4 replies got %v", replies)
+	}
+	if replies[0] != "OK" || replies[3] != "PONG" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if _, ok := replies[1].(RedisError); !ok {
+		t.Errorf("expected an error reply in place, got %v", replies[1])
+	}
+	if b, err := BytesReply(replies[2]); b != nil || err != nil {
+		t.Errorf("expected a nil bulk reply, got %v %v", b, err)
+	}
+	if stats := pool.Stats(); stats.Dials != 1 {
+		t.Errorf("expected a single connection, got %+v", stats)
+	}
+}
@@ -1,16 +1,77 @@
 package xredis
 
 import (
-	"github.com/xuyu/goredis"
+	"sync"
 )
 
 // Publish posts a message to the given channel.
 // Integer reply: the number of clients that received the message.
 func (r *Redis) Publish(channel, message string) (int64, error) {
-	return r.redisMaster.Publish(channel, message)
+	return integerReply(r.master().Do("PUBLISH", channel, message))
 }
 
-// PubSub new a PubSub from *redis.
-func (r *Redis) PubSub() (*goredis.PubSub, error) {
-	return r.redisSlave.PubSub()
+// PubSub is a connection in subscribe mode, it is dialed for the purpose
+// rather than taken from the pool as it cant be used for anything else
+type PubSub struct {
+	lock sync.Mutex // Receive runs in its own goroutine, this guards writes
+	conn *conn
+}
+
+// DialPubSub opens a subscriber connection, only the address, credentials,
+// database and timeouts in config are used
+func DialPubSub(config *PoolConfig) (*PubSub, error) {
+	c, err := dialConn(config)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSub{conn: c}, nil
+}
+
+// PubSub opens a subscriber connection to the pools server
+func (p *Pool) PubSub() (*PubSub, error) {
+	return DialPubSub(&p.config)
+}
+
+// PubSub opens a subscriber connection to the slave.
+func (r *Redis) PubSub() (*PubSub, error) {
+	return r.slave().PubSub()
+}
+
+func (ps *PubSub) command(cmd string, args ...string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if err := ps.conn.send(append([]string{cmd}, args...)...); err != nil {
+		return err
+	}
+	return ps.conn.flush()
+}
+
+func (ps *PubSub) Subscribe(channels ...string) error {
+	return ps.command("SUBSCRIBE", channels...)
+}
+
+func (ps *PubSub) UnSubscribe(channels ...string) error {
+	return ps.command("UNSUBSCRIBE", channels...)
+}
+
+func (ps *PubSub) PSubscribe(patterns ...string) error {
+	return ps.command("PSUBSCRIBE", patterns...)
+}
+
+func (ps *PubSub) PUnSubscribe(patterns ...string) error {
+	return ps.command("PUNSUBSCRIBE", patterns...)
+}
+
+// Receive blocks until the next message or subscription change, like
+// [message channel payload] or [subscribe channel count]
+func (ps *PubSub) Receive() ([]string, error) {
+	reply, err := ps.conn.receive(-1)
+	if err != nil {
+		return nil, err
+	}
+	return replyStrings(reply)
+}
+
+func (ps *PubSub) Close() error {
+	return ps.conn.close()
 }
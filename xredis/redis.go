@@ -2,44 +2,208 @@ package xredis
 
 import (
 	// "github.com/fatih/structs"
-	"github.com/xuyu/goredis"
+	"github.com/screencloud/subhub/metrics"
 	"log"
+	"sync"
+	"time"
 )
 
+var commandDuration = metrics.NewHistogram("subhub_redis_command_duration_seconds",
+	"Time taken by redis commands.", nil, "command")
+
+// timeCommand starts timing a redis command, call the returned func once it has completed
+func timeCommand(command string) func() {
+	t := time.Now()
+	return func() {
+		commandDuration.Observe(time.Since(t).Seconds(), command)
+	}
+}
+
 type Redis struct {
+	lock sync.RWMutex
 
-	// lock sync.RWMutex
+	masterPool *Pool // used for write
+	slavePool  *Pool // used for reads
 
-	redisMaster *goredis.Redis // used for write
-	redisSlave  *goredis.Redis // used for reads
+	// set when the master and slave are found through sentinel
+	sentinel *Sentinel
+	config   PoolConfig
 }
 
-func Connect(masterConfig *goredis.DialConfig, slaveConfig *goredis.DialConfig) (*Redis, error) {
+// New wraps pools that are already set up, master and slave can be the same pool
+func New(masterPool *Pool, slavePool *Pool) *Redis {
+	return &Redis{masterPool: masterPool, slavePool: slavePool}
+}
+
+func Connect(masterConfig *PoolConfig, slaveConfig *PoolConfig) (*Redis, error) {
 	r := &Redis{}
 
 	log.Println("server connect redis")
 
-	redisMaster, err := goredis.Dial(masterConfig)
-	if err != nil {
-		log.Fatal("Unable to connect to redis master", err)
+	r.masterPool = NewPool("master", masterConfig)
+	if _, err := r.masterPool.Do("PING"); err != nil {
+		log.Println("Unable to connect to redis master", err)
 		return r, err
 	}
-	r.redisMaster = redisMaster
 
-	redisSlave, err := goredis.Dial(slaveConfig)
+	r.slavePool = NewPool("slave", slaveConfig)
+	if _, err := r.slavePool.Do("PING"); err != nil {
+		log.Println("Unable to connect to redis slave", err)
+		return r, err
+	}
+
+	return r, nil
+}
+
+const SENTINEL_REFRESH_INTERVAL = 30 * time.Second
+
+// ConnectSentinel asks the sentinels for the master and a replica and follows
+// failovers, config is used for everything but the address
+func ConnectSentinel(sentinel *Sentinel, config *PoolConfig) (*Redis, error) {
+	r := &Redis{sentinel: sentinel, config: *config}
+
+	log.Println("server connect redis via sentinel", sentinel.Master())
+
+	masterAddress, err := sentinel.MasterAddress()
 	if err != nil {
-		log.Fatal("Unable to connect to redis sub", err)
+		log.Println("Unable to find redis master", err)
+		return r, err
+	}
+	if err = r.connectMaster(masterAddress); err != nil {
+		log.Println("Unable to connect to redis master", err)
+		return r, err
+	}
+	if err = r.connectSlave(); err != nil {
+		log.Println("Unable to connect to redis slave", err)
 		return r, err
 	}
-	r.redisSlave = redisSlave
 
-	return r, err
+	go sentinel.Watch(r.switchMaster)
+	go r.refreshLoop()
+	return r, nil
 }
 
-func (r *Redis) Master() *goredis.Redis {
-	return r.redisMaster
+// dial makes a pool for address and checks it can be reached
+func (r *Redis) dial(name string, address string) (*Pool, error) {
+	config := r.config
+	config.Address = address
+	pool := NewPool(name, &config)
+	if _, err := pool.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
 }
 
-func (r *Redis) Slave() *goredis.Redis {
-	return r.redisSlave
+// swap installs a new pool, closing the one it replaces
+func (r *Redis) swap(pool **Pool, replacement *Pool) {
+	r.lock.Lock()
+	old := *pool
+	*pool = replacement
+	r.lock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (r *Redis) connectMaster(address string) error {
+	masterPool, err := r.dial("master", address)
+	if err != nil {
+		return err
+	}
+	r.swap(&r.masterPool, masterPool)
+	return nil
+}
+
+// connectSlave picks a replica that is up, or the master if there are none
+func (r *Redis) connectSlave() error {
+	address, err := r.sentinel.SlaveAddress()
+	if err != nil {
+		return err
+	}
+	slavePool, err := r.dial("slave", address)
+	if err != nil {
+		return err
+	}
+	r.swap(&r.slavePool, slavePool)
+	return nil
+}
+
+// switchMaster is called by the sentinel watch after a failover, writes move
+// to the new master and a replica is picked again as the old master is gone
+// or has been demoted
+func (r *Redis) switchMaster(address string) {
+	for {
+		err := r.connectMaster(address)
+		if err == nil {
+			break
+		}
+		log.Println("Unable to connect to new redis master", address, err)
+		time.Sleep(SENTINEL_RETRY_INTERVAL)
+		// the sentinels may have moved on again while we were retrying
+		if latest, err := r.sentinel.MasterAddress(); err == nil {
+			address = latest
+		}
+	}
+	if err := r.connectSlave(); err != nil {
+		log.Println("Unable to connect to redis slave", err)
+	}
+}
+
+// refreshLoop moves reads off a replica the sentinels no longer think is up
+func (r *Redis) refreshLoop() {
+	ticker := time.NewTicker(SENTINEL_REFRESH_INTERVAL)
+	for range ticker.C {
+		addrs, err := r.sentinel.SlaveAddresses()
+		if err != nil {
+			continue
+		}
+		current, masterAddress := r.slave().Address(), r.master().Address()
+		healthy := false
+		for _, addr := range addrs {
+			healthy = healthy || addr == current
+		}
+		// reading from the master is only a fallback for when there are no replicas
+		if healthy || (current == masterAddress && len(addrs) == 0) {
+			continue
+		}
+		log.Println("redis slave", current, "is no longer healthy")
+		if err := r.connectSlave(); err != nil {
+			log.Println("Unable to connect to redis slave", err)
+		}
+	}
+}
+
+func (r *Redis) master() *Pool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.masterPool
+}
+
+func (r *Redis) slave() *Pool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.slavePool
+}
+
+func (r *Redis) Master() *Pool {
+	return r.master()
+}
+
+func (r *Redis) Slave() *Pool {
+	return r.slave()
+}
+
+// Close closes the pools idle connections
+func (r *Redis) Close() {
+	r.master().Close()
+	r.slave().Close()
+}
+
+// Stats returns the connection pool stats for the master and slave
+func (r *Redis) Stats() map[string]PoolStats {
+	return map[string]PoolStats{
+		"master": r.master().Stats(),
+		"slave":  r.slave().Stats(),
+	}
 }
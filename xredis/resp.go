@@ -0,0 +1,282 @@
+package xredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// A minimal RESP (REdis Serialization Protocol) reader and writer, used by the
+// connection pool, subscribers and sentinel.
+// Replies are decoded to: string (status), int64 (integer), []byte (bulk),
+// []interface{} (multi bulk), nil (null bulk or multi bulk) or RedisError.
+
+type RedisError string
+
+func (e RedisError) Error() string { return string(e) }
+
+var errProtocol = errors.New("xredis: protocol error")
+
+// writeCommand buffers a command as a multi bulk of bulk strings, the caller flushes
+func writeCommand(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads one reply, an error reply is returned as a RedisError value
+// so that a connection can carry on after it, the error is only for io and
+// protocol problems
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		multi := make([]interface{}, n)
+		for idx := range multi {
+			if multi[idx], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return multi, nil
+	}
+	return nil, errProtocol
+}
+
+// replyStrings flattens a multi bulk reply of bulk or status strings
+func replyStrings(reply interface{}) ([]string, error) {
+	multi, ok := reply.([]interface{})
+	if !ok {
+		if err, ok := reply.(RedisError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("xredis: expected multi bulk reply, got %T", reply)
+	}
+	strs := make([]string, len(multi))
+	for idx, item := range multi {
+		switch v := item.(type) {
+		case []byte:
+			strs[idx] = string(v)
+		case string:
+			strs[idx] = v
+		case int64:
+			strs[idx] = strconv.FormatInt(v, 10)
+		case nil:
+			strs[idx] = ""
+		default:
+			return nil, fmt.Errorf("xredis: unexpected %T in multi bulk reply", item)
+		}
+	}
+	return strs, nil
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+// packArgs flattens command arguments to strings, slices are expanded
+func packArgs(items ...interface{}) []string {
+	args := make([]string, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			args = append(args, v)
+		case []string:
+			args = append(args, v...)
+		case int:
+			args = append(args, strconv.Itoa(v))
+		case int64:
+			args = append(args, strconv.FormatInt(v, 10))
+		case uint64:
+			args = append(args, strconv.FormatUint(v, 10))
+		case float64:
+			args = append(args, strconv.FormatFloat(v, 'g', -1, 64))
+		default:
+			args = append(args, fmt.Sprint(v))
+		}
+	}
+	return args
+}
+
+// The reply helpers turn a Do result into the type a command returns, an
+// error reply becomes the error. They also accept replies out of a Pipeline.
+
+func replyError(reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	if rerr, ok := reply.(RedisError); ok {
+		return rerr
+	}
+	return nil
+}
+
+func okReply(reply interface{}, err error) error {
+	return replyError(reply, err)
+}
+
+func integerReply(reply interface{}, err error) (int64, error) {
+	if err = replyError(reply, err); err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("xredis: expected integer reply, got %T", reply)
+}
+
+func boolReply(reply interface{}, err error) (bool, error) {
+	n, err := integerReply(reply, err)
+	return n == 1, err
+}
+
+func bytesReply(reply interface{}, err error) ([]byte, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("xredis: expected bulk reply, got %T", reply)
+}
+
+func stringReply(reply interface{}, err error) (string, error) {
+	b, err := bytesReply(reply, err)
+	return string(b), err
+}
+
+func floatReply(reply interface{}, err error) (float64, error) {
+	s, err := stringReply(reply, err)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func stringsReply(reply interface{}, err error) ([]string, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	return replyStrings(reply)
+}
+
+func bytesSliceReply(reply interface{}, err error) ([][]byte, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	multi, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("xredis: expected multi bulk reply, got %T", reply)
+	}
+	items := make([][]byte, len(multi))
+	for idx, item := range multi {
+		if items[idx], err = bytesReply(item, nil); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func valuesReply(reply interface{}, err error) ([]interface{}, error) {
+	if err = replyError(reply, err); err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []interface{}:
+		return v, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("xredis: expected multi bulk reply, got %T", reply)
+}
+
+func mapReply(reply interface{}, err error) (map[string]string, error) {
+	strs, err := stringsReply(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(strs)/2)
+	for idx := 0; idx+1 < len(strs); idx += 2 {
+		m[strs[idx]] = strs[idx+1]
+	}
+	return m, nil
+}
+
+// scanReply splits a SCAN style reply into the next cursor and the items
+func scanReply(reply interface{}, err error) (uint64, []string, error) {
+	if err = replyError(reply, err); err != nil {
+		return 0, nil, err
+	}
+	multi, ok := reply.([]interface{})
+	if !ok || len(multi) != 2 {
+		return 0, nil, fmt.Errorf("xredis: unexpected scan reply %v", reply)
+	}
+	cursor, err := stringReply(multi[0], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	items, err := stringsReply(multi[1], nil)
+	return next, items, err
+}
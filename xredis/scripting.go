@@ -0,0 +1,66 @@
+package xredis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Script is a lua script that redis runs atomically, nothing else runs on the
+// server while it does. It is sent by its SHA1 with EVALSHA and only falls
+// back to EVAL, which also caches it, when redis doesnt know it yet, like
+// after a restart or a failover. Scripts always run on the master.
+type Script struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+// NewScript takes the number of KEYS the script expects, the rest of the
+// arguments it is run with are passed as ARGV
+func NewScript(keyCount int, src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{keyCount: keyCount, src: src, hash: hex.EncodeToString(sum[:])}
+}
+
+func (s *Script) Hash() string {
+	return s.hash
+}
+
+func (s *Script) args(keysAndArgs []string) []string {
+	args := make([]string, 0, len(keysAndArgs)+2)
+	args = append(args, s.hash, itoa(s.keyCount))
+	return append(args, keysAndArgs...)
+}
+
+// Do runs the script with its keys followed by its arguments
+func (s *Script) Do(p *Pool, keysAndArgs ...string) (interface{}, error) {
+	args := s.args(keysAndArgs)
+	reply, err := p.Do("EVALSHA", args...)
+	if rerr, ok := err.(RedisError); ok && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		args[0] = s.src
+		reply, err = p.Do("EVAL", args...)
+	}
+	return reply, err
+}
+
+// Load caches the script on the server so the first Do doesnt need to send it
+func (s *Script) Load(p *Pool) error {
+	_, err := stringReply(p.Do("SCRIPT", "LOAD", s.src))
+	return err
+}
+
+// Eval runs a script on the master, see Script
+func (r *Redis) Eval(script *Script, keysAndArgs ...string) (interface{}, error) {
+	return script.Do(r.master(), keysAndArgs...)
+}
+
+// ScriptLoad caches scripts on the master
+func (r *Redis) ScriptLoad(scripts ...*Script) error {
+	for _, script := range scripts {
+		if err := script.Load(r.master()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
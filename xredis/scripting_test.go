@@ -0,0 +1,31 @@
+package xredis
+
+import (
+	"testing"
+)
+
+func TestScriptFallsBackToEval(t *testing.T) {
+	fr := newFakeRedis(t)
+	defer fr.close()
+	pool := NewPool("test", fr.config())
+	defer pool.Close()
+
+	script := NewScript(1, "return redis.call('INCR', KEYS[1])")
+	for i := 0; i < 3; i++ {
+		reply, err := script.Do(pool, "counter")
+		if err != nil || reply != int64(1) {
+			t.Fatalf("expected 1 got %v %v", reply, err)
+		}
+	}
+	// only the first run sends the source
+	if fr.evals != 1 || fr.scripts[script.Hash()] != 3 {
+		t.Errorf("expected one EVAL and three runs, got %d and %d", fr.evals, fr.scripts[script.Hash()])
+	}
+}
+
+func TestScriptHash(t *testing.T) {
+	script := NewScript(0, "return 1")
+	if script.Hash() != "e0e1f9fabfc9d4800c877a703b823ac0578ff8db" {
+		t.Errorf("unexpected sha1 %s", script.Hash())
+	}
+}
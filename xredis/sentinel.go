@@ -0,0 +1,245 @@
+package xredis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SENTINEL_TIMEOUT        = 2 * time.Second
+	SENTINEL_RETRY_INTERVAL = time.Second
+	SENTINEL_PING_INTERVAL  = 5 * time.Second // the watch connection is given up on after two without a reply
+	SENTINEL_SWITCH_MASTER  = "+switch-master"
+)
+
+var ErrNoSentinel = errors.New("xredis: no sentinel could be reached")
+
+// Sentinel asks a group of redis sentinels where the master and replicas for
+// a named master are, and watches for failovers.
+type Sentinel struct {
+	lock         sync.Mutex
+	addrs        []string // the sentinel that last answered is kept first
+	master       string
+	pingInterval time.Duration
+}
+
+func NewSentinel(addrs []string, master string) *Sentinel {
+	return &Sentinel{
+		addrs:        append([]string{}, addrs...),
+		master:       master,
+		pingInterval: SENTINEL_PING_INTERVAL,
+	}
+}
+
+func (s *Sentinel) Master() string {
+	return s.master
+}
+
+func (s *Sentinel) sentinels() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.addrs...)
+}
+
+// promote moves a sentinel that answered to the front of the list
+func (s *Sentinel) promote(addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for idx, a := range s.addrs {
+		if a == addr {
+			copy(s.addrs[1:idx+1], s.addrs[:idx])
+			s.addrs[0] = addr
+			return
+		}
+	}
+}
+
+// command runs a command against each sentinel in turn until one answers
+func (s *Sentinel) command(args ...string) (interface{}, error) {
+	err := ErrNoSentinel
+	for _, addr := range s.sentinels() {
+		var reply interface{}
+		reply, err = sentinelCommand(addr, args...)
+		if err == nil {
+			s.promote(addr)
+			return reply, nil
+		}
+		log.Println("sentinel", addr, "failed", err)
+	}
+	return nil, err
+}
+
+func sentinelCommand(addr string, args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", addr, SENTINEL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SENTINEL_TIMEOUT))
+	w := bufio.NewWriter(conn)
+	if err = writeCommand(w, args...); err != nil {
+		return nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(RedisError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// MasterAddress returns the host:port of the current master
+func (s *Sentinel) MasterAddress() (string, error) {
+	reply, err := s.command("SENTINEL", "get-master-addr-by-name", s.master)
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return "", fmt.Errorf("xredis: sentinel doesnt know master %s", s.master)
+	}
+	parts, err := replyStrings(reply)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) != 2 {
+		return "", fmt.Errorf("xredis: unexpected sentinel reply %v", parts)
+	}
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+// SlaveAddresses returns the host:port of each replica that is up
+func (s *Sentinel) SlaveAddresses() ([]string, error) {
+	reply, err := s.command("SENTINEL", "slaves", s.master)
+	if err != nil {
+		return nil, err
+	}
+	multi, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("xredis: unexpected sentinel reply %v", reply)
+	}
+	addrs := make([]string, 0, len(multi))
+	for _, item := range multi {
+		// each replica is a flat list of field, value pairs
+		fields, err := replyStrings(item)
+		if err != nil {
+			return nil, err
+		}
+		info := make(map[string]string)
+		for idx := 0; idx+1 < len(fields); idx += 2 {
+			info[fields[idx]] = fields[idx+1]
+		}
+		flags := info["flags"]
+		if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(info["ip"], info["port"]))
+	}
+	return addrs, nil
+}
+
+// SlaveAddress picks one of the replicas that are up, falling back to the master
+func (s *Sentinel) SlaveAddress() (string, error) {
+	addrs, err := s.SlaveAddresses()
+	if err != nil || len(addrs) == 0 {
+		return s.MasterAddress()
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// Watch calls onSwitch with the new master address each time the sentinels
+// fail over, it blocks forever so run it in its own goroutine. A failover
+// while it was reconnecting is caught by asking for the master again each time
+// it subscribes, the first answer is taken as the master already in use.
+func (s *Sentinel) Watch(onSwitch func(masterAddress string)) {
+	current := ""
+	for {
+		for _, addr := range s.sentinels() {
+			err := s.watch(addr, &current, onSwitch)
+			log.Println("sentinel watch", addr, "ended", err)
+		}
+		time.Sleep(SENTINEL_RETRY_INTERVAL)
+	}
+}
+
+func (s *Sentinel) watch(addr string, current *string, onSwitch func(masterAddress string)) error {
+	conn, err := net.DialTimeout("tcp", addr, SENTINEL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	conn.SetWriteDeadline(time.Now().Add(SENTINEL_TIMEOUT))
+	if err = writeCommand(w, "SUBSCRIBE", SENTINEL_SWITCH_MASTER); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	// only once subscribed, so a switch after this answer isnt missed either
+	if masterAddress, err := s.MasterAddress(); err == nil {
+		if *current != "" && masterAddress != *current {
+			log.Println("sentinel master", s.master, "moved to", masterAddress, "while not watching")
+			onSwitch(masterAddress)
+		}
+		*current = masterAddress
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.ping(conn, w, done)
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * s.pingInterval))
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		parts, err := replyStrings(reply)
+		if err != nil {
+			return err
+		}
+		if len(parts) != 3 || parts[0] != "message" || parts[1] != SENTINEL_SWITCH_MASTER {
+			continue // subscribe confirmation or pong
+		}
+		// <master name> <old ip> <old port> <new ip> <new port>
+		fields := strings.Fields(parts[2])
+		if len(fields) != 5 || fields[0] != s.master {
+			continue
+		}
+		s.promote(addr)
+		masterAddress := net.JoinHostPort(fields[3], fields[4])
+		log.Println("sentinel switched master", s.master, "to", masterAddress)
+		*current = masterAddress
+		onSwitch(masterAddress)
+	}
+}
+
+// ping keeps the watch connection busy so a sentinel that has gone away
+// without closing it is noticed by the read deadline
+func (s *Sentinel) ping(conn net.Conn, w *bufio.Writer, done chan struct{}) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// a write that fails shows up as the read deadline passing
+			conn.SetWriteDeadline(time.Now().Add(SENTINEL_TIMEOUT))
+			writeCommand(w, "PING")
+			w.Flush()
+		}
+	}
+}
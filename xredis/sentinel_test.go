@@ -0,0 +1,263 @@
+package xredis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSentinel answers the few sentinel commands we use from canned replies
+// and pushes switch-master messages to anyone subscribed. Once subscribed it
+// doesnt answer pings, and a send on drop closes the subscription.
+type fakeSentinel struct {
+	t          *testing.T
+	ln         net.Listener
+	lock       sync.Mutex
+	replies    map[string]string // command args joined by a space to raw reply
+	answered   int
+	switches   chan string
+	subscribed chan struct{}
+	drop       chan struct{}
+}
+
+func newFakeSentinel(t *testing.T, replies map[string]string) *fakeSentinel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSentinel{t: t, ln: ln, replies: replies, switches: make(chan string, 1),
+		subscribed: make(chan struct{}, 10), drop: make(chan struct{})}
+	go fs.serve()
+	return fs
+}
+
+func (fs *fakeSentinel) addr() string {
+	return fs.ln.Addr().String()
+}
+
+func (fs *fakeSentinel) setReply(cmd string, reply string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.replies[cmd] = reply
+}
+
+func (fs *fakeSentinel) commands() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.answered
+}
+
+func (fs *fakeSentinel) close() {
+	fs.ln.Close()
+}
+
+func (fs *fakeSentinel) serve() {
+	for {
+		conn, err := fs.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fs.handle(conn)
+	}
+}
+
+func (fs *fakeSentinel) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, err := replyStrings(req)
+		if err != nil {
+			return
+		}
+		cmd := strings.Join(args, " ")
+		if cmd == "SUBSCRIBE "+SENTINEL_SWITCH_MASTER {
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n"))
+			fs.subscribed <- struct{}{}
+			for {
+				select {
+				case payload := <-fs.switches:
+					w := bufio.NewWriter(conn)
+					writeCommand(w, "message", SENTINEL_SWITCH_MASTER, payload)
+					w.Flush()
+				case <-fs.drop:
+					return
+				}
+			}
+		}
+		fs.lock.Lock()
+		reply, ok := fs.replies[cmd]
+		fs.answered++
+		fs.lock.Unlock()
+		if !ok {
+			reply = "-ERR unknown command\r\n"
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+const masterReply = "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6379\r\n"
+
+// two replicas, the second one is down
+const slavesReply = "*2\r\n" +
+	"*6\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$4\r\nport\r\n$4\r\n6380\r\n$5\r\nflags\r\n$5\r\nslave\r\n" +
+	"*6\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$4\r\nport\r\n$4\r\n6381\r\n$5\r\nflags\r\n$12\r\nslave,s_down\r\n"
+
+func TestSentinelMasterAddress(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name mymaster": masterReply,
+	})
+	defer fs.close()
+
+	// the first sentinel is down, so the second one should be asked and kept first
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downAddr := down.Addr().String()
+	down.Close()
+
+	s := NewSentinel([]string{downAddr, fs.addr()}, "mymaster")
+	addr, err := s.MasterAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "127.0.0.1:6379" {
+		t.Errorf("expected master 127.0.0.1:6379 got %s", addr)
+	}
+	if s.sentinels()[0] != fs.addr() {
+		t.Errorf("expected answering sentinel to be promoted, got %v", s.sentinels())
+	}
+}
+
+func TestSentinelUnknownMaster(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name other": "*-1\r\n",
+	})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "other")
+	if _, err := s.MasterAddress(); err == nil {
+		t.Error("expected an error for an unknown master")
+	}
+}
+
+func TestSentinelSlaveAddresses(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name mymaster": masterReply,
+		"SENTINEL slaves mymaster":                  slavesReply,
+	})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "mymaster")
+	addrs, err := s.SlaveAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1:6380" {
+		t.Errorf("expected only the healthy replica got %v", addrs)
+	}
+	addr, err := s.SlaveAddress()
+	if err != nil || addr != "127.0.0.1:6380" {
+		t.Errorf("expected slave 127.0.0.1:6380 got %s %v", addr, err)
+	}
+}
+
+func TestSentinelSlaveFallsBackToMaster(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name mymaster": masterReply,
+		"SENTINEL slaves mymaster":                  "*0\r\n",
+	})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "mymaster")
+	addr, err := s.SlaveAddress()
+	if err != nil || addr != "127.0.0.1:6379" {
+		t.Errorf("expected master 127.0.0.1:6379 got %s %v", addr, err)
+	}
+}
+
+func TestSentinelWatch(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "mymaster")
+	switched := make(chan string, 1)
+	go s.Watch(func(addr string) {
+		switched <- addr
+	})
+
+	// other masters are ignored
+	fs.switches <- "othermaster 127.0.0.1 7000 127.0.0.1 7001"
+	fs.switches <- "mymaster 127.0.0.1 6379 127.0.0.1 6380"
+	select {
+	case addr := <-switched:
+		if addr != "127.0.0.1:6380" {
+			t.Errorf("expected new master 127.0.0.1:6380 got %s", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for switch-master")
+	}
+}
+
+func waitSubscribed(t *testing.T, fs *fakeSentinel) {
+	select {
+	case <-fs.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watch to subscribe")
+	}
+}
+
+// a failover while the watch was reconnecting is still passed on
+func TestSentinelWatchCatchesUp(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name mymaster": masterReply,
+	})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "mymaster")
+	switched := make(chan string, 1)
+	go s.Watch(func(addr string) {
+		switched <- addr
+	})
+	waitSubscribed(t, fs)
+	// the master it starts out with
+	for fs.commands() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fs.setReply("SENTINEL get-master-addr-by-name mymaster", "*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6380\r\n")
+	fs.drop <- struct{}{}
+	select {
+	case addr := <-switched:
+		if addr != "127.0.0.1:6380" {
+			t.Errorf("expected new master 127.0.0.1:6380 got %s", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the missed switch")
+	}
+}
+
+// a sentinel that stops answering pings is given up on
+func TestSentinelWatchPings(t *testing.T) {
+	fs := newFakeSentinel(t, map[string]string{
+		"SENTINEL get-master-addr-by-name mymaster": masterReply,
+	})
+	defer fs.close()
+
+	s := NewSentinel([]string{fs.addr()}, "mymaster")
+	s.pingInterval = 50 * time.Millisecond
+	switched := make(chan string, 1)
+	go s.Watch(func(addr string) {
+		switched <- addr
+	})
+	waitSubscribed(t, fs)
+	waitSubscribed(t, fs)
+	select {
+	case addr := <-switched:
+		t.Errorf("expected no switch for the same master got %s", addr)
+	default:
+	}
+}
@@ -8,12 +8,12 @@ package xredis
 // Integer reply: the number of elements that were added to the set,
 // not including all the elements already present into the set.
 func (r *Redis) SAdd(key string, members ...string) (int64, error) {
-	return r.redisMaster.SAdd(key, members...)
+	return integerReply(r.master().Do("SADD", packArgs(key, members)...))
 }
 
 // SCard returns the set cardinality (number of elements) of the set stored at key.
 func (r *Redis) SCard(key string) (int64, error) {
-	return r.redisSlave.SCard(key)
+	return integerReply(r.slave().Do("SCARD", key))
 }
 
 // SDiff returns the members of the set resulting from the difference
@@ -21,7 +21,7 @@ func (r *Redis) SCard(key string) (int64, error) {
 // Keys that do not exist are considered to be empty sets.
 // Multi-bulk reply: list with members of the resulting set.
 func (r *Redis) SDiff(keys ...string) ([]string, error) {
-	return r.redisSlave.SDiff(keys...)
+	return stringsReply(r.slave().Do("SDIFF", keys...))
 }
 
 // SDiffStore is equal to SDIFF, but instead of returning the resulting set,
@@ -29,13 +29,13 @@ func (r *Redis) SDiff(keys ...string) ([]string, error) {
 // If destination already exists, it is overwritten.
 // Integer reply: the number of elements in the resulting set.
 func (r *Redis) SDiffStore(destination string, keys ...string) (int64, error) {
-	return r.redisMaster.SDiffStore(destination, keys...)
+	return integerReply(r.master().Do("SDIFFSTORE", packArgs(destination, keys)...))
 }
 
 // SInter returns the members of the set resulting from the intersection of all the given sets.
 // Multi-bulk reply: list with members of the resulting set.
 func (r *Redis) SInter(keys ...string) ([]string, error) {
-	return r.redisSlave.SInter(keys...)
+	return stringsReply(r.slave().Do("SINTER", keys...))
 }
 
 // SInterStore is equal to SINTER, but instead of returning the resulting set,
@@ -43,37 +43,37 @@ func (r *Redis) SInter(keys ...string) ([]string, error) {
 // If destination already exists, it is overwritten.
 // Integer reply: the number of elements in the resulting set.
 func (r *Redis) SInterStore(destination string, keys ...string) (int64, error) {
-	return r.redisMaster.SInterStore(destination, keys...)
+	return integerReply(r.master().Do("SINTERSTORE", packArgs(destination, keys)...))
 }
 
 // SIsMember returns if member is a member of the set stored at key.
 func (r *Redis) SIsMember(key, member string) (bool, error) {
-	return r.redisSlave.SIsMember(key, member)
+	return boolReply(r.slave().Do("SISMEMBER", key, member))
 }
 
 // SMembers returns all the members of the set value stored at key.
 func (r *Redis) SMembers(key string) ([]string, error) {
-	return r.redisSlave.SMembers(key)
+	return stringsReply(r.slave().Do("SMEMBERS", key))
 }
 
 // SMove moves member from the set at source to the set at destination.
 // This operation is atomic.
 // In every given moment the element will appear to be a member of source or destination for other clients.
 func (r *Redis) SMove(source, destination, member string) (bool, error) {
-	return r.redisMaster.SMove(source, destination, member)
+	return boolReply(r.master().Do("SMOVE", source, destination, member))
 }
 
 // SPop removes and returns a random element from the set value stored at key.
 // Bulk reply: the removed element, or nil when key does not exist.
 func (r *Redis) SPop(key string) ([]byte, error) {
-	return r.redisMaster.SPop(key)
+	return bytesReply(r.master().Do("SPOP", key))
 }
 
 // SRandMember returns a random element from the set value stored at key.
 // Bulk reply: the command returns a Bulk Reply with the randomly selected element,
 // or nil when key does not exist.
 func (r *Redis) SRandMember(key string) ([]byte, error) {
-	return r.redisSlave.SRandMember(key)
+	return bytesReply(r.slave().Do("SRANDMEMBER", key))
 }
 
 // SRandMemberCount returns an array of count distinct elements if count is positive.
@@ -82,7 +82,7 @@ func (r *Redis) SRandMember(key string) ([]byte, error) {
 // In this case the numer of returned elements is the absolute value of the specified count.
 // returns an array of elements, or an empty array when key does not exist.
 func (r *Redis) SRandMemberCount(key string, count int) ([]string, error) {
-	return r.redisSlave.SRandMemberCount(key, count)
+	return stringsReply(r.slave().Do("SRANDMEMBER", packArgs(key, count)...))
 }
 
 // SRem remove the specified members from the set stored at key.
@@ -92,23 +92,23 @@ func (r *Redis) SRandMemberCount(key string, count int) ([]string, error) {
 // Integer reply: the number of members that were removed from the set,
 // not including non existing members.
 func (r *Redis) SRem(key string, members ...string) (int64, error) {
-	return r.redisMaster.SRem(key, members...)
+	return integerReply(r.master().Do("SREM", packArgs(key, members)...))
 }
 
 // SUnion returns the members of the set resulting from the union of all the given sets.
 // Multi-bulk reply: list with members of the resulting set.
 func (r *Redis) SUnion(keys ...string) ([]string, error) {
-	return r.redisSlave.SUnion(keys...)
+	return stringsReply(r.slave().Do("SUNION", keys...))
 }
 
 // SUnionStore is equal to SUnion.
 // If destination already exists, it is overwritten.
 // Integer reply: the number of elements in the resulting set.
 func (r *Redis) SUnionStore(destination string, keys ...string) (int64, error) {
-	return r.redisMaster.SUnionStore(destination, keys...)
+	return integerReply(r.master().Do("SUNIONSTORE", packArgs(destination, keys)...))
 }
 
 // SScan key cursor [MATCH pattern] [COUNT count]
 func (r *Redis) SScan(key string, cursor uint64, pattern string, count int) (uint64, []string, error) {
-	return r.redisSlave.SScan(key, cursor, pattern, count)
+	return scanReply(r.slave().Do("SSCAN", packArgs(key, scanArgs(cursor, pattern, count))...))
 }
@@ -11,20 +11,24 @@ package xredis
 // The number of elements added to the sorted sets,
 // not including elements already existing for which the score was updated.
 func (r *Redis) ZAdd(key string, pairs map[string]float64) (int64, error) {
-	return r.redisMaster.ZAdd(key, pairs)
+	args := []string{key}
+	for member, score := range pairs {
+		args = append(args, packArgs(score, member)...)
+	}
+	return integerReply(r.master().Do("ZADD", args...))
 }
 
 // ZCard returns the sorted set cardinality (number of elements) of the sorted set stored at key.
 // Integer reply: the cardinality (number of elements) of the sorted set, or 0 if key does not exist.
 func (r *Redis) ZCard(key string) (int64, error) {
-	return r.redisSlave.ZCard(key)
+	return integerReply(r.slave().Do("ZCARD", key))
 }
 
 // ZCount returns the number of elements in the sorted set at key with a score between min and max.
 // The min and max arguments have the same semantic as described for ZRANGEBYSCORE.
 // Integer reply: the number of elements in the specified score range.
 func (r *Redis) ZCount(key, min, max string) (int64, error) {
-	return r.redisSlave.ZCount(key, min, max)
+	return integerReply(r.slave().Do("ZCOUNT", key, min, max))
 }
 
 // ZIncrBy increments the score of member in the sorted set stored at key by increment.
@@ -34,18 +38,18 @@ func (r *Redis) ZCount(key, min, max string) (int64, error) {
 // An error is returned when key exists but does not hold a sorted set.
 // Bulk reply: the new score of member (a double precision floating point number), represented as string.
 func (r *Redis) ZIncrBy(key string, increment float64, member string) (float64, error) {
-	return r.redisMaster.ZIncrBy(key, increment, member)
+	return floatReply(r.master().Do("ZINCRBY", packArgs(key, increment, member)...))
 }
 
 // ZInterStore destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
 func (r *Redis) ZInterStore(destination string, keys []string, weights []int, aggregate string) (int64, error) {
-	return r.redisMaster.ZInterStore(destination, keys, weights, aggregate)
+	return integerReply(r.master().Do("ZINTERSTORE", storeArgs(destination, keys, weights, aggregate)...))
 }
 
 // ZLexCount returns the number of elements in the sorted set at key
 // with a value between min and max in order to force lexicographical ordering.
 func (r *Redis) ZLexCount(key, min, max string) (int64, error) {
-	return r.redisSlave.ZLexCount(key, min, max)
+	return integerReply(r.slave().Do("ZLEXCOUNT", key, min, max))
 }
 
 // ZRange returns the specified range of elements in the sorted set stored at key.
@@ -56,18 +60,33 @@ func (r *Redis) ZLexCount(key, min, max string) (int64, error) {
 // together with the elements.
 // The returned list will contain value1,score1,...,valueN,scoreN instead of value1,...,valueN.
 func (r *Redis) ZRange(key string, start, stop int, withscores bool) ([]string, error) {
-	return r.redisSlave.ZRange(key, start, stop, withscores)
+	args := packArgs(key, start, stop)
+	if withscores {
+		args = append(args, "WITHSCORES")
+	}
+	return stringsReply(r.slave().Do("ZRANGE", args...))
 }
 
 // ZRangeByLex returns all the elements in the sorted set at key with a value between min and max
 // in order to force lexicographical ordering.
 func (r *Redis) ZRangeByLex(key, min, max string, limit bool, offset, count int) ([]string, error) {
-	return r.redisSlave.ZRangeByLex(key, min, max, limit, offset, count)
+	args := []string{key, min, max}
+	if limit {
+		args = append(args, packArgs("LIMIT", offset, count)...)
+	}
+	return stringsReply(r.slave().Do("ZRANGEBYLEX", args...))
 }
 
 // ZRangeByScore key min max [WITHSCORES] [LIMIT offset count]
 func (r *Redis) ZRangeByScore(key, min, max string, withscores, limit bool, offset, count int) ([]string, error) {
-	return r.redisSlave.ZRangeByScore(key, min, max, withscores, limit, offset, count)
+	args := []string{key, min, max}
+	if withscores {
+		args = append(args, "WITHSCORES")
+	}
+	if limit {
+		args = append(args, packArgs("LIMIT", offset, count)...)
+	}
+	return stringsReply(r.slave().Do("ZRANGEBYSCORE", args...))
 }
 
 // ZRank returns the rank of member in the sorted set stored at key,
@@ -78,7 +97,11 @@ func (r *Redis) ZRangeByScore(key, min, max string, withscores, limit bool, offs
 // If member does not exist in the sorted set or key does not exist, Bulk reply: nil.
 // -1 represent the nil bulk rely.
 func (r *Redis) ZRank(key, member string) (int64, error) {
-	return r.redisSlave.ZRank(key, member)
+	reply, err := r.slave().Do("ZRANK", key, member)
+	if reply == nil && err == nil {
+		return -1, nil // not a member
+	}
+	return integerReply(reply, err)
 }
 
 // ZRem removes the specified members from the sorted set stored at key. Non existing members are ignored.
@@ -86,13 +109,13 @@ func (r *Redis) ZRank(key, member string) (int64, error) {
 // Integer reply, specifically:
 // The number of members removed from the sorted set, not including non existing members.
 func (r *Redis) ZRem(key string, members ...string) (int64, error) {
-	return r.redisMaster.ZRem(key, members...)
+	return integerReply(r.master().Do("ZREM", packArgs(key, members)...))
 }
 
 // ZRemRangeByLex removes all elements in the sorted set stored at key
 // between the lexicographical range specified by min and max.
 func (r *Redis) ZRemRangeByLex(key, min, max string) (int64, error) {
-	return r.redisMaster.ZRemRangeByLex(key, min, max)
+	return integerReply(r.master().Do("ZREMRANGEBYLEX", key, min, max))
 }
 
 // ZRemRangeByRank removes all elements in the sorted set stored at key with rank between start and stop.
@@ -101,13 +124,13 @@ func (r *Redis) ZRemRangeByLex(key, min, max string) (int64, error) {
 // For example: -1 is the element with the highest score, -2 the element with the second highest score and so forth.
 // Integer reply: the number of elements removed.
 func (r *Redis) ZRemRangeByRank(key string, start, stop int) (int64, error) {
-	return r.redisMaster.ZRemRangeByRank(key, start, stop)
+	return integerReply(r.master().Do("ZREMRANGEBYRANK", packArgs(key, start, stop)...))
 }
 
 // ZRemRangeByScore removes all elements in the sorted set stored at key with a score between min and max (inclusive).
 // Integer reply: the number of elements removed.
 func (r *Redis) ZRemRangeByScore(key, min, max string) (int64, error) {
-	return r.redisMaster.ZRemRangeByScore(key, min, max)
+	return integerReply(r.master().Do("ZREMRANGEBYSCORE", key, min, max))
 }
 
 // ZRevRange returns the specified range of elements in the sorted set stored at key.
@@ -115,34 +138,64 @@ func (r *Redis) ZRemRangeByScore(key, min, max string) (int64, error) {
 // Descending lexicographical order is used for elements with equal score.
 // Multi-bulk reply: list of elements in the specified range (optionally with their scores).
 func (r *Redis) ZRevRange(key string, start, stop int, withscores bool) ([]string, error) {
-	return r.redisSlave.ZRevRange(key, start, stop, withscores)
+	args := packArgs(key, start, stop)
+	if withscores {
+		args = append(args, "WITHSCORES")
+	}
+	return stringsReply(r.slave().Do("ZREVRANGE", args...))
 }
 
 // ZRevRangeByScore key max min [WITHSCORES] [LIMIT offset count]
 func (r *Redis) ZRevRangeByScore(key, max, min string, withscores, limit bool, offset, count int) ([]string, error) {
-	return r.redisSlave.ZRevRangeByScore(key, max, min, withscores, limit, offset, count)
+	args := []string{key, max, min}
+	if withscores {
+		args = append(args, "WITHSCORES")
+	}
+	if limit {
+		args = append(args, packArgs("LIMIT", offset, count)...)
+	}
+	return stringsReply(r.slave().Do("ZREVRANGEBYSCORE", args...))
 }
 
 // ZRevRank returns the rank of member in the sorted set stored at key,
 // with the scores ordered from high to low. The rank (or index) is 0-based,
 // which means that the member with the highest score has rank 0.
 func (r *Redis) ZRevRank(key, member string) (int64, error) {
-	return r.redisSlave.ZRevRank(key, member)
+	reply, err := r.slave().Do("ZREVRANK", key, member)
+	if reply == nil && err == nil {
+		return -1, nil // not a member
+	}
+	return integerReply(reply, err)
 }
 
 // ZScore returns the score of member in the sorted set at key.
 // If member does not exist in the sorted set, or key does not exist, nil is returned.
 // Bulk reply: the score of member (a double precision floating point number), represented as string.
 func (r *Redis) ZScore(key, member string) ([]byte, error) {
-	return r.redisSlave.ZScore(key, member)
+	return bytesReply(r.slave().Do("ZSCORE", key, member))
 }
 
 // ZUnionStore destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
 func (r *Redis) ZUnionStore(destination string, keys []string, weights []int, aggregate string) (int64, error) {
-	return r.redisMaster.ZUnionStore(destination, keys, weights, aggregate)
+	return integerReply(r.master().Do("ZUNIONSTORE", storeArgs(destination, keys, weights, aggregate)...))
 }
 
 // ZScan key cursor [MATCH pattern] [COUNT count]
 func (r *Redis) ZScan(key string, cursor uint64, pattern string, count int) (uint64, []string, error) {
-	return r.redisSlave.ZScan(key, cursor, pattern, count)
+	return scanReply(r.slave().Do("ZSCAN", packArgs(key, scanArgs(cursor, pattern, count))...))
+}
+
+// storeArgs builds the arguments for ZINTERSTORE and ZUNIONSTORE
+func storeArgs(destination string, keys []string, weights []int, aggregate string) []string {
+	args := packArgs(destination, len(keys), keys)
+	if len(weights) > 0 {
+		args = append(args, "WEIGHTS")
+		for _, w := range weights {
+			args = append(args, itoa(w))
+		}
+	}
+	if aggregate != "" {
+		args = append(args, "AGGREGATE", aggregate)
+	}
+	return args
 }
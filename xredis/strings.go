@@ -1,15 +1,30 @@
 package xredis
 
+import (
+	"errors"
+)
+
+// ErrNotSet is returned by Set when NX or XX stopped the value being set
+var ErrNotSet = errors.New("xredis: key not set")
+
+func pairArgs(pairs map[string]string) []string {
+	args := make([]string, 0, len(pairs)*2)
+	for key, value := range pairs {
+		args = append(args, key, value)
+	}
+	return args
+}
+
 // Append appends the value at the end of the string which stored at key
 // If key does not exist it is created and set as an empty string.
 // Return integer reply: the length of the string after the append operation.
 func (r *Redis) Append(key, value string) (int64, error) {
-	return r.redisMaster.Append(key, value)
+	return integerReply(r.master().Do("APPEND", key, value))
 }
 
 // BitCount counts the number of set bits (population counting) in a string.
 func (r *Redis) BitCount(key string, start, end int) (int64, error) {
-	return r.redisSlave.BitCount(key, start, end)
+	return integerReply(r.slave().Do("BITCOUNT", packArgs(key, start, end)...))
 }
 
 // BitOp performs a bitwise operation between multiple keys (containing string values)
@@ -23,7 +38,7 @@ func (r *Redis) BitCount(key string, start, end int) (int64, error) {
 // Return value: Integer reply
 // The size of the string stored in the destination key, that is equal to the size of the longest input string.
 func (r *Redis) BitOp(operation, destkey string, keys ...string) (int64, error) {
-	return r.redisMaster.BitOp(operation, destkey, keys...)
+	return integerReply(r.master().Do("BITOP", packArgs(operation, destkey, keys)...))
 }
 
 // Decr decrements the number stored at key by one.
@@ -33,12 +48,12 @@ func (r *Redis) BitOp(operation, destkey string, keys ...string) (int64, error)
 // This operation is limited to 64 bit signed integers.
 // Integer reply: the value of key after the decrement
 func (r *Redis) Decr(key string) (int64, error) {
-	return r.redisMaster.Decr(key)
+	return integerReply(r.master().Do("DECR", key))
 }
 
 // DecrBy decrements the number stored at key by decrement.
 func (r *Redis) DecrBy(key string, decrement int) (int64, error) {
-	return r.redisMaster.DecrBy(key, decrement)
+	return integerReply(r.master().Do("DECRBY", packArgs(key, decrement)...))
 }
 
 // Get gets the value of key.
@@ -46,7 +61,7 @@ func (r *Redis) DecrBy(key string, decrement int) (int64, error) {
 // An error is returned if the value stored at key is not a string,
 // because GET only handles string values.
 func (r *Redis) Get(key string) ([]byte, error) {
-	return r.redisSlave.Get(key)
+	return bytesReply(r.slave().Do("GET", key))
 }
 
 // GetBit returns the bit value at offset in the string value stored at key.
@@ -55,7 +70,7 @@ func (r *Redis) Get(key string) ([]byte, error) {
 // When key does not exist it is assumed to be an empty string,
 // so offset is always out of range and the value is also assumed to be a contiguous space with 0 bits.
 func (r *Redis) GetBit(key string, offset int) (int64, error) {
-	return r.redisSlave.GetBit(key, offset)
+	return integerReply(r.slave().Do("GETBIT", packArgs(key, offset)...))
 }
 
 // GetRange returns the substring of the string value stored at key,
@@ -64,13 +79,13 @@ func (r *Redis) GetBit(key string, offset int) (int64, error) {
 // So -1 means the last character, -2 the penultimate and so forth.
 // The function handles out of range requests by limiting the resulting range to the actual length of the string.
 func (r *Redis) GetRange(key string, start, end int) (string, error) {
-	return r.redisSlave.GetRange(key, start, end)
+	return stringReply(r.slave().Do("GETRANGE", packArgs(key, start, end)...))
 }
 
 // GetSet atomically sets key to value and returns the old value stored at key.
 // Returns an error when key exists but does not hold a string value.
 func (r *Redis) GetSet(key, value string) ([]byte, error) {
-	return r.redisMaster.GetSet(key, value)
+	return bytesReply(r.master().Do("GETSET", key, value))
 }
 
 // Incr increments the number stored at key by one.
@@ -79,7 +94,7 @@ func (r *Redis) GetSet(key, value string) ([]byte, error) {
 // or contains a string that can not be represented as integer.
 // Integer reply: the value of key after the increment
 func (r *Redis) Incr(key string) (int64, error) {
-	return r.redisMaster.Incr(key)
+	return integerReply(r.master().Do("INCR", key))
 }
 
 // IncrBy increments the number stored at key by increment.
@@ -88,7 +103,7 @@ func (r *Redis) Incr(key string) (int64, error) {
 // or contains a string that can not be represented as integer.
 // Integer reply: the value of key after the increment
 func (r *Redis) IncrBy(key string, increment int) (int64, error) {
-	return r.redisMaster.IncrBy(key, increment)
+	return integerReply(r.master().Do("INCRBY", packArgs(key, increment)...))
 }
 
 // IncrByFloat increments the string representing a floating point number
@@ -100,7 +115,7 @@ func (r *Redis) IncrBy(key string, increment int) (int64, error) {
 // as a double precision floating point number.
 // Return bulk reply: the value of key after the increment.
 func (r *Redis) IncrByFloat(key string, increment float64) (float64, error) {
-	return r.redisMaster.IncrByFloat(key, increment)
+	return floatReply(r.master().Do("INCRBYFLOAT", packArgs(key, increment)...))
 }
 
 // MGet returns the values of all specified keys.
@@ -108,14 +123,14 @@ func (r *Redis) IncrByFloat(key string, increment float64) (float64, error) {
 // the special value nil is returned. Because of this, the operation never fails.
 // Multi-bulk reply: list of values at the specified keys.
 func (r *Redis) MGet(keys ...string) ([][]byte, error) {
-	return r.redisSlave.MGet(keys...)
+	return bytesSliceReply(r.slave().Do("MGET", keys...))
 }
 
 // MSet sets the given keys to their respective values.
 // MSET replaces existing values with new values, just as regular SET.
 // See MSETNX if you don't want to overwrite existing values.
 func (r *Redis) MSet(pairs map[string]string) error {
-	return r.redisMaster.MSet(pairs)
+	return okReply(r.master().Do("MSET", pairArgs(pairs)...))
 }
 
 // MSetnx sets the given keys to their respective values.
@@ -123,53 +138,69 @@ func (r *Redis) MSet(pairs map[string]string) error {
 // True if the all the keys were set.
 // False if no key was set (at least one key already existed).
 func (r *Redis) MSetnx(pairs map[string]string) (bool, error) {
-	return r.redisMaster.MSetnx(pairs)
+	return boolReply(r.master().Do("MSETNX", pairArgs(pairs)...))
 }
 
 // PSetex works exactly like SETEX with the sole difference that
 // the expire time is specified in milliseconds instead of seconds.
 func (r *Redis) PSetex(key string, milliseconds int, value string) error {
-	return r.redisMaster.PSetex(key, milliseconds, value)
+	return okReply(r.master().Do("PSETEX", packArgs(key, milliseconds, value)...))
 }
 
 // Set sets key to hold the string value.
 // If key already holds a value, it is overwritten, regardless of its type.
 // Any previous time to live associated with the key is discarded on successful SET operation.
 func (r *Redis) Set(key, value string, seconds, milliseconds int, mustExists, mustNotExists bool) error {
-	return r.redisMaster.Set(key, value, seconds, milliseconds, mustExists, mustNotExists)
+	args := []string{key, value}
+	if seconds > 0 {
+		args = append(args, "EX", itoa(seconds))
+	}
+	if milliseconds > 0 {
+		args = append(args, "PX", itoa(milliseconds))
+	}
+	if mustExists {
+		args = append(args, "XX")
+	} else if mustNotExists {
+		args = append(args, "NX")
+	}
+	reply, err := r.master().Do("SET", args...)
+	if reply == nil && err == nil {
+		return ErrNotSet
+	}
+	return okReply(reply, err)
 }
 
 // SimpleSet do SET key value, no other arguments.
 func (r *Redis) SimpleSet(key, value string) error {
-	return r.redisMaster.SimpleSet(key, value)
+	return okReply(r.master().Do("SET", key, value))
 }
 
 // SetBit sets or clears the bit at offset in the string value stored at key.
 // Integer reply: the original bit value stored at offset.
 func (r *Redis) SetBit(key string, offset, value int) (int64, error) {
-	return r.redisMaster.SetBit(key, offset, value)
+	return integerReply(r.master().Do("SETBIT", packArgs(key, offset, value)...))
 }
 
 // Setex sets key to hold the string value and set key to timeout after a given number of seconds.
 func (r *Redis) Setex(key string, seconds int, value string) error {
-	return r.redisMaster.Setex(key, seconds, value)
+	return okReply(r.master().Do("SETEX", packArgs(key, seconds, value)...))
 }
 
 // Setnx sets key to hold string value if key does not exist.
 func (r *Redis) Setnx(key, value string) (bool, error) {
-	return r.redisMaster.Setnx(key, value)
+	return boolReply(r.master().Do("SETNX", key, value))
 }
 
 // SetRange overwrites part of the string stored at key, starting at the specified offset,
 // for the entire length of value.
 // Integer reply: the length of the string after it was modified by the command.
 func (r *Redis) SetRange(key string, offset int, value string) (int64, error) {
-	return r.redisMaster.SetRange(key, offset, value)
+	return integerReply(r.master().Do("SETRANGE", packArgs(key, offset, value)...))
 }
 
 // StrLen returns the length of the string value stored at key.
 // An error is returned when key holds a non-string value.
 // Integer reply: the length of the string at key, or 0 when key does not exist.
 func (r *Redis) StrLen(key string) (int64, error) {
-	return r.redisSlave.StrLen(key)
+	return integerReply(r.slave().Do("STRLEN", key))
 }
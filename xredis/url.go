@@ -0,0 +1,86 @@
+package xredis
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	REDIS_URL_SCHEME     = "redis"
+	REDIS_TLS_URL_SCHEME = "rediss"
+	REDIS_DEFAULT_PORT   = "6379"
+)
+
+// KEYSPACE_NOTIFICATION_PREFIX is the channel prefix redis publishes keyspace
+// notifications on for a database
+const KEYSPACE_NOTIFICATION_PREFIX = "__keyspace@%d__:"
+
+func KeyspacePrefix(database int) string {
+	return fmt.Sprintf(KEYSPACE_NOTIFICATION_PREFIX, database)
+}
+
+// ApplyURL sets the address, credentials, database and TLS from either a plain
+// host:port or a URL like redis://[[username]:password@]host[:port][/database],
+// rediss:// connects over TLS
+func (config *PoolConfig) ApplyURL(address string) error {
+	if !strings.Contains(address, "://") {
+		config.Address = address
+		return nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case REDIS_URL_SCHEME:
+		config.TLS = nil
+	case REDIS_TLS_URL_SCHEME:
+		// the server name is filled in from the address when dialing, so it
+		// follows a sentinel failover
+		config.TLS = &tls.Config{}
+	default:
+		return fmt.Errorf("xredis: unknown url scheme %s", u.Scheme)
+	}
+	host, port := u.Host, REDIS_DEFAULT_PORT
+	if h, p, err := net.SplitHostPort(u.Host); err == nil {
+		host, port = h, p
+	}
+	if host == "" {
+		return fmt.Errorf("xredis: no host in url")
+	}
+	config.Address = net.JoinHostPort(host, port)
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			config.Username = u.User.Username()
+			config.Password = password
+		} else {
+			// redis://password@host is common enough to allow
+			config.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		config.Database, err = strconv.Atoi(db)
+		if err != nil || config.Database < 0 {
+			return fmt.Errorf("xredis: invalid database %s", db)
+		}
+	}
+	return nil
+}
+
+// RedactURL hides the password in a redis url so it can be logged
+func RedactURL(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	} else {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}